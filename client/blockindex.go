@@ -0,0 +1,633 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// The content of every version of a file is split into blocks of at most BlockSize bytes,
+// found through an index tree whose root is kept in the signed meta. Every entry of the tree
+// holds the length of the content below it and the hash of the ciphertext it points at, so
+// any range of the file is read and checked without touching the rest, and readers who hold
+// the file keys still cannot forge blocks or index nodes.
+//
+// The signed root hash pins every hash and length below it, so blocks cannot be reordered,
+// spliced in from another file or dropped without the read that reaches them failing.
+//
+// Index nodes are encoded with a fixed size however full they are, so an append always
+// rewrites the same number of bytes until the tree grows a level.
+//
+// Blocks of deduplicated versions are chunks shared with the owner's other files (see
+// dedup.go). They are sealed under a key of their own, which their index entry carries.
+
+const BlockSize = 64 * 1024 // largest block, longer content is split
+const IndexFanout = 32      // entries per index node
+
+const hashSize = 64     // length of userlib.Hash
+const chunkKeySize = 16 // length of the key a chunk is sealed under
+const indexEntrySize = LENGTH + 8 + hashSize + chunkKeySize
+const indexNodeSize = 4 + IndexFanout*indexEntrySize
+
+const fileFlagCompressed = 1 // first byte of an encoded File record whose contents are compressed
+
+// FileTree is the content of one version of a file.
+type FileTree struct {
+	FileSourcekey []byte // used as source key to generate file and index keys
+	Root          userlib.UUID
+	RootHash      []byte // hash of the ciphertext of the root index node
+	Depth         int    // levels of index nodes, 1 when the root points at blocks
+	Compressed    bool   // blocks appended or overwritten in the tree are compressed
+}
+
+// IndexEntry points at a block, or at an index node one level down.
+type IndexEntry struct {
+	UUID   userlib.UUID
+	Length int    // bytes of file content below the entry
+	Hash   []byte // hash of the ciphertext of the record the entry points at
+	Key    []byte // source key of a deduplicated chunk, nil for blocks under the file key
+}
+
+// IndexNode is one node of the index tree, leaves point at blocks.
+type IndexNode struct {
+	Entries []IndexEntry
+}
+
+func EncodeIndexNode(node IndexNode) (data []byte) {
+	data = make([]byte, 0, indexNodeSize)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(node.Entries)))
+	for _, entry := range node.Entries {
+		data = append(data, entry.UUID[:]...)
+		data = binary.BigEndian.AppendUint64(data, uint64(entry.Length))
+		data = append(data, entry.Hash...)
+		data = append(data, entry.Key...)
+		data = append(data, make([]byte, chunkKeySize-len(entry.Key))...)
+	}
+	// pad so every node has the same size
+	return append(data, make([]byte, indexNodeSize-len(data))...)
+}
+
+func DecodeIndexNode(data []byte) (node IndexNode, err error) {
+	if len(data) != indexNodeSize {
+		return IndexNode{}, errors.New("index node has the wrong size")
+	}
+	count := int(binary.BigEndian.Uint32(data))
+	if count > IndexFanout {
+		return IndexNode{}, errors.New("index node has too many entries")
+	}
+	data = data[4:]
+	for i := 0; i < count; i++ {
+		var entry IndexEntry
+		copy(entry.UUID[:], data[:LENGTH])
+		entry.Length = int(binary.BigEndian.Uint64(data[LENGTH:]))
+		entry.Hash = append([]byte{}, data[LENGTH+8:LENGTH+8+hashSize]...)
+		if key := data[LENGTH+8+hashSize : indexEntrySize]; !bytes.Equal(key, make([]byte, chunkKeySize)) {
+			entry.Key = append([]byte{}, key...)
+		}
+		node.Entries = append(node.Entries, entry)
+		data = data[indexEntrySize:]
+	}
+	return node, nil
+}
+
+// encodes a File record as a flags byte followed by the contents
+func EncodeFile(fileStruct File) (data []byte) {
+	data = make([]byte, 0, 1+len(fileStruct.Contents))
+	if fileStruct.Compressed {
+		data = append(data, fileFlagCompressed)
+	} else {
+		data = append(data, 0)
+	}
+	return append(data, fileStruct.Contents...)
+}
+
+// decodes a File record, which blocks written before the binary encoding hold as JSON
+func DecodeFile(data []byte) (fileStruct File, err error) {
+	if len(data) == 0 {
+		return File{}, errors.New("file record is empty")
+	}
+	if data[0] == '{' {
+		err = json.Unmarshal(data, &fileStruct)
+		return fileStruct, err
+	}
+	if data[0]&^fileFlagCompressed != 0 {
+		return File{}, errors.New("file record has unknown flags")
+	}
+	return File{Contents: data[1:], Compressed: data[0] == fileFlagCompressed}, nil
+}
+
+// seals block as a File record stored at blockUUID, compressing it first when asked
+func SealBlock(blockUUID userlib.UUID, block []byte, compressed bool, fileEncryptKey, fileHMACKey []byte) (value, hash []byte, err error) {
+	fileStruct := File{Contents: block}
+	if compressed {
+		fileStruct, err = CompressBlock(block)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return SealFileRecord(RecordBlock, blockUUID, EncodeFile(fileStruct), fileEncryptKey, fileHMACKey)
+}
+
+// encrypts and macs an encoded block or index node stored at UUID and returns its datastore value and the hash the index keeps for it
+func SealFileRecord(recordType RecordType, UUID userlib.UUID, data []byte, fileEncryptKey, fileHMACKey []byte) (value, hash []byte, err error) {
+	msg, tag, err := EncryptBytesThenMac(recordType, UUID, data, fileEncryptKey, fileHMACKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err = GenerateUUIDVal(recordType, msg, tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	return value, userlib.Hash(msg), nil
+}
+
+// returns the keys the block an entry points at is sealed under
+func BlockKeys(entry IndexEntry, fileEncryptKey, fileHMACKey []byte) (blockEncryptKey, blockHMACKey []byte, err error) {
+	if entry.Key == nil {
+		return fileEncryptKey, fileHMACKey, nil
+	}
+	blockEncryptKey, blockHMACKey, err = GetTwoHASHKDFKeys(entry.Key, ENCRYPT, MAC)
+	if err != nil {
+		return nil, nil, errors.New("failed to get keys for chunk")
+	}
+	return blockEncryptKey, blockHMACKey, nil
+}
+
+func LoadBlock(datastore Datastore, entry IndexEntry, fileEncryptKey, fileHMACKey []byte) (contents []byte, err error) {
+	blockEncryptKey, blockHMACKey, err := BlockKeys(entry, fileEncryptKey, fileHMACKey)
+	if err != nil {
+		return nil, err
+	}
+	fileStruct, fileMsg, err := UnpackCheckTagAndDecryptFile(datastore, entry.UUID, blockEncryptKey, blockHMACKey)
+	if err != nil {
+		return nil, err
+	}
+	// an authentic block the index does not point at is an older copy of it
+	if !userlib.HMACEqual(userlib.Hash(fileMsg), entry.Hash) {
+		return nil, ErrRollback
+	}
+	contents, err = DecompressBlock(fileStruct)
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) != entry.Length {
+		return nil, errors.New("integrity check failed: File block does not match the index")
+	}
+	return contents, nil
+}
+
+func LoadIndexNode(datastore Datastore, entry IndexEntry, fileEncryptKey, fileHMACKey []byte) (node IndexNode, err error) {
+	// check if node exists, unpack, check tag and hash, and decrypt
+	nodeValue, ok := datastore.Get(entry.UUID)
+	if !ok {
+		return IndexNode{}, errors.New("index node was not found in DataStore")
+	}
+	nodeMsg, _, err := OpenRecord(datastore, entry.UUID, nodeValue, RecordIndexNode, fileHMACKey)
+	if err != nil {
+		return IndexNode{}, errors.New("integrity check failed: index node has unauthorized modifications")
+	}
+	if !userlib.HMACEqual(userlib.Hash(nodeMsg), entry.Hash) {
+		return IndexNode{}, ErrRollback
+	}
+	// nodes written before the binary encoding hold it as a JSON string
+	data := userlib.SymDec(fileEncryptKey, nodeMsg)
+	if len(data) != indexNodeSize {
+		var legacy []byte
+		err = json.Unmarshal(data, &legacy)
+		if err != nil {
+			return IndexNode{}, errors.New("index node could not be decrypted")
+		}
+		data = legacy
+	}
+	return DecodeIndexNode(data)
+}
+
+// splits content into blocks of at most BlockSize bytes, empty content has no blocks
+func SplitBlocks(content []byte) (blocks [][]byte) {
+	for len(content) > BlockSize {
+		blocks = append(blocks, content[:BlockSize])
+		content = content[BlockSize:]
+	}
+	if len(content) > 0 {
+		blocks = append(blocks, content)
+	}
+	return
+}
+
+// seals each block at a new UUID into records and returns the entries pointing at them
+func AddBlocks(records map[userlib.UUID][]byte, content []byte, compressed bool, fileEncryptKey, fileHMACKey []byte) (entries []IndexEntry, err error) {
+	for _, block := range SplitBlocks(content) {
+		entry := IndexEntry{UUID: uuid.New(), Length: len(block)}
+		records[entry.UUID], entry.Hash, err = SealBlock(entry.UUID, block, compressed, fileEncryptKey, fileHMACKey)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// seals node at nodeUUID into records and returns the entry pointing at it
+func AddIndexNode(records map[userlib.UUID][]byte, nodeUUID userlib.UUID, node IndexNode, fileEncryptKey, fileHMACKey []byte) (entry IndexEntry, err error) {
+	entry.UUID = nodeUUID
+	for _, child := range node.Entries {
+		entry.Length += child.Length
+	}
+	records[nodeUUID], entry.Hash, err = SealFileRecord(RecordIndexNode, nodeUUID, EncodeIndexNode(node), fileEncryptKey, fileHMACKey)
+	return entry, err
+}
+
+// writes content as a new tree under a new file key, with compressed blocks when compressed
+func WriteFileTree(userdata *User, content []byte, compressed bool) (tree FileTree, err error) {
+	tree.FileSourcekey, err = GetRandomKey(userdata)
+	if err != nil {
+		return FileTree{}, errors.New("failed to get file sourcekey")
+	}
+	fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(tree.FileSourcekey, ENCRYPT, MAC)
+	if err != nil {
+		return FileTree{}, errors.New("failed to get keys for File")
+	}
+
+	// Seal the blocks, then build the index over them
+	records := make(map[userlib.UUID][]byte)
+	entries, err := AddBlocks(records, content, compressed, fileEncryptKey, fileHMACKey)
+	if err != nil {
+		return FileTree{}, err
+	}
+	tree, err = BuildFileTree(records, tree.FileSourcekey, compressed, entries)
+	if err != nil {
+		return FileTree{}, err
+	}
+
+	err = userdata.datastore.SetBatch(records)
+	if err != nil {
+		return FileTree{}, err
+	}
+	return tree, nil
+}
+
+// seals the index over blocks already sealed under fileSourceKey into records, bottom up
+// until a single root is left. No blocks still gives a root, an empty leaf.
+func BuildFileTree(records map[userlib.UUID][]byte, fileSourceKey []byte, compressed bool, entries []IndexEntry) (tree FileTree, err error) {
+	fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(fileSourceKey, ENCRYPT, MAC)
+	if err != nil {
+		return FileTree{}, errors.New("failed to get keys for File")
+	}
+	tree.FileSourcekey, tree.Compressed = fileSourceKey, compressed
+	level := entries
+	for {
+		var parents []IndexEntry
+		for start := 0; start == 0 || start < len(level); start += IndexFanout {
+			end := minInt(start+IndexFanout, len(level))
+			parent, err := AddIndexNode(records, uuid.New(), IndexNode{Entries: level[start:end]}, fileEncryptKey, fileHMACKey)
+			if err != nil {
+				return FileTree{}, err
+			}
+			parents = append(parents, parent)
+		}
+		tree.Depth++
+		level = parents
+		if len(level) == 1 {
+			break
+		}
+	}
+	tree.Root, tree.RootHash = level[0].UUID, level[0].Hash
+	return tree, nil
+}
+
+// reads the whole tree, returning the content, the UUID of every block and index node that
+// belongs to the tree alone, and the UUID of every deduplicated chunk it uses
+func ReadFileTree(datastore Datastore, tree FileTree) (content []byte, records, chunks []userlib.UUID, err error) {
+	fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(tree.FileSourcekey, ENCRYPT, MAC)
+	if err != nil {
+		return nil, nil, nil, errors.New("failed to get keys for File")
+	}
+
+	var walk func(entry IndexEntry, depth int) error
+	walk = func(entry IndexEntry, depth int) error {
+		node, err := LoadIndexNode(datastore, entry, fileEncryptKey, fileHMACKey)
+		if err != nil {
+			return err
+		}
+		records = append(records, entry.UUID)
+		for _, child := range node.Entries {
+			if depth > 1 {
+				err = walk(child, depth-1)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			block, err := LoadBlock(datastore, child, fileEncryptKey, fileHMACKey)
+			if err != nil {
+				return err
+			}
+			content = append(content, block...)
+			if child.Key != nil {
+				chunks = append(chunks, child.UUID)
+			} else {
+				records = append(records, child.UUID)
+			}
+		}
+		return nil
+	}
+	err = walk(IndexEntry{UUID: tree.Root, Hash: tree.RootHash}, tree.Depth)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return content, records, chunks, nil
+}
+
+// returns the length of the content of the tree from its root
+func FileTreeLength(datastore Datastore, tree FileTree) (length int, err error) {
+	fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(tree.FileSourcekey, ENCRYPT, MAC)
+	if err != nil {
+		return 0, errors.New("failed to get keys for File")
+	}
+	root, err := LoadIndexNode(datastore, IndexEntry{UUID: tree.Root, Hash: tree.RootHash}, fileEncryptKey, fileHMACKey)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range root.Entries {
+		length += entry.Length
+	}
+	return length, nil
+}
+
+// reads content[offset:end] of the tree, only loading the index nodes and blocks that overlap it
+func ReadFileRange(datastore Datastore, tree FileTree, offset, end int) (content []byte, err error) {
+	fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(tree.FileSourcekey, ENCRYPT, MAC)
+	if err != nil {
+		return nil, errors.New("failed to get keys for File")
+	}
+
+	// offsets are relative to the start of the entry being read
+	var read func(entry IndexEntry, depth, offset, end int) error
+	read = func(entry IndexEntry, depth, offset, end int) error {
+		node, err := LoadIndexNode(datastore, entry, fileEncryptKey, fileHMACKey)
+		if err != nil {
+			return err
+		}
+		start := 0
+		for _, child := range node.Entries {
+			childEnd := start + child.Length
+			if childEnd > offset && start < end {
+				lo, hi := maxInt(offset, start)-start, minInt(end, childEnd)-start
+				if depth > 1 {
+					err = read(child, depth-1, lo, hi)
+					if err != nil {
+						return err
+					}
+				} else {
+					block, err := LoadBlock(datastore, child, fileEncryptKey, fileHMACKey)
+					if err != nil {
+						return err
+					}
+					content = append(content, block[lo:hi]...)
+				}
+			}
+			start = childEnd
+		}
+		return nil
+	}
+	err = read(IndexEntry{UUID: tree.Root, Hash: tree.RootHash}, tree.Depth, offset, end)
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// overwrites the content of the tree from offset with data, which must not run past the end.
+// Only the blocks overlapping the range and the index nodes above them are rewritten, in place.
+// Deduplicated chunks are shared, so they are copied to a new block instead and returned as released.
+func OverwriteFileRange(datastore Datastore, tree FileTree, offset int, data []byte) (updated FileTree, released []userlib.UUID, err error) {
+	fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(tree.FileSourcekey, ENCRYPT, MAC)
+	if err != nil {
+		return FileTree{}, nil, errors.New("failed to get keys for File")
+	}
+	records := make(map[userlib.UUID][]byte)
+
+	// offsets are relative to the start of the entry being written, returns the updated entry
+	var write func(entry IndexEntry, depth, offset int, data []byte) (IndexEntry, error)
+	write = func(entry IndexEntry, depth, offset int, data []byte) (IndexEntry, error) {
+		node, err := LoadIndexNode(datastore, entry, fileEncryptKey, fileHMACKey)
+		if err != nil {
+			return IndexEntry{}, err
+		}
+		start := 0
+		for i, child := range node.Entries {
+			childEnd := start + child.Length
+			if childEnd > offset && start < offset+len(data) {
+				lo, hi := maxInt(offset, start), minInt(offset+len(data), childEnd)
+				piece := data[lo-offset : hi-offset]
+				if depth > 1 {
+					node.Entries[i], err = write(child, depth-1, lo-start, piece)
+					if err != nil {
+						return IndexEntry{}, err
+					}
+				} else {
+					// only blocks the range covers partly have to be read first
+					block := append([]byte{}, piece...)
+					if lo != start || hi != childEnd {
+						block, err = LoadBlock(datastore, child, fileEncryptKey, fileHMACKey)
+						if err != nil {
+							return IndexEntry{}, err
+						}
+						copy(block[lo-start:], piece)
+					}
+					if child.Key != nil {
+						released = append(released, child.UUID)
+						node.Entries[i].UUID, node.Entries[i].Key = uuid.New(), nil
+					}
+					records[node.Entries[i].UUID], node.Entries[i].Hash, err = SealBlock(node.Entries[i].UUID, block, tree.Compressed, fileEncryptKey, fileHMACKey)
+					if err != nil {
+						return IndexEntry{}, err
+					}
+				}
+			}
+			start = childEnd
+		}
+		return AddIndexNode(records, entry.UUID, node, fileEncryptKey, fileHMACKey)
+	}
+	root, err := write(IndexEntry{UUID: tree.Root, Hash: tree.RootHash}, tree.Depth, offset, data)
+	if err != nil {
+		return FileTree{}, nil, err
+	}
+
+	err = datastore.SetBatch(records)
+	if err != nil {
+		return FileTree{}, nil, err
+	}
+	tree.RootHash = root.Hash
+	return tree, released, nil
+}
+
+// appends content to the tree. Only the new blocks and the rightmost index node of every
+// level are written, new nodes are only added once the rightmost ones are full.
+func AppendFileTree(datastore Datastore, tree FileTree, content []byte) (updated FileTree, err error) {
+	fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(tree.FileSourcekey, ENCRYPT, MAC)
+	if err != nil {
+		return FileTree{}, errors.New("failed to get keys for File")
+	}
+	records := make(map[userlib.UUID][]byte)
+	entries, err := AddBlocks(records, content, tree.Compressed, fileEncryptKey, fileHMACKey)
+	if err != nil {
+		return FileTree{}, err
+	}
+	tree, err = AppendIndexEntries(datastore, records, tree, entries)
+	if err != nil {
+		return FileTree{}, err
+	}
+
+	err = datastore.SetBatch(records)
+	if err != nil {
+		return FileTree{}, err
+	}
+	return tree, nil
+}
+
+// adds entries for blocks already sealed under the file key to the end of the tree,
+// sealing the rightmost path of the index into records
+func AppendIndexEntries(datastore Datastore, records map[userlib.UUID][]byte, tree FileTree, entries []IndexEntry) (updated FileTree, err error) {
+	fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(tree.FileSourcekey, ENCRYPT, MAC)
+	if err != nil {
+		return FileTree{}, errors.New("failed to get keys for File")
+	}
+
+	// Load the rightmost path, path[0] is the leaf and path[len(path)-1] the root
+	path, pathUUIDs, err := LoadRightmostPath(datastore, tree, fileEncryptKey, fileHMACKey)
+	if err != nil {
+		return FileTree{}, err
+	}
+
+	// push adds entry to the rightmost node of level. A full node is sealed as it is and a new
+	// rightmost node is started next to it, growing a new root when the old one was full.
+	var push func(level int, entry IndexEntry) error
+	push = func(level int, entry IndexEntry) error {
+		if len(path[level].Entries) < IndexFanout {
+			path[level].Entries = append(path[level].Entries, entry)
+			return nil
+		}
+		sealed, err := AddIndexNode(records, pathUUIDs[level], path[level], fileEncryptKey, fileHMACKey)
+		if err != nil {
+			return err
+		}
+		if level == len(path)-1 {
+			path = append(path, IndexNode{Entries: []IndexEntry{sealed}})
+			pathUUIDs = append(pathUUIDs, uuid.New())
+		} else {
+			parent := path[level+1].Entries
+			parent[len(parent)-1] = sealed
+		}
+		path[level] = IndexNode{Entries: []IndexEntry{entry}}
+		pathUUIDs[level] = uuid.New()
+		return push(level+1, IndexEntry{UUID: pathUUIDs[level]})
+	}
+	for _, entry := range entries {
+		err = push(0, entry)
+		if err != nil {
+			return FileTree{}, err
+		}
+	}
+
+	// Seal the rightmost path bottom up, fixing the entry each parent keeps for it
+	var entry IndexEntry
+	for level := range path {
+		entry, err = AddIndexNode(records, pathUUIDs[level], path[level], fileEncryptKey, fileHMACKey)
+		if err != nil {
+			return FileTree{}, err
+		}
+		if level+1 < len(path) {
+			parent := path[level+1].Entries
+			parent[len(parent)-1] = entry
+		}
+	}
+
+	tree.Root, tree.RootHash, tree.Depth = entry.UUID, entry.Hash, len(path)
+	return tree, nil
+}
+
+// loads the rightmost index node of every level, path[0] is the leaf and path[len(path)-1] the root
+func LoadRightmostPath(datastore Datastore, tree FileTree, fileEncryptKey, fileHMACKey []byte) (path []IndexNode, pathUUIDs []userlib.UUID, err error) {
+	path = make([]IndexNode, tree.Depth)
+	pathUUIDs = make([]userlib.UUID, tree.Depth)
+	entry := IndexEntry{UUID: tree.Root, Hash: tree.RootHash}
+	for level := tree.Depth - 1; level >= 0; level-- {
+		path[level], err = LoadIndexNode(datastore, entry, fileEncryptKey, fileHMACKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		pathUUIDs[level] = entry.UUID
+		if level > 0 {
+			if len(path[level].Entries) == 0 {
+				return nil, nil, errors.New("integrity check failed: empty index node")
+			}
+			entry = path[level].Entries[len(path[level].Entries)-1]
+		}
+	}
+	return path, pathUUIDs, nil
+}
+
+// returns how many blocks the tree has and the length of its content. Trees are only built
+// and appended to from the left, so every index node off the rightmost path is full and
+// only that path has to be loaded.
+func FileTreeBlocks(datastore Datastore, tree FileTree) (blocks, length int, err error) {
+	fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(tree.FileSourcekey, ENCRYPT, MAC)
+	if err != nil {
+		return 0, 0, errors.New("failed to get keys for File")
+	}
+	path, _, err := LoadRightmostPath(datastore, tree, fileEncryptKey, fileHMACKey)
+	if err != nil {
+		return 0, 0, err
+	}
+	blocks = len(path[0].Entries)
+	below := 1 // blocks under a full node of the level below
+	for level := 1; level < len(path); level++ {
+		below *= IndexFanout
+		blocks += (len(path[level].Entries) - 1) * below
+	}
+	for _, entry := range path[len(path)-1].Entries {
+		length += entry.Length
+	}
+	return blocks, length, nil
+}
+
+// rewrites the tree into as few blocks as its content needs under a new file key, or into
+// deduplicated chunks when chunked, compressing them when compressed. Returns the new tree,
+// and the records and chunks of the old one to release once it is no longer used.
+func CompactFileTree(userdata *User, tree FileTree, chunked, compressed bool) (compacted FileTree, droppedBlocks, droppedChunks []userlib.UUID, err error) {
+	content, droppedBlocks, droppedChunks, err := ReadFileTree(userdata.datastore, tree)
+	if err != nil {
+		return FileTree{}, nil, nil, err
+	}
+	compacted, err = WriteContentTree(userdata, content, chunked, compressed)
+	if err != nil {
+		return FileTree{}, nil, nil, err
+	}
+	return compacted, droppedBlocks, droppedChunks, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func maxUint64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"encoding/binary"
 	"encoding/json"
 
 	userlib "github.com/cs161-staff/project2-userlib"
@@ -11,6 +12,10 @@ import (
 	// Useful for string manipulation
 	"strings"
 
+	"sort"
+
+	"time"
+
 	// Useful for formatting strings (e.g. `fmt.Sprintf`).
 	"fmt"
 
@@ -29,11 +34,66 @@ const ENCRYPT = "encrypt"
 const MAC = "mac"
 const ACCESS = "access"
 
+// ErrFileDeleted is returned to sharees once the owner has deleted the file they were given.
+var ErrFileDeleted = errors.New("file deleted")
+
+// ErrAccessRevoked is returned to users the owner has revoked, directly or through whoever invited them.
+var ErrAccessRevoked = errors.New("access revoked")
+
+// ErrReadOnly is returned when a user who was only given read access tries to change a file.
+var ErrReadOnly = errors.New("file is shared read only")
+
+// ErrRollback is returned when a record is an authentic but older copy of what the session has already seen.
+var ErrRollback = errors.New("rollback detected: an older copy of the file was restored")
+
+// ErrConflict is returned when another session kept changing the file while the user tried to, see concurrency.go.
+var ErrConflict = errors.New("conflict: the file was changed by another session at the same time")
+
+// ErrLocked is returned when another session holds the lock of a file, see lease.go.
+var ErrLocked = errors.New("file is locked")
+
+// ErrInvitationExpired is returned when an invitation is accepted after the expiry its sender signed.
+var ErrInvitationExpired = errors.New("invitation expired")
+
+// ErrInvitationUsed is returned for invitations that were already accepted, cancelled, or replaced by a newer one.
+var ErrInvitationUsed = errors.New("invitation was already accepted or cancelled")
+
+// ErrInboxTampered is returned along with what could be listed when entries of the user's inbox were removed or forged.
+var ErrInboxTampered = errors.New("integrity check failed: inbox has been tampered with")
+
+// ErrVersionNotFound is returned for versions that never existed or are no longer retained.
+var ErrVersionNotFound = errors.New("version not found")
+
+// DefaultInvitationTTL is how long invitations from CreateInvitation can be accepted.
+const DefaultInvitationTTL = 7 * 24 * time.Hour
+
+// DefaultVersionRetention is how many versions of a new file are kept until SetVersionRetention changes it.
+const DefaultVersionRetention = 5
+
+// Permission is the level of access an invitation grants to a file.
+type Permission int
+
+const (
+	PermissionRead      Permission = iota + 1 // load the file and pass on read access
+	PermissionReadWrite                       // also store, append, and pass on write access
+)
+
 type User struct {
-	Username  string
-	RSAkey    userlib.PKEDecKey
-	Sigkey    userlib.DSSignKey
-	sourceKey []byte
+	Username      string
+	RSAkey        userlib.PKEDecKey
+	Sigkey        userlib.DSSignKey
+	FileIndex     userlib.UUID   // where the encrypted list of this user's filenames is kept
+	FileIndexKey  []byte         // used to generate file index keys
+	ChunkTable    userlib.UUID   // where the encrypted reference counts of this user's chunks are kept
+	ChunkKey      []byte         // used to generate chunk table keys
+	InvitationKey []byte         // used to generate the UUIDs of the invitations this user creates
+	RetiredAccess []userlib.UUID // access structs left under a previous password, deleted on next login
+	InboxSequence uint64         // the most entries this user has seen appended to their inbox, see inbox.go
+	sourceKey     []byte
+	datastore     Datastore // where every record of this user is read from and written to
+	keystore      Keystore
+	session       *sessionCache // what this session has seen, shared by copies of the User
+	clock         Clock         // where the session reads the time from
 }
 
 type Access struct {
@@ -44,40 +104,116 @@ type Access struct {
 	InvitationList      userlib.UUID
 	ListKey             []byte // used to generate invitation list keys
 	IsOwner             bool
+	Grant               FileGrant       // only set for the owner, sharees find theirs in their invitation
+	Transfer            PendingTransfer // set while an ownership transfer the owner offered is not accepted, see transfer.go
+	Epoch               int             // the transfer an owner took the file in, zero for its creator
+}
+
+// FileGrant is what an access struct or invitation lets its holder do with a file.
+// Every holder can verify the meta, only writers hold the key that signs it.
+type FileGrant struct {
+	Permission    Permission
+	FileSignKey   userlib.DSSignKey // zero for readers
+	FileVerifyKey userlib.DSVerifyKey
 }
 
 type InvitationList struct {
-	Invitations map[userlib.UUID][]byte // invitation UUID to sourcekey
+	Invitations map[userlib.UUID][]byte       // invitation UUID to sourcekey, for users the owner invited directly
+	Revoked     []userlib.UUID                // revoked invitations left behind as tombstones
+	Owners      []string                      // earlier owners, oldest first, who may have invited users directly
+	Handovers   []Handover                    // one for every ownership transfer, see transfer.go
+	Forwards    map[userlib.UUID]userlib.UUID // forwards their recipient has not followed yet to the node they lead to, see forward.go
 }
 
 type InvitationMeta struct {
 	InvitationUUID      userlib.UUID
-	InvitationSourcekey []byte // used to generate invitation keys
+	InvitationSourcekey []byte    // used to generate invitation keys
+	Expires             time.Time `json:"-"` // sent in the clear after the ciphertext, see EncryptThenSign
 }
 
+// Invitation is one node of the share tree of a file. The owner reaches every node
+// through InvitationList and the Children of each node, sharees only know their own subtree.
 type Invitation struct {
 	MetaUUID      userlib.UUID
 	MetaSourcekey []byte // used to generate meta keys
+	Creator       string // who created the file, the first of its owners, see forward.go
+	Sharer        string
+	Recipient     string
+	Accepted      bool
+	Pointer       userlib.UUID            // the invitation meta that last handed out the node, nil for older nodes
+	Consumed      bool                    // set once that invitation meta was accepted or cancelled
+	Revoked       bool                    // set on the tombstone left behind when the recipient is revoked
+	Children      map[userlib.UUID][]byte // invitations the recipient created, invitation UUID to sourcekey
+	Grant         FileGrant
+	Granted       time.Time // when the sharer granted Grant.Permission
+	GrantSig      []byte    // the sharer's signature over the grant, see sharing.go
+	AcceptSig     []byte    // the recipient's signature that they accepted, see sharing.go
 }
 
+// FileVersion is a tree kept in the history of a file once StoreFile replaced it.
+type FileVersion struct {
+	Number int
+	FileTree
+}
+
+// Meta is signed with the file sign key on every write.
 type Meta struct {
-	Start         userlib.UUID
-	Last          userlib.UUID
-	FileSourcekey []byte // used as source key to generate file keys
+	FileTree                // the current version, the only one appends and writes go to
+	Version   int           // number of the current version, the first StoreFile is version 1
+	Retention int           // how many versions are kept, including the current one
+	Sequence  Sequence      // incremented by every write of the meta, see rollback.go
+	History   []FileVersion // older versions still kept, oldest first
+
+	// appends compact the current version once it has this many more blocks than its content needs, 0 never
+	CompactThreshold int
+
+	Compression    bool           // new versions are written with compressed blocks
+	Deduplicated   bool           // versions the owner stores are chunked and shared with their other files
+	ReleasedChunks []userlib.UUID // chunks other writers stopped using, released on the owner's next write
 }
 
 type File struct {
-	Contents []byte
-	Next     userlib.UUID
+	Contents   []byte
+	Compressed bool // Contents is padded DEFLATE, see compress.go
+}
+
+type FileIndex struct {
+	Files map[string]bool // filename to whether the user owns the file
+}
+
+// FileInfo describes one entry of a user's namespace as returned by ListFiles.
+type FileInfo struct {
+	Filename string
+	IsOwner  bool
 }
 
 func InitUser(username string, password string) (userdataptr *User, err error) {
-	/* 
- 	Creates a user for the service.
-  	Requires a valid unused username. 
-  	Returns a pointer to the generated user object and an error if applicable. 
+	/*
+		Creates a user for the service backed by DefaultDatastore and the userlib keystore.
+		Requires a valid unused username.
+		Returns a pointer to the generated user object and an error if applicable.
+	*/
+	return InitUserWithOptions(username, password, SessionOptions{})
+}
+
+func InitUserWithStorage(username string, password string, datastore Datastore, keystore Keystore) (userdataptr *User, err error) {
+	/*
+		Creates a user for the service whose records live in the given datastore and keystore.
+		Requires a valid unused username.
+		Returns a pointer to the generated user object and an error if applicable.
+	*/
+	return InitUserWithOptions(username, password, SessionOptions{Datastore: datastore, Keystore: keystore})
+}
+
+func InitUserWithOptions(username string, password string, options SessionOptions) (userdataptr *User, err error) {
+	/*
+		Creates a user for the service whose records live in the datastore and keystore of options,
+		with a session reading the time from its clock.
+		Requires a valid unused username.
+		Returns a pointer to the generated user object and an error if applicable.
 	*/
-	
+	datastore, keystore, clock := options.backends()
+
 	// error check: check if username is an empty string
 	if username == "" {
 		return nil, errors.New("username cannot be empty")
@@ -90,7 +226,7 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 	}
 
 	// error check: check if username already exists
-	_, ok := userlib.DatastoreGet(userUUID)
+	_, ok := datastore.Get(userUUID)
 	if ok {
 		return nil, errors.New("username already exists")
 	}
@@ -109,40 +245,113 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 	}
 
 	// put public values into keystore
-	userlib.KeystoreSet(username+" public key", RSAPublicKey)
-	userlib.KeystoreSet(username+" signature key", DSVerifyKey)
+	err = keystore.Set(username+" public key", RSAPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	err = keystore.Set(username+" signature key", DSVerifyKey)
+	if err != nil {
+		return nil, err
+	}
 
 	// create user struct
 	userdata := User{
-		Username:  username,
-		RSAkey:    RSAPrivateKey,
-		Sigkey:    DSSignKey,
-		sourceKey: sourceKey,
+		Username:   username,
+		RSAkey:     RSAPrivateKey,
+		Sigkey:     DSSignKey,
+		FileIndex:  uuid.New(),
+		ChunkTable: uuid.New(),
+		sourceKey:  sourceKey,
+		datastore:  datastore,
+		keystore:   keystore,
+		session:    newSessionCache(),
+		clock:      clock,
+	}
+
+	// create the empty file index
+	userdata.FileIndexKey, err = GetRandomKey(&userdata)
+	if err != nil {
+		return nil, errors.New("failed to get file index key")
+	}
+	fileIndexEncryptKey, fileIndexHMACKey, err := GetTwoHASHKDFKeys(userdata.FileIndexKey, ENCRYPT, MAC)
+	if err != nil {
+		return nil, err
+	}
+	err = EncryptMacAndStore(datastore, userdata.FileIndex, RecordFileIndex, FileIndex{Files: make(map[string]bool)}, fileIndexEncryptKey, fileIndexHMACKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// create the empty chunk table
+	userdata.ChunkKey, err = GetRandomKey(&userdata)
+	if err != nil {
+		return nil, errors.New("failed to get chunk key")
+	}
+	chunkTableEncryptKey, chunkTableHMACKey, err := GetTwoHASHKDFKeys(userdata.ChunkKey, ENCRYPT, MAC)
+	if err != nil {
+		return nil, err
+	}
+	chunkTableKey, err := GetRandomKey(&userdata)
+	if err != nil {
+		return nil, errors.New("failed to get chunk key")
+	}
+	err = EncryptMacAndStore(datastore, userdata.ChunkTable, RecordChunkTable, ChunkTable{Key: chunkTableKey, Chunks: make(map[userlib.UUID]ChunkRef)}, chunkTableEncryptKey, chunkTableHMACKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// the invitations this user creates are found again under this key, it survives password changes
+	userdata.InvitationKey, err = GetRandomKey(&userdata)
+	if err != nil {
+		return nil, errors.New("failed to get invitation key")
 	}
 
 	// get encrypted msg and mac tag
 	// userBytes, err := json.Marshal(userdata)
-	msg, tag, err := EncryptThenMac(userdata, encryptKey, hmacKey)
+	msg, tag, err := EncryptThenMac(RecordUser, userUUID, userdata, encryptKey, hmacKey)
 	if err != nil {
 		return nil, err
 	}
 
 	// generate value for datastore and store
-	value, err := GenerateUUIDVal(msg, tag)
+	value, err := GenerateUUIDVal(RecordUser, msg, tag)
 	if err != nil {
 		return nil, errors.New("GenerateUUIDVal error")
 	}
-	userlib.DatastoreSet(userUUID, value)
+	err = userdata.datastore.Set(userUUID, value)
+	if err != nil {
+		return nil, err
+	}
 	return &userdata, nil
 }
 
 func GetUser(username string, password string) (userdataptr *User, err error) {
-	/* 
- 	Autheticates user information and retrieves a pointer to the user object.
-  	Requires information provided to match an existing user. 
-  	Returns a pointer to the generated user object and an error if applicable. 
+	/*
+		Autheticates user information against DefaultDatastore and the userlib keystore.
+		Requires information provided to match an existing user.
+		Returns a pointer to the generated user object and an error if applicable.
+	*/
+	return GetUserWithOptions(username, password, SessionOptions{})
+}
+
+func GetUserWithStorage(username string, password string, datastore Datastore, keystore Keystore) (userdataptr *User, err error) {
+	/*
+		Autheticates user information and retrieves a pointer to the user object.
+		Requires information provided to match an existing user in the given datastore.
+		Returns a pointer to the generated user object and an error if applicable.
 	*/
-	
+	return GetUserWithOptions(username, password, SessionOptions{Datastore: datastore, Keystore: keystore})
+}
+
+func GetUserWithOptions(username string, password string, options SessionOptions) (userdataptr *User, err error) {
+	/*
+		Autheticates user information against the datastore and keystore of options, and opens a
+		session reading the time from its clock.
+		Requires information provided to match an existing user in the given datastore.
+		Returns a pointer to the generated user object and an error if applicable.
+	*/
+	datastore, keystore, clock := options.backends()
+
 	// error check: empty username
 	if username == "" {
 		return nil, errors.New("username cannot be empty")
@@ -154,17 +363,11 @@ func GetUser(username string, password string) (userdataptr *User, err error) {
 		return nil, errors.New("GetUserUUID error")
 	}
 	// error check: user doesn't exist
-	encryptedUserdata, ok := userlib.DatastoreGet(userUUID)
+	encryptedUserdata, ok := datastore.Get(userUUID)
 	if !ok {
 		return nil, errors.New("username does not exist")
 	}
 
-	// unpack data into msg and tag
-	msg, tag, err := UnpackValue(encryptedUserdata)
-	if err != nil {
-		return nil, errors.New("failed to unpack user data")
-	}
-
 	// Generate the source key, encryption key, and HMAC key from the username and password
 	sourceKey := GetSourceKey(username, password)
 	encryptKey, hmacKey, err := GetTwoHASHKDFKeys(sourceKey, ENCRYPT, MAC)
@@ -172,8 +375,8 @@ func GetUser(username string, password string) (userdataptr *User, err error) {
 		return nil, errors.New("failed to generate encryption and HMAC keys")
 	}
 
-	// HMAC Check
-	err = CheckTag(msg, tag, hmacKey)
+	// unpack data into msg and check its tag
+	msg, _, err := OpenRecord(datastore, userUUID, encryptedUserdata, RecordUser, hmacKey)
 	if err != nil {
 		return nil, errors.New("data integrity check failed: either wrong credentials or tampering")
 	}
@@ -187,391 +390,269 @@ func GetUser(username string, password string) (userdataptr *User, err error) {
 	}
 
 	userdata.sourceKey = sourceKey
+	userdata.datastore = datastore
+	userdata.session = newSessionCache()
+	userdata.keystore = keystore
+	userdata.clock = clock
 
 	//username check
 	if userdata.Username != username {
 		return nil, errors.New("retrieved username does not match expected username")
 	}
-	return &userdata, nil
-}
 
-func (userdata *User) StoreFile(filename string, content []byte) (err error) {
-	
-	// Get accessUUID and keys
-	accessUUID, err := GetAccessUUID(*userdata, filename)
+	// file index check
+	_, _, _, err = LoadFileIndex(&userdata)
 	if err != nil {
-		return errors.New("failed to get accessUUID")
-	}
-	accessSourceKey, err := GetAccessKey(userdata.sourceKey, filename)
-	if err != nil {
-		return errors.New("failed to get access sourcekey")
+		return nil, err
 	}
-	accessEncryptKey, accessHMACKey, err := GetTwoHASHKDFKeys(accessSourceKey, ENCRYPT, MAC)
+
+	// chunk table check
+	_, _, _, err = LoadChunkTable(&userdata)
 	if err != nil {
-		return errors.New("failed to get access encrypt and mac keys")
+		return nil, err
 	}
-	accessValue, ok := userlib.DatastoreGet(accessUUID)
-
-	if ok {
-		// Unpack, check tag, and decrypt
-		accessMsg, accessTag, err := UnpackValue(accessValue)
-		if err != nil {
-			return errors.New("failed to unpack Access Struct")
-		}
-		err = CheckTag(accessMsg, accessTag, accessHMACKey)
-		if err != nil {
-			return errors.New("integrity check failed: Access Struct has been tampered with")
-		}
-		accessStruct, err := DecryptAccessMsg(accessMsg, accessEncryptKey)
-		if err != nil {
-			return errors.New("could not decrypt Access Struct")
-		}
-
-		// Get Meta UUID and keys
-		metaUUID, metaSourceKey, err := GetMetaUUIDAndSourceKey(accessStruct)
-		if err != nil {
-			return errors.New("could not get Meta UUID and sourcekey")
-		}
-		metaEncryptKey, metaHMACKey, err := GetTwoHASHKDFKeys(metaSourceKey, ENCRYPT, MAC)
-		if err != nil {
-			return errors.New("could not get Meta encrypt and mac keys")
-		}
-
-		// Check if Meta exists, check tag, unpack, and decrypt
-		metaValue, ok := userlib.DatastoreGet(metaUUID)
-		if !ok {
-			return errors.New("could not find Meta data in datastore")
-		}
-		metaMsg, metaTag, err := UnpackValue(metaValue)
-		if err != nil {
-			return errors.New("could not unpack Meta value")
-		}
-		err = CheckTag(metaMsg, metaTag, metaHMACKey)
-		if err != nil {
-			return errors.New("integrity check failed: Meta struct has been tampered with")
-		}
-		metaStruct, err := DecryptMetaMsg(metaMsg, metaEncryptKey)
-		if err != nil {
-			return errors.New("failed to decrypt Meta struct")
-		}
-
-		// Get start and end of files and keys for file
-		startoffile := metaStruct.Start
-		fileSourceKey := metaStruct.FileSourcekey
-		// fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(fileSourceKey, ENCRYPT, MAC)
-		// Add tampering file check
-
-		// Overwrite file and generate a new UUID for .Next of the file to update meta
-		newNextUUID, err := AddFileToDatabase(startoffile, fileSourceKey, content)
-		if err != nil {
-			return err
-		}
-		metaStruct.Last = newNextUUID
-
-		// Encrypt and mac meta and return it back to the datastore
-		metaMsg, metaTag, err = EncryptThenMac(metaStruct, metaEncryptKey, metaHMACKey)
-		if err != nil {
-			return err
-		}
-		metaValue, err = GenerateUUIDVal(metaMsg, metaTag)
-		if err != nil {
-			return err
-		}
-		userlib.DatastoreSet(metaUUID, metaValue)
-
-	} else {
-		// Access does not exist. user must create a new file. Generate new file UUID and file keys
-		fileUUID := uuid.New()
-		fileSourceKey, err := GetRandomKey(userdata)
-		if err != nil {
-			return errors.New("failed to get file sourcekey")
-		}
-
-		// Add file to database
-		nextFileUUID, err := AddFileToDatabase(fileUUID, fileSourceKey, content)
-		if err != nil {
-			return errors.New("failed to add file to datastore")
-		}
 
-		// Generate meta UUID and keys
-		metaUUID := uuid.New()
-		metaSourceKey, err := GetRandomKey(userdata)
-		if err != nil {
-			return errors.New("failed to get meta sourcekey")
-		}
-		metaEncryptKey, metaHMACKey, err := GetTwoHASHKDFKeys(metaSourceKey, ENCRYPT, MAC)
+	// finish cleaning up after a password change that was interrupted
+	if len(userdata.RetiredAccess) > 0 {
+		err = DeleteRetiredAccess(&userdata)
 		if err != nil {
-			return errors.New("failed to get file HDKF")
+			return nil, err
 		}
+	}
+	return &userdata, nil
+}
 
-		// Construct the metadata struct (UUIDs and keys), encrypt, mac, and store
-		metaStruct := Meta{fileUUID, nextFileUUID, fileSourceKey}
-		metaMsg, metaTag, err := EncryptThenMac(metaStruct, metaEncryptKey, metaHMACKey)
-		if err != nil {
-			return errors.New("failed to package data for entry into DataStore")
-		}
-		metaValue, err := GenerateUUIDVal(metaMsg, metaTag)
-		if err != nil {
-			return err
-		}
-		userlib.DatastoreSet(metaUUID, metaValue)
+func (userdata *User) StoreFile(filename string, content []byte) (err error) {
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		return attempt.storeFile(filename, content)
+	})
+}
 
-		// set list key
-		userListKey, err := GetRandomKey(userdata)
-		if err != nil {
-			return err
-		}
+func (userdata *User) storeFile(filename string, content []byte) (err error) {
+	// Check the user may replace the file before writing anything
+	chunked, compressed, err := CheckCanStore(userdata, filename)
+	if err != nil {
+		return err
+	}
 
-		invitationList := InvitationList{
-			Invitations: make(map[uuid.UUID][]byte),
-		}
+	// Write the content to a fresh tree under new keys and make it the current version
+	tree, err := WriteContentTree(userdata, content, chunked, compressed)
+	if err != nil {
+		return errors.New("failed to add file to datastore")
+	}
+	return StoreFileTree(userdata, filename, tree)
+}
 
-		invitationListEncryptKey, invitationListHMACKey, err := GetTwoHASHKDFKeys(userListKey, ENCRYPT, MAC)
-		if err != nil {
-			errors.New("failed to generate encryption and HMAC keys for invite list Struct")
-		}
+func (userdata *User) LoadFile(filename string) (content []byte, err error) {
+	err = RetryOnConflict(userdata, func(attempt *User) (err error) {
+		content, err = attempt.loadFile(filename)
+		return err
+	})
+	return content, err
+}
 
-		// Encrypt and mac meta and return it back to the datastore
-		userListMsg, userListTag, err := EncryptThenMac(invitationList, invitationListEncryptKey, invitationListHMACKey)
-		if err != nil {
-			return err
-		}
+func (userdata *User) loadFile(filename string) (content []byte, err error) {
+	// Get the access struct for the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
+	if err != nil {
+		return nil, err
+	}
 
-		inviteListValue, err := GenerateUUIDVal(userListMsg, userListTag)
+	// Owners also check the invitation list so tampering with any record of the file is caught
+	if accessStruct.IsOwner {
+		_, _, _, err = LoadInvitationList(userdata.datastore, accessStruct)
 		if err != nil {
-			return err
-		}
-		inviteListUUID := uuid.New()
-		userlib.DatastoreSet(inviteListUUID, inviteListValue)
-
-		// Create the owner struct
-		ownerStruct := Access{
-			MetaUUID:       metaUUID,
-			MetaSourcekey:  metaSourceKey,
-			InvitationList: inviteListUUID,
-			ListKey:        userListKey,
-			IsOwner:        true,
-		}
-
-		if !ownerStruct.IsOwner {
-			return errors.New("error making struct")
+			return nil, err
 		}
+	}
 
-		// access encrypt then mac
-		ownerMsg, ownerTag, err := EncryptThenMacAccess(ownerStruct, accessEncryptKey, accessHMACKey)
-		if err != nil {
-			return err
-		}
+	// Get the meta, this checks it was signed by a writer of the file
+	_, metaStruct, _, _, _, err := LoadMeta(userdata, accessStruct) // this will error if they do not have access
+	if err != nil {
+		return nil, err
+	}
 
-		// package the values
-		ownerValue, err := GenerateUUIDVal(ownerMsg, ownerTag)
-		if err != nil {
-			return err
-		}
-		userlib.DatastoreSet(accessUUID, ownerValue)
+	// Read every block through the index, checking them against the root hash of the meta
+	content, _, _, err = ReadFileTree(userdata.datastore, metaStruct.FileTree)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return content, nil
 }
 
-func (userdata *User) LoadFile(filename string) (content []byte, err error) {
-	// Get the access UUID and check if it exists
-	accessUUID, err := GetAccessUUID(*userdata, filename)
+func (userdata *User) AppendToFile(filename string, content []byte) error {
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		return attempt.appendToFile(filename, content)
+	})
+}
+
+func (userdata *User) appendToFile(filename string, content []byte) error {
+	// Get the access struct for the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
 	if err != nil {
-		return nil, errors.New("failed to get accessUUID")
-	}
-	accessValue, ok := userlib.DatastoreGet(accessUUID)
-	if !ok {
-		return nil, errors.New("file does not exist in user namespace")
+		return err
 	}
 
-	// Generate the source key, encryption key, and HMAC key
-	accessSourceKey, err := GetAccessKey(userdata.sourceKey, filename)
+	// Get the meta and check the user may write to the file
+	metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant, err := LoadMeta(userdata, accessStruct)
 	if err != nil {
-		return nil, errors.New("failed to get access sourcekey")
+		return err
 	}
-	accessEncryptKey, accessHMACKey, err := GetTwoHASHKDFKeys(accessSourceKey, ENCRYPT, MAC)
-	if err != nil {
-		return nil, errors.New("failed to generate encryption and HMAC keys for Access Struct")
+	if !CanWrite(grant) {
+		return ErrReadOnly
 	}
 
-	// Unpack, check tag, and decrypt
-	accessMsg, accessTag, err := UnpackValue(accessValue)
+	// Write the new blocks and the rightmost index nodes above them
+	metaStruct.FileTree, err = AppendFileTree(userdata.datastore, metaStruct.FileTree, content)
 	if err != nil {
-		return nil, errors.New("failed to unpack Access Struct")
+		return err
+	}
+
+	// Sign and store the updated meta, compacting first if the appends left too many small blocks
+	return StoreAppendedMeta(userdata, accessStruct, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
+}
+
+func (userdata *User) ReadAt(filename string, offset int, length int) (content []byte, err error) {
+	/*
+		Reads length bytes of the file starting at offset, fewer if the file ends first.
+		Only the blocks overlapping the range and the index nodes above them are loaded.
+	*/
+	if offset < 0 || length < 0 {
+		return nil, errors.New("offset and length cannot be negative")
 	}
-	err = CheckTag(accessMsg, accessTag, accessHMACKey)
+	err = RetryOnConflict(userdata, func(attempt *User) (err error) {
+		content, err = attempt.readAt(filename, offset, length)
+		return err
+	})
+	return content, err
+}
+
+func (userdata *User) readAt(filename string, offset int, length int) (content []byte, err error) {
+	// Get the access struct and the meta of the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
 	if err != nil {
-		return nil, errors.New("integrity check failed: Access Struct has been tampered with")
+		return nil, err
 	}
-	accessStruct, err := DecryptAccessMsg(accessMsg, accessEncryptKey)
+	_, metaStruct, _, _, _, err := LoadMeta(userdata, accessStruct)
 	if err != nil {
-		return nil, errors.New("could not decrypt access message")
+		return nil, err
 	}
 
-	// Get meta UUID and keys
-	metaUUID, metaSourceKey, err := GetMetaUUIDAndSourceKey(accessStruct)
+	// Check the range against the length of the file and read it
+	size, err := FileTreeLength(userdata.datastore, metaStruct.FileTree)
 	if err != nil {
-		return nil, errors.New("could not get Meta UUID and soucekey") // this will error if they do not have access
+		return nil, err
 	}
-	metaEncryptKey, metaHMACKey, err := GetTwoHASHKDFKeys(metaSourceKey, ENCRYPT, MAC)
-	if err != nil {
-		return nil, errors.New("could not get Meta encrypt and mac keys")
+	if offset > size {
+		return nil, errors.New("offset is past the end of the file")
 	}
+	return ReadFileRange(userdata.datastore, metaStruct.FileTree, offset, minInt(offset+length, size))
+}
 
-	// Check if meta exists, check tag, unpack, and decrypt
-	metaValue, ok := userlib.DatastoreGet(metaUUID)
-	if !ok {
-		return nil, errors.New("could not find Meta data in datastore")
+func (userdata *User) WriteAt(filename string, offset int, data []byte) error {
+	/*
+		Overwrites the file with data starting at offset, growing the file if data runs past its end.
+		Only the blocks overlapping the range and the index nodes above them are rewritten.
+	*/
+	if offset < 0 {
+		return errors.New("offset cannot be negative")
 	}
-	metaMsg, metaTag, err := UnpackValue(metaValue)
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		return attempt.writeAt(filename, offset, data)
+	})
+}
+
+func (userdata *User) writeAt(filename string, offset int, data []byte) error {
+	// Get the access struct and the meta, and check the user may write to the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
 	if err != nil {
-		return nil, errors.New("could not unpack Meta value")
+		return err
 	}
-	err = CheckTag(metaMsg, metaTag, metaHMACKey)
+	metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant, err := LoadMeta(userdata, accessStruct)
 	if err != nil {
-		return nil, errors.New("integrity check failed: Meta struct has been tampered with")
+		return err
 	}
-	metaStruct, err := DecryptMetaMsg(metaMsg, metaEncryptKey)
-	if err != nil {
-		return nil, errors.New("failed to decrypt Meta struct")
+	if !CanWrite(grant) {
+		return ErrReadOnly
 	}
-
-	// Get start and end of files and keys for file
-	startoffile, endoffile := metaStruct.Start, metaStruct.Last
-	fileSourceKey := metaStruct.FileSourcekey
-	fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(fileSourceKey, ENCRYPT, MAC)
+	size, err := FileTreeLength(userdata.datastore, metaStruct.FileTree)
 	if err != nil {
-		return nil, errors.New("failed to get keys for File")
+		return err
+	}
+	if offset > size {
+		return errors.New("offset is past the end of the file")
 	}
 
-	// Declare variable for storing file contents and iterate through file components
-	var fullContent []byte
-	var fileContent []byte
-
-	currentUUID := startoffile
-	for currentUUID != endoffile {
-		// Fetch the file data block from the datastore
-		fileValue, ok := userlib.DatastoreGet(currentUUID)
-		if !ok {
-			return nil, errors.New("File data block not found")
-		}
-
-		// Unpack, check tag, and decrypt
-		fileMsg, fileTag, err := UnpackValue(fileValue)
-		if err != nil {
-			return nil, errors.New("file could not be unpacked")
-		}
-		err = CheckTag(fileMsg, fileTag, fileHMACKey)
+	// Overwrite the part inside the file, copying the shared chunks it touches, and append the rest
+	inside := minInt(len(data), size-offset)
+	var releasedChunks []userlib.UUID
+	if inside > 0 {
+		var copiedChunks []userlib.UUID
+		metaStruct.FileTree, copiedChunks, err = OverwriteFileRange(userdata.datastore, metaStruct.FileTree, offset, data[:inside])
 		if err != nil {
-			return nil, errors.New("integrity check failed: File has unauthorized modifications")
+			return err
 		}
-		fileStruct, err := DecryptFileMsg(fileMsg, fileEncryptKey)
+		metaStruct, releasedChunks = TakeReleasedChunks(accessStruct, metaStruct, copiedChunks)
+	}
+	if inside < len(data) {
+		metaStruct.FileTree, err = AppendFileTree(userdata.datastore, metaStruct.FileTree, data[inside:])
 		if err != nil {
-			return nil, errors.New("File could not be decrypted")
+			return err
 		}
-		fileContent = fileStruct.Contents
-
-		// Append this file to entire message
-		fullContent = append(fullContent, fileContent...)
-
-		currentUUID = fileStruct.Next
-	}
-
-	return fullContent, nil
-}
-
-func (userdata *User) AppendToFile(filename string, content []byte) error {
-	// Get the access UUID and check if it exists
-	accessUUID, err := GetAccessUUID(*userdata, filename)
-	if err != nil {
-		return errors.New("failed to get access UUID sourcekey")
-	}
-	accessValue, ok := userlib.DatastoreGet(accessUUID)
-	if !ok {
-		return errors.New("File does not exist in user namespace")
-	}
-
-	// Generate the source key, encryption key, and HMAC key
-	accessSourceKey, err := GetAccessKey(userdata.sourceKey, filename)
-	if err != nil {
-		return errors.New("failed to get access sourcekey")
-	}
-	accessEncryptKey, accessHMACKey, err := GetTwoHASHKDFKeys(accessSourceKey, ENCRYPT, MAC)
-	if err != nil {
-		return errors.New("failed to generate encryption and HMAC keys for Access Struct")
-	}
-
-	// Unpack, check tag, and decrypt
-	accessMsg, accessTag, err := UnpackValue(accessValue)
-	if err != nil {
-		return errors.New("failed to unpack Access Struct")
-	}
-	err = CheckTag(accessMsg, accessTag, accessHMACKey)
-	if err != nil {
-		return errors.New("integrity check failed: Access Struct has been tampered with")
-	}
-	accessStruct, err := DecryptAccessMsg(accessMsg, accessEncryptKey)
-	if err != nil {
-		return errors.New("could not decrypt Access Struct")
-	}
-
-	// Get meta UUID and keys
-	metaUUID, metaSourceKey, err := GetMetaUUIDAndSourceKey(accessStruct)
-	if err != nil {
-		return errors.New("could not get Meta UUID and soucekey") // this will error if they do not have accesss
+		err = StoreAppendedMeta(userdata, accessStruct, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
+	} else {
+		// Sign and store the meta with the new root
+		err = StoreMeta(userdata, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
 	}
-	metaEncryptKey, metaHMACKey, err := GetTwoHASHKDFKeys(metaSourceKey, ENCRYPT, MAC)
 	if err != nil {
-		return errors.New("could not get Meta encrypt and mac keys")
+		return err
 	}
+	return ReleaseChunks(userdata, releasedChunks)
+}
 
-	// Check if meta exists, check tag, unpack, and decrypt
-	metaValue, ok := userlib.DatastoreGet(metaUUID)
-	if !ok {
-		return errors.New("could not find Meta data in datastore")
-	}
-	metaMsg, metaTag, err := UnpackValue(metaValue)
-	if err != nil {
-		return errors.New("could not unpack Meta value")
-	}
-	err = CheckTag(metaMsg, metaTag, metaHMACKey)
-	if err != nil {
-		return errors.New("integrity check failed: Meta struct has been tampered with")
-	}
-	metaStruct, err := DecryptMetaMsg(metaMsg, metaEncryptKey)
+func (userdata *User) CreateInvitation(filename string, recipientUsername string) (
+	invitationPtr uuid.UUID, err error) {
+	// pass on the same permission the caller has
+	permission, err := userdata.GetPermission(filename)
 	if err != nil {
-		return errors.New("failed to decrypt Meta struct")
+		return uuid.Nil, err
 	}
+	return userdata.CreateInvitationWithPermission(filename, recipientUsername, permission)
+}
 
-	fileSourceKey := metaStruct.FileSourcekey
-	lastUUID := metaStruct.Last
+func (userdata *User) CreateInvitationWithPermission(filename string, recipientUsername string, permission Permission) (
+	invitationPtr uuid.UUID, err error) {
+	/*
+		Invites recipientUsername to filename with the given permission. Readers can only pass on read access.
+		Inviting an existing recipient again changes their permission, but a writer keeps the sign key
+		they were handed until they are revoked.
+	*/
+	return userdata.CreateExpiringInvitation(filename, recipientUsername, permission, DefaultInvitationTTL)
+}
 
-	// FILE INFORMATION
-	nextFileUUID, err := AddFileToDatabase(lastUUID, fileSourceKey, content)
-	if err != nil {
-		return err
+func (userdata *User) CreateExpiringInvitation(filename string, recipientUsername string, permission Permission, ttl time.Duration) (
+	invitationPtr uuid.UUID, err error) {
+	/*
+		Invites recipientUsername with an invitation that can be accepted once, within ttl. A newer
+		invitation to the same recipient replaces one they have not accepted yet.
+	*/
+	if permission != PermissionRead && permission != PermissionReadWrite {
+		return uuid.Nil, errors.New("unknown permission")
 	}
-	metaStruct.Last = nextFileUUID
-
-	// Encrypt and Mac updated meta
-	metaMsg, metaTag, err = EncryptThenMac(metaStruct, metaEncryptKey, metaHMACKey)
-	if err != nil {
-		return err
+	if ttl <= 0 {
+		return uuid.Nil, errors.New("ttl must be positive")
 	}
-
-	// generate UUID value
-	metaValue, err = GenerateUUIDVal(metaMsg, metaTag)
-	if err != nil {
+	err = RetryOnConflict(userdata, func(attempt *User) (err error) {
+		invitationPtr, err = attempt.createInvitation(filename, recipientUsername, permission, ttl)
 		return err
-	}
-	userlib.DatastoreSet(metaUUID, metaValue)
-	return nil
+	})
+	return invitationPtr, err
 }
 
-func (userdata *User) CreateInvitation(filename string, recipientUsername string) (
+func (userdata *User) createInvitation(filename string, recipientUsername string, permission Permission, ttl time.Duration) (
 	invitationPtr uuid.UUID, err error) {
 	// check if user exits by seeing if their key exists in public keystore
-	_, ok := userlib.KeystoreGet(recipientUsername + " public key")
+	_, ok := userdata.keystore.Get(recipientUsername + " public key")
 	if !ok {
 		return uuid.Nil, errors.New("recipient user does not exist in the system")
 	}
@@ -582,72 +663,52 @@ func (userdata *User) CreateInvitation(filename string, recipientUsername string
 
 	}
 
-	// Get the access UUID, check if it exists, then get keys
-	accessUUID, err1 := GetAccessUUID(*userdata, filename)
-	if err1 != nil {
-		return uuid.Nil, err
-	}
-	accessValue, ok := userlib.DatastoreGet(accessUUID)
-	if !ok {
-		return uuid.Nil, errors.New("file does not exist in user namespace")
-	}
-	accessSourceKey, err := GetAccessKey(userdata.sourceKey, filename)
-	if err != nil {
-		return uuid.Nil, errors.New("failed to get access sourcekey")
-	}
-	accessEncryptKey, accessHMACKey, err := GetTwoHASHKDFKeys(accessSourceKey, ENCRYPT, MAC)
-	if err != nil {
-		return uuid.Nil, errors.New("failed to generate encryption and HMAC keys for Access Struct")
-	}
-
-	// Unpack, check tag, and decrypt access struct
-	accessMsg, accessTag, err := UnpackValue(accessValue)
-	if err != nil {
-		return uuid.Nil, errors.New("failed to unpack Access Struct")
-	}
-	err = CheckTag(accessMsg, accessTag, accessHMACKey)
-	if err != nil {
-		return uuid.Nil, errors.New("integrity check failed: Access Struct has been tampered with")
-	}
-	accessStruct, err := DecryptAccessMsg(accessMsg, accessEncryptKey)
+	// Get the access struct for the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
 	if err != nil {
-		return uuid.Nil, errors.New("could not decrypt Access Struct")
+		return uuid.Nil, err
 	}
 
 	// Get meta UUID and keys
-	metaUUID, metaSourceKey, err := GetMetaUUIDAndSourceKey(accessStruct)
-	if err != nil {
-		return uuid.Nil, errors.New("could not get Meta UUID and soucekey")
-	}
-
-	// Generate a new shared key for the invitation
-	invitationSourceKey, err := GetRandomKey(userdata)
-	if err != nil {
-		return userlib.UUID{}, errors.New("failed to generate source key")
-	}
-
-	// get keys
-	inviteEncryptKey, inviteHMACKey, err := GetTwoHASHKDFKeys(invitationSourceKey, ENCRYPT, MAC)
+	metaUUID, metaSourceKey, grant, err := GetMetaUUIDAndSourceKey(userdata.datastore, accessStruct)
 	if err != nil {
-		return uuid.Nil, errors.New("failed to generate keys for invite")
+		return uuid.Nil, fmt.Errorf("could not get Meta UUID and sourcekey: %w", err)
 	}
 
-	// create invitation
-	invitation := Invitation{
-		MetaUUID:      metaUUID,
-		MetaSourcekey: metaSourceKey,
+	// Only writers hand out the sign key
+	if permission == PermissionReadWrite && !CanWrite(grant) {
+		return uuid.Nil, ErrReadOnly
 	}
-
-	// Encrypt the invite and create an HMAC tag
-	inviteMsg, inviteTag, err := EncryptThenMac(invitation, inviteEncryptKey, inviteHMACKey)
-	if err != nil {
-		return uuid.Nil, errors.New("failed to package data for entry into DataStore")
+	recipientGrant := FileGrant{Permission: permission, FileVerifyKey: grant.FileVerifyKey}
+	if permission == PermissionReadWrite {
+		recipientGrant.FileSignKey = grant.FileSignKey
 	}
 
-	// Store the encrypted invite and the HMAC tag in the datastore
-	invitationValue, err := GenerateUUIDVal(inviteMsg, inviteTag)
-	if err != nil {
-		return uuid.Nil, err
+	// Get the children of the caller in the share tree: the owner's are kept in the
+	// invitation list, a sharee's are kept in their own invitation
+	var invitationListStruct InvitationList
+	var invitationListEncryptKey, invitationListHMACKey []byte
+	var parentStruct Invitation
+	var parentEncryptKey, parentHMACKey []byte
+	var children map[userlib.UUID][]byte
+	var creator string
+	if accessStruct.IsOwner {
+		invitationListStruct, invitationListEncryptKey, invitationListHMACKey, err = LoadInvitationList(userdata.datastore, accessStruct)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		children = invitationListStruct.Invitations
+		creator = FileCreator(invitationListStruct, userdata.Username)
+	} else {
+		parentStruct, parentEncryptKey, parentHMACKey, err = LoadInvitation(userdata.datastore, accessStruct.InvitationUUID, accessStruct.InvitationSourcekey)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		if parentStruct.Children == nil {
+			parentStruct.Children = make(map[userlib.UUID][]byte)
+		}
+		children = parentStruct.Children
+		creator = parentStruct.Creator
 	}
 
 	// MAKE THIS DETERMINIMISTIC
@@ -655,80 +716,95 @@ func (userdata *User) CreateInvitation(filename string, recipientUsername string
 	if err != nil {
 		return uuid.Nil, err
 	}
-	userlib.DatastoreSet(invitationUUID, invitationValue)
 
-	// create meta uuid
+	// create meta uuid, the node remembers it so only this invitation can be accepted
 	//TODO MAKE THIS RANDOM
 	invitationMetaUUID := uuid.New()
 
-	// create meta invitation
-	invitationMeta := InvitationMeta{
-		InvitationUUID:      invitationUUID,
-		InvitationSourcekey: invitationSourceKey,
-	}
-
-	// encrypt, sign, and store invitation Meta
-	invitationMetaMsg, invitationMetaSig, err := EncryptThenSign(invitationMeta, recipientUsername, userdata.Sigkey)
-	if err != nil {
-		return uuid.Nil, err
-	}
-	invitationMetaValue, err := GenerateUUIDVal(invitationMetaMsg, invitationMetaSig)
-	if err != nil {
-		return uuid.Nil, err
-	}
-
-	userlib.DatastoreSet(invitationMetaUUID, invitationMetaValue)
-
-	// also add invitationUUID, invitationSourceKey to invite list of owner
-	if accessStruct.IsOwner {
-		// get invitation list
-		inviteListUUID := accessStruct.InvitationList
-		inviteListKey := accessStruct.ListKey
-		inviteListData, ok := userlib.DatastoreGet(inviteListUUID)
-		if !ok {
-			return uuid.Nil, errors.New("invalid or missing inviteListData UUID")
+	// Re-inviting the same recipient hands out the node they already have, the invitation it
+	// handed out before can no longer be accepted
+	invitationSourceKey, exists := children[invitationUUID]
+	if exists {
+		invitation, invitationEncryptKey, invitationHMACKey, err := LoadInvitation(userdata.datastore, invitationUUID, invitationSourceKey)
+		if err != nil {
+			return uuid.Nil, err
 		}
-
-		// Unpack the invitation data
-		inviteListMsg, inviteListTag, err := UnpackValue(inviteListData)
+		invitation.Grant = recipientGrant
+		invitation.Pointer = invitationMetaUUID
+		invitation.Consumed = false
+		err = SignGrant(userdata, invitationUUID, &invitation)
 		if err != nil {
-			return uuid.Nil, errors.New("failed to unpack invitationList data")
+			return uuid.Nil, err
 		}
-
-		inviteListEncryptKey, inviteListHMACKey, err := GetTwoHASHKDFKeys(inviteListKey, ENCRYPT, MAC)
+		err = EncryptMacAndStore(userdata.datastore, invitationUUID, RecordInvitation, invitation, invitationEncryptKey, invitationHMACKey)
 		if err != nil {
 			return uuid.Nil, err
 		}
-
-		// check tag
-		err = CheckTag(inviteListMsg, inviteListTag, inviteListHMACKey)
+	} else {
+		// Generate a new shared key for the invitation
+		invitationSourceKey, err = GetRandomKey(userdata)
 		if err != nil {
-			return uuid.Nil, errors.New("integrity check failed: invite struct has been tampered with")
+			return userlib.UUID{}, errors.New("failed to generate source key")
 		}
-		// decrypt invitation list using invitation list key
 
-		invitationListValue, err := DecryptInvitationListMsg(inviteListMsg, inviteListEncryptKey)
-
-		// add value to the map
-		invitationListValue.Invitations[invitationUUID] = invitationSourceKey
-
-		// re-encrypt + hmac
-		invitationListEncryptKey, invitationListHMACKey, err := GetTwoHASHKDFKeys(inviteListKey, ENCRYPT, MAC)
+		// create invitation, encrypt, mac, and store
+		invitation := Invitation{
+			MetaUUID:      metaUUID,
+			MetaSourcekey: metaSourceKey,
+			Creator:       creator,
+			Sharer:        userdata.Username,
+			Recipient:     recipientUsername,
+			Pointer:       invitationMetaUUID,
+			Grant:         recipientGrant,
+		}
+		err = SignGrant(userdata, invitationUUID, &invitation)
 		if err != nil {
-			errors.New("failed to generate encryption and HMAC keys for invite list Struct")
+			return uuid.Nil, err
 		}
-
-		// Encrypt and mac meta and return it back to the datastore
-		inviteListMsg, inviteListTag, err = EncryptThenMac(invitationListValue, invitationListEncryptKey, invitationListHMACKey)
+		err = StoreInvitation(userdata.datastore, invitationUUID, invitationSourceKey, invitation)
 		if err != nil {
 			return uuid.Nil, err
 		}
 
-		inviteListValue, err := GenerateUUIDVal(inviteListMsg, inviteListTag)
+		// record the new node under the caller in the share tree
+		children[invitationUUID] = invitationSourceKey
+		if accessStruct.IsOwner {
+			err = EncryptMacAndStore(userdata.datastore, accessStruct.InvitationList, RecordInvitationList, invitationListStruct, invitationListEncryptKey, invitationListHMACKey)
+		} else {
+			err = EncryptMacAndStore(userdata.datastore, accessStruct.InvitationUUID, RecordInvitation, parentStruct, parentEncryptKey, parentHMACKey)
+		}
 		if err != nil {
 			return uuid.Nil, err
 		}
-		userlib.DatastoreSet(inviteListUUID, inviteListValue)
+	}
+
+	// create meta invitation
+	invitationMeta := InvitationMeta{
+		InvitationUUID:      invitationUUID,
+		InvitationSourcekey: invitationSourceKey,
+		Expires:             SessionTime(userdata).Add(ttl),
+	}
+
+	// encrypt, sign, and store invitation Meta
+	invitationMetaMsg, invitationMetaSig, err := EncryptThenSign(userdata.keystore, invitationMetaUUID, invitationMeta, recipientUsername, userdata.Sigkey)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	invitationMetaValue, err := GenerateUUIDVal(RecordInvitationMeta, invitationMetaMsg, invitationMetaSig)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	err = userdata.datastore.Set(invitationMetaUUID, invitationMetaValue)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	// leave a note in the recipient's inbox so they can find the invitation, an inbox that was
+	// tampered with gets none and the recipient is told when they list it
+	err = AppendToInbox(userdata, recipientUsername, InboxEntry{Sender: userdata.Username, Filename: filename, InvitationPtr: invitationMetaUUID})
+	if err != nil && err != ErrInboxTampered {
+		return uuid.Nil, err
 	}
 
 	// add invitation
@@ -736,59 +812,58 @@ func (userdata *User) CreateInvitation(filename string, recipientUsername string
 }
 
 func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid.UUID, filename string) error {
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		return attempt.acceptInvitation(senderUsername, invitationPtr, filename)
+	})
+}
+
+func (userdata *User) acceptInvitation(senderUsername string, invitationPtr uuid.UUID, filename string) error {
 	// Check if the recipient already has a file with the chosen filename
 	accessUUID, err := GetAccessUUID(*userdata, filename)
 	if err != nil {
 		return errors.New("could not get access uuid")
 	}
-	_, ok := userlib.DatastoreGet(accessUUID)
+	_, ok := userdata.datastore.Get(accessUUID)
 	if ok {
 		return errors.New("recipient already has a file with the chosen filename")
 	}
 
-	// Get invitation metadata from Datastore
-	invitationMetaValue, ok := userlib.DatastoreGet(invitationPtr)
-	if !ok {
-		return errors.New("no invitation meta")
+	// Get the invitation meta, verify sender's signature, and decrypt it
+	invitationMetaStruct, err := LoadInvitationMeta(userdata, senderUsername, invitationPtr)
+	if err != nil {
+		return err
 	}
 
-	// Unpack the invitation data, verify sender's signature, and decrypt the invitation
-	invitationMetaMsg, invitationMetaSig, err := UnpackValue(invitationMetaValue)
+	// Get invitation UUID and invitation keys, revocations since the invitation was sent forward them
+	invitationUUID := invitationMetaStruct.InvitationUUID
+	invitationSourceKey, followed, err := FollowForwards(userdata, invitationUUID, invitationMetaStruct.InvitationSourcekey)
 	if err != nil {
-		return errors.New("failed to unpack invitation data")
+		return err
 	}
-	err = CheckSignature(invitationMetaMsg, invitationMetaSig, senderUsername)
+
+	// Get the invitation from the datastore, check the tag, and decrypt
+	invitationStruct, inviteEncryptKey, inviteHMACKey, err := LoadInvitation(userdata.datastore, invitationUUID, invitationSourceKey)
 	if err != nil {
-		return errors.New("failed to verify invitation signature")
+		return err
 	}
-	invitationMetaStruct, err := DecryptAsynchMsg(invitationMetaMsg, userdata.RSAkey)
+	err = CheckInvitationUsable(invitationMetaStruct, invitationStruct, invitationPtr, SessionTime(userdata))
 	if err != nil {
-		return errors.New("failed to decrypt invitation")
-	}
-
-	// Get invitation UUID and invitation keys
-	invitationUUID := invitationMetaStruct.InvitationUUID
-	invitationSourceKey := invitationMetaStruct.InvitationSourcekey
-
-	// Get the invitation from the datastore to check the tag
-	inviteData, ok := userlib.DatastoreGet(invitationUUID)
-	if !ok {
-		return errors.New("invalid or missing invitation UUID")
+		return err
 	}
-	// Unpack the invitation data
-	inviteMsg, inviteTag, err := UnpackValue(inviteData)
-	if err != nil {
-		return errors.New("failed to unpack invitation data")
+	if invitationStruct.Sharer != senderUsername || invitationStruct.Recipient != userdata.Username {
+		return errors.New("invitation was not sent by sender to this user")
 	}
-	// generate keys
-	_, inviteHMACKey, err := GetTwoHASHKDFKeys(invitationSourceKey, ENCRYPT, MAC)
+
+	// mark the node as accepted in the share tree, which uses up the invitation meta
+	invitationStruct.Accepted = true
+	invitationStruct.Consumed = true
+	invitationStruct.AcceptSig, err = SignAcceptance(userdata, invitationUUID, invitationStruct)
 	if err != nil {
 		return err
 	}
-	// check tag
-	err = CheckTag(inviteMsg, inviteTag, inviteHMACKey)
+	err = EncryptMacAndStore(userdata.datastore, invitationUUID, RecordInvitation, invitationStruct, inviteEncryptKey, inviteHMACKey)
 	if err != nil {
-		return errors.New("integrity check failed: invite struct has been tampered with")
+		return err
 	}
 
 	// create an access struct and get the keys
@@ -806,603 +881,1840 @@ func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid
 	}
 
 	// Encrypt the access, HMAC, and store
-	accessMsg, accessTag, err := EncryptThenMac(accessStruct, accessEncKey, accessHMACKey)
+	accessMsg, accessTag, err := EncryptThenMac(RecordAccess, accessUUID, accessStruct, accessEncKey, accessHMACKey)
 	if err != nil {
 		return errors.New("failed to package data for entry into DataStore")
 	}
-	accessData, err := GenerateUUIDVal(accessMsg, accessTag)
+	accessData, err := GenerateUUIDVal(RecordAccess, accessMsg, accessTag)
 	if err != nil {
 		return err
 	}
-	userlib.DatastoreSet(accessUUID, accessData)
-	return nil
-}
-
-func (userdata *User) RevokeAccess(filename string, recipientUsername string) error {
-	// Get the access UUID and check if it exists
-	accessUUID, err := GetAccessUUID(*userdata, filename)
-	if err != nil {
-		return errors.New("failed to get access sourcekey")
-	}
-	accessValue, ok := userlib.DatastoreGet(accessUUID)
-	if !ok {
-		return errors.New("file does not exist in user namespace")
-	}
-
-	// Generate the source key, encryption key, and HMAC key
-	accessSourceKey, err := GetAccessKey(userdata.sourceKey, filename)
+	err = userdata.datastore.Set(accessUUID, accessData)
 	if err != nil {
-		return errors.New("failed to get access sourcekey")
+		return err
 	}
-	accessEncryptKey, accessHMACKey, err := GetTwoHASHKDFKeys(accessSourceKey, ENCRYPT, MAC)
+	err = userdata.datastore.DeleteBatch(followed)
 	if err != nil {
-		return errors.New("failed to generate encryption and HMAC keys for Access Struct")
+		return err
 	}
 
-	// Unpack, check tag, and decrypt
-	accessMsg, accessTag, err := UnpackValue(accessValue)
-	if err != nil {
-		return errors.New("failed to unpack Access Struct")
-	}
-	err = CheckTag(accessMsg, accessTag, accessHMACKey)
-	if err != nil {
-		return errors.New("integrity check failed: Access Struct has been tampered with")
+	// the invitation is no longer pending, take it out of the user's inbox
+	err = RemoveFromInbox(userdata, []userlib.UUID{invitationPtr})
+	if err != nil && err != ErrInboxTampered {
+		return err
 	}
-	accessStruct, err := DecryptAccessMsg(accessMsg, accessEncryptKey)
+
+	// record the shared file in the user's file index
+	return AddToFileIndex(userdata, filename, false)
+}
+
+func (userdata *User) CancelInvitation(filename string, recipientUsername string) error {
+	/*
+		Withdraws the invitation for filename the caller sent to recipientUsername before they
+		accept it. A recipient who already accepted keeps their access, use RevokeAccess for that.
+	*/
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		return attempt.cancelInvitation(filename, recipientUsername)
+	})
+}
+
+func (userdata *User) cancelInvitation(filename string, recipientUsername string) error {
+	// Get the access struct for the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
 	if err != nil {
-		return errors.New("could not decrypt Access Struct")
+		return err
 	}
 
-	if !accessStruct.IsOwner {
-		return errors.New("only the owner can revoke access")
+	// Get the children of the caller in the share tree, like CreateInvitation does
+	var invitationListStruct InvitationList
+	var invitationListEncryptKey, invitationListHMACKey []byte
+	var parentStruct Invitation
+	var parentEncryptKey, parentHMACKey []byte
+	var children map[userlib.UUID][]byte
+	if accessStruct.IsOwner {
+		invitationListStruct, invitationListEncryptKey, invitationListHMACKey, err = LoadInvitationList(userdata.datastore, accessStruct)
+		if err != nil {
+			return err
+		}
+		children = invitationListStruct.Invitations
+	} else {
+		parentStruct, parentEncryptKey, parentHMACKey, err = LoadInvitation(userdata.datastore, accessStruct.InvitationUUID, accessStruct.InvitationSourcekey)
+		if err != nil {
+			return err
+		}
+		children = parentStruct.Children
 	}
 
-	// Get meta UUID and keys
-	metaUUID, metaSourceKey, err := GetMetaUUIDAndSourceKey(accessStruct)
-	if err != nil {
-		return errors.New("could not get Meta UUID and soucekey")
-	}
-	_, metaHMACKey, err := GetTwoHASHKDFKeys(metaSourceKey, ENCRYPT, MAC)
+	// Find the node the caller handed to the recipient
+	invitationUUID, err := GetInvitationUUID(userdata, recipientUsername, filename)
 	if err != nil {
-		return errors.New("could not get Meta encrypt and mac keys")
+		return err
 	}
-
-	// Check if meta exists, check tag, unpack, and decrypt
-	metaValue, ok := userlib.DatastoreGet(metaUUID)
-	if !ok {
-		return errors.New("could not find Meta data in datastore")
+	invitationSourceKey, exists := children[invitationUUID]
+	if !exists {
+		return errors.New("no invitation for filename was sent to recipientUsername")
 	}
-	metaMsg, metaTag, err := UnpackValue(metaValue)
+	invitationStruct, invitationEncryptKey, invitationHMACKey, err := LoadInvitation(userdata.datastore, invitationUUID, invitationSourceKey)
 	if err != nil {
-		return errors.New("could not unpack Meta value")
+		return err
 	}
-	err = CheckTag(metaMsg, metaTag, metaHMACKey)
-	if err != nil {
-		return errors.New("integrity check failed: Meta struct has been tampered with")
+	if invitationStruct.Consumed || (invitationStruct.Pointer == uuid.Nil && invitationStruct.Accepted) {
+		return ErrInvitationUsed
 	}
 
-	// Decrypt file contents
-	content, err := userdata.LoadFile(filename)
-	if err != nil {
-		return errors.New("failed to load file contents")
+	// Destroy the invitation meta so the invitation can no longer be opened, the recipient drops
+	// its inbox entry the next time they list their inbox
+	if invitationStruct.Pointer != uuid.Nil {
+		err = userdata.datastore.Delete(invitationStruct.Pointer)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Generate new keys and encrypt file contents at a new UUID
-	fileUUID := uuid.New()
-	fileSourceKey, err := GetRandomKey(userdata)
-	if err != nil {
-		return errors.New("failed to get new sourcekey for file")
-	}
-	nextFileUUID, err := AddFileToDatabase(fileUUID, fileSourceKey, content)
-	if err != nil {
-		return errors.New("failed to add to database")
+	// A recipient who accepted an earlier invitation keeps the node, it only stops handing out the new one
+	if invitationStruct.Accepted {
+		invitationStruct.Consumed = true
+		return EncryptMacAndStore(userdata.datastore, invitationUUID, RecordInvitation, invitationStruct, invitationEncryptKey, invitationHMACKey)
 	}
 
-	// Generate a new UUID for meta, meta struct, and meta keys
-	metaStruct := Meta{fileUUID, nextFileUUID, fileSourceKey}
-	metaSourceKey, err = GetRandomKey(userdata)
-	if err != nil {
-		return errors.New("failed to get new sourcekey for meta")
+	// Otherwise take the node out of the share tree and delete it
+	delete(children, invitationUUID)
+	if accessStruct.IsOwner {
+		err = EncryptMacAndStore(userdata.datastore, accessStruct.InvitationList, RecordInvitationList, invitationListStruct, invitationListEncryptKey, invitationListHMACKey)
+	} else {
+		err = EncryptMacAndStore(userdata.datastore, accessStruct.InvitationUUID, RecordInvitation, parentStruct, parentEncryptKey, parentHMACKey)
 	}
-	metaEncryptKey, metaHMACKey, err := GetTwoHASHKDFKeys(metaSourceKey, ENCRYPT, MAC)
 	if err != nil {
 		return err
 	}
+	return userdata.datastore.Delete(invitationUUID)
+}
 
-	// Encrypt, mac, and store new meta
-	metaMsg, metaTag, err = EncryptThenMac(metaStruct, metaEncryptKey, metaHMACKey)
-	if err != nil {
+func (userdata *User) RevokeAccess(filename string, recipientUsername string) error {
+	var oldBlocks []userlib.UUID
+	err := RetryOnConflict(userdata, func(attempt *User) (err error) {
+		oldBlocks, err = attempt.revokeAccess(filename, recipientUsername)
 		return err
-	}
-	metaValue, err = GenerateUUIDVal(metaMsg, metaTag)
+	})
 	if err != nil {
 		return err
 	}
-	userlib.DatastoreSet(metaUUID, metaValue)
 
-	// Get invitationList struct location and keys
-	invitationListUUID := accessStruct.InvitationList
-	invitationListKey := accessStruct.ListKey
-	invitationListEncryptKey, invitationListHMACKey, err := GetTwoHASHKDFKeys(invitationListKey, ENCRYPT, MAC)
+	// Destroy the old trees so revoked users have no ciphertext left to decrypt. This is left
+	// until the commit, a transaction only keeps the last write of every record.
+	return SecureDeleteBlocks(userdata.datastore, oldBlocks)
+}
+
+// moves the file to new keys without recipientUsername and returns the old blocks to destroy
+func (userdata *User) revokeAccess(filename string, recipientUsername string) (oldBlocks []userlib.UUID, err error) {
+	// Get the access struct and check if it exists
+	accessUUID, accessStruct, accessEncryptKey, accessHMACKey, err := LoadAccess(userdata, filename)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Get value, unpack, check tag, and decrypt
-	invitationListValue, ok := userlib.DatastoreGet(invitationListUUID)
-	if !ok {
-		return errors.New("failed to get invitation list from Datastore")
-	}
-	invitationListMsg, invitationListTag, err := UnpackValue(invitationListValue)
-	if err != nil {
-		return errors.New("failed to unpack invitation list")
+	if !accessStruct.IsOwner {
+		return nil, errors.New("only the owner can revoke access")
 	}
-	err = CheckTag(invitationListMsg, invitationListTag, invitationListHMACKey)
+
+	// Get the invitation list and the full share tree under it
+	invitationListStruct, _, _, err := LoadInvitationList(userdata.datastore, accessStruct)
 	if err != nil {
-		return errors.New("integrity check failed: detected unauthorized modifications")
+		return nil, err
 	}
-	invitationListStruct, err := DecryptInvitationListMsg(invitationListMsg, invitationListEncryptKey)
+	shareTree, err := GetShareTree(userdata.datastore, invitationListStruct)
 	if err != nil {
-		return errors.New("failed to decrypt invitation list struct")
+		return nil, err
 	}
 
-	// Get recipient invitation UUID
-	recipientInvitationUUID, err := GetInvitationUUID(userdata, recipientUsername, filename)
-	if err != nil {
-		return errors.New("error getting invitation uuid for recipient")
+	// Every node of the recipient, and everything below them, is revoked
+	revoked := make(map[userlib.UUID]bool)
+	for _, node := range shareTree {
+		if node.Invitation.Recipient == recipientUsername || revoked[node.Parent] {
+			revoked[node.InvitationUUID] = true
+		}
 	}
-
-	// Check if the target user is in the invitation list
-	_, exists := invitationListStruct.Invitations[recipientInvitationUUID]
-	if !exists {
-		return errors.New("filename was not shared with recipientUsername")
+	if len(revoked) == 0 {
+		return nil, errors.New("filename was not shared with recipientUsername")
 	}
 
-	// Delete recipient from invitationsList
-	invitations := invitationListStruct.Invitations
-	delete(invitations, recipientInvitationUUID)
+	// Get the old meta so every version it keeps, and its lease, can be moved to new keys
+	metaUUID, metaStruct, _, oldMetaHMACKey, oldGrant, err := LoadMeta(userdata, accessStruct)
+	if err != nil {
+		return nil, err
+	}
 
-	// Iterate over invitations list getting keys, decrypting, updating, and encrypting
-	for invitationUUID, invitationSourceKey := range invitations {
-		// Get keys
-		invitationEncryptKey, invitationHMACKey, err := GetTwoHASHKDFKeys(invitationSourceKey, ENCRYPT, MAC)
+	// Copy every version to a fresh tree under new keys, remembering the old blocks and index
+	// nodes so they can be destroyed once nobody needs them. Deduplicated versions are chunked
+	// again under a new chunk key, since the revoked users know the UUIDs and keys of the old chunks.
+	if Deduplicates(accessStruct, metaStruct) {
+		err = RotateChunkKey(userdata)
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		// Update invitation information
-		invitationStruct := Invitation{metaUUID, metaSourceKey}
-		invitationMsg, invitationTag, err := EncryptThenMac(invitationStruct, invitationEncryptKey, invitationHMACKey)
+	}
+	var oldChunks []userlib.UUID
+	trees := []*FileTree{&metaStruct.FileTree}
+	for i := range metaStruct.History {
+		trees = append(trees, &metaStruct.History[i].FileTree)
+	}
+	for _, tree := range trees {
+		content, records, chunks, err := ReadFileTree(userdata.datastore, *tree)
 		if err != nil {
-			return errors.New("failed to encrypt and mac invitation struct")
+			return nil, errors.New("failed to load file contents")
 		}
-		invitationValue, err := GenerateUUIDVal(invitationMsg, invitationTag)
+		*tree, err = WriteContentTree(userdata, content, Deduplicates(accessStruct, metaStruct), tree.Compressed)
 		if err != nil {
-			return errors.New("failed to get UUID value for invitation")
+			return nil, errors.New("failed to add to database")
 		}
-		userlib.DatastoreSet(invitationUUID, invitationValue)
+		oldBlocks = append(oldBlocks, records...)
+		oldChunks = append(oldChunks, chunks...)
 	}
+	metaStruct, releasedChunks := TakeReleasedChunks(accessStruct, metaStruct, oldChunks)
 
-	// Update invitation list, encrypt it, and add it back to datastore
-	invitationListStruct.Invitations = invitations
-
-	invitationListMsg, invitationListTag, err = EncryptThenMac(invitationListStruct, invitationListEncryptKey, invitationListHMACKey)
+	// Generate new meta keys and sign keys so revoked writers can no longer sign
+	metaSourceKey, err := GetRandomKey(userdata)
 	if err != nil {
-		return errors.New("failed to encrypt then mac updated invitation list struct")
+		return nil, errors.New("failed to get new sourcekey for meta")
 	}
-	invitationListValue, err = GenerateUUIDVal(invitationListMsg, invitationListTag)
+	metaEncryptKey, metaHMACKey, err := GetTwoHASHKDFKeys(metaSourceKey, ENCRYPT, MAC)
 	if err != nil {
-		return errors.New("failed to generate then mac updated invitation list UUID value")
+		return nil, err
 	}
-	userlib.DatastoreSet(invitationListUUID, invitationListValue)
-
-	// Update owner struct, encrypt it, and add it back to the datastore
-	accessStruct.MetaSourcekey = metaSourceKey
-	accessMsg, accessTag, err = EncryptThenMac(accessStruct, accessEncryptKey, accessHMACKey)
+	fileSignKey, fileVerifyKey, err := userlib.DSKeyGen()
 	if err != nil {
-		return errors.New("failed to encrypt and mac new owner struct")
+		return nil, errors.New("failed to generate file signature keys")
 	}
-	updatedOwnerValue, err := GenerateUUIDVal(accessMsg, accessTag)
-	if err != nil {
-		return errors.New("failed to get UUID value for owner")
+	grant := FileGrant{
+		Permission:    PermissionReadWrite,
+		FileSignKey:   fileSignKey,
+		FileVerifyKey: fileVerifyKey,
 	}
-	userlib.DatastoreSet(accessUUID, updatedOwnerValue)
 
+	// Encrypt, mac, sign, and store new meta
+	err = StoreMeta(userdata, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
+	if err != nil {
+		return nil, err
+	}
+
+	// Move the lease to the new keys, a lease held by a revoked user is released
+	lease, locked, err := LoadLease(userdata, metaUUID, oldMetaHMACKey, oldGrant)
+	if err != nil {
+		return nil, err
+	}
+	if locked {
+		for _, node := range shareTree {
+			if revoked[node.InvitationUUID] && node.Invitation.Recipient == lease.Holder {
+				lease, err = SignLease(userdata, metaUUID, Lease{}, lease.Sequence)
+				if err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+		err = StoreLease(userdata, metaUUID, lease, metaHMACKey, grant)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Give every remaining node a new sourcekey, so nobody who held an old one can read the new meta keys
+	sourceKeys := make(map[userlib.UUID][]byte)
+	for _, node := range shareTree {
+		if !revoked[node.InvitationUUID] {
+			sourceKeys[node.InvitationUUID], err = GetRandomKey(userdata)
+			if err != nil {
+				return nil, errors.New("failed to generate source key")
+			}
+		}
+	}
+
+	// Hand the new meta and sign keys to every remaining node and leave a tombstone for every revoked one
+	updatedInvitations := make(map[userlib.UUID][]byte)
+	for _, node := range shareTree {
+		invitationStruct := Invitation{Revoked: true}
+		invitationSourceKey := node.Sourcekey
+		if !revoked[node.InvitationUUID] {
+			invitationStruct = node.Invitation
+			invitationSourceKey = sourceKeys[node.InvitationUUID]
+			invitationStruct.MetaUUID = metaUUID
+			invitationStruct.MetaSourcekey = metaSourceKey
+			invitationStruct.Grant.FileVerifyKey = fileVerifyKey
+			invitationStruct.Grant.FileSignKey = userlib.DSSignKey{}
+			if invitationStruct.Grant.Permission == PermissionReadWrite {
+				invitationStruct.Grant.FileSignKey = fileSignKey
+			}
+			for childUUID := range invitationStruct.Children {
+				if revoked[childUUID] {
+					delete(invitationStruct.Children, childUUID)
+				} else if childSourceKey, ok := sourceKeys[childUUID]; ok {
+					invitationStruct.Children[childUUID] = childSourceKey
+				}
+			}
+		}
+
+		invitationEncryptKey, invitationHMACKey, err := GetTwoHASHKDFKeys(invitationSourceKey, ENCRYPT, MAC)
+		if err != nil {
+			return nil, err
+		}
+		invitationMsg, invitationTag, err := EncryptThenMac(RecordInvitation, node.InvitationUUID, invitationStruct, invitationEncryptKey, invitationHMACKey)
+		if err != nil {
+			return nil, errors.New("failed to encrypt and mac invitation struct")
+		}
+		invitationValue, err := GenerateUUIDVal(RecordInvitation, invitationMsg, invitationTag)
+		if err != nil {
+			return nil, errors.New("failed to get UUID value for invitation")
+		}
+		updatedInvitations[node.InvitationUUID] = invitationValue
+	}
+	err = userdata.datastore.SetBatch(updatedInvitations)
+	if err != nil {
+		return nil, err
+	}
+
+	// Forward the new sourcekeys to the recipients, a recipient who did not follow an earlier
+	// forward yet finds the new sourcekey there
+	forwards, forwardValues, err := ResealForwards(userdata, invitationListStruct.Forwards, shareTree, sourceKeys, invitationListStruct.Handovers)
+	if err != nil {
+		return nil, err
+	}
+	waiting := make(map[userlib.UUID]bool)
+	for _, invitationUUID := range forwards {
+		waiting[invitationUUID] = true
+	}
+	for _, node := range shareTree {
+		if revoked[node.InvitationUUID] || waiting[node.InvitationUUID] {
+			continue
+		}
+		forwardUUID, err := GetForwardUUID(node.InvitationUUID, node.Sourcekey)
+		if err != nil {
+			return nil, err
+		}
+		forwardValues[forwardUUID], err = SealForward(userdata, forwardUUID, node.Invitation.Recipient, sourceKeys[node.InvitationUUID], invitationListStruct.Handovers)
+		if err != nil {
+			return nil, err
+		}
+		forwards[forwardUUID] = node.InvitationUUID
+	}
+	err = userdata.datastore.SetBatch(forwardValues)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the invitation list and move it to a new UUID and key
+	for invitationUUID := range revoked {
+		delete(invitationListStruct.Invitations, invitationUUID)
+		invitationListStruct.Revoked = append(invitationListStruct.Revoked, invitationUUID)
+	}
+	for invitationUUID := range invitationListStruct.Invitations {
+		if invitationSourceKey, ok := sourceKeys[invitationUUID]; ok {
+			invitationListStruct.Invitations[invitationUUID] = invitationSourceKey
+		}
+	}
+	invitationListStruct.Forwards = forwards
+	oldInvitationList := accessStruct.InvitationList
+	accessStruct.InvitationList = uuid.New()
+	accessStruct.ListKey, err = GetRandomKey(userdata)
+	if err != nil {
+		return nil, errors.New("failed to generate invitation list key")
+	}
+	invitationListEncryptKey, invitationListHMACKey, err := GetTwoHASHKDFKeys(accessStruct.ListKey, ENCRYPT, MAC)
+	if err != nil {
+		return nil, err
+	}
+	err = EncryptMacAndStore(userdata.datastore, accessStruct.InvitationList, RecordInvitationList, invitationListStruct, invitationListEncryptKey, invitationListHMACKey)
+	if err != nil {
+		return nil, errors.New("failed to store updated invitation list struct")
+	}
+	err = userdata.datastore.Delete(oldInvitationList)
+	if err != nil {
+		return nil, err
+	}
+
+	// An ownership transfer offered before hands out the old keys, so it is withdrawn
+	if accessStruct.Transfer.Ptr != uuid.Nil {
+		err = userdata.datastore.Delete(accessStruct.Transfer.Ptr)
+		if err != nil {
+			return nil, err
+		}
+		accessStruct.Transfer = PendingTransfer{}
+	}
+
+	// Update owner struct, encrypt it, and add it back to the datastore
+	accessStruct.MetaSourcekey = metaSourceKey
+	accessStruct.Grant = grant
+	err = EncryptMacAndStore(userdata.datastore, accessUUID, RecordAccess, accessStruct, accessEncryptKey, accessHMACKey)
+	if err != nil {
+		return nil, errors.New("failed to store new owner struct")
+	}
+
+	return oldBlocks, ReleaseChunks(userdata, releasedChunks)
+}
+
+func (userdata *User) DeleteFile(filename string) error {
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		return attempt.deleteFile(filename)
+	})
+}
+
+func (userdata *User) deleteFile(filename string) error {
+	// Get the access struct for the file
+	accessUUID, accessStruct, _, _, err := LoadAccess(userdata, filename)
+	if err != nil {
+		return err
+	}
+
+	// Drop the file from the user's file index first so it never lists a half deleted file
+	err = RemoveFromFileIndex(userdata, filename)
+	if err != nil {
+		return err
+	}
+
+	// Sharees only remove the file from their own namespace
+	if !accessStruct.IsOwner {
+		return userdata.datastore.Delete(accessUUID)
+	}
+
+	// Collect the owner access struct, the invitation list, and every invitation in the share tree
+	doomed := []userlib.UUID{accessUUID, accessStruct.InvitationList}
+	invitationListStruct, _, _, err := LoadInvitationList(userdata.datastore, accessStruct)
+	if err != nil {
+		return err
+	}
+	shareTree, err := GetShareTree(userdata.datastore, invitationListStruct)
+	if err != nil {
+		return err
+	}
+	for _, node := range shareTree {
+		doomed = append(doomed, node.InvitationUUID)
+	}
+	doomed = append(doomed, invitationListStruct.Revoked...)
+
+	// Cancel the invitations that were not accepted yet
+	for _, node := range shareTree {
+		if node.Invitation.Pointer != uuid.Nil && !node.Invitation.Consumed {
+			doomed = append(doomed, node.Invitation.Pointer)
+		}
+	}
+	for forwardUUID := range invitationListStruct.Forwards {
+		doomed = append(doomed, forwardUUID)
+	}
+	if accessStruct.Transfer.Ptr != uuid.Nil {
+		doomed = append(doomed, accessStruct.Transfer.Ptr)
+	}
+
+	// Collect meta and every block and index node of every version, and the chunks they use
+	var releasedChunks []userlib.UUID
+	metaUUID, metaStruct, _, _, _, err := LoadMeta(userdata, accessStruct)
+	if err != nil && err != ErrFileDeleted {
+		return err
+	}
+	if err == nil {
+		leaseUUID, err := GetLeaseUUID(metaUUID)
+		if err != nil {
+			return err
+		}
+		doomed = append(doomed, metaUUID, leaseUUID)
+		releasedChunks = metaStruct.ReleasedChunks
+		trees := []FileTree{metaStruct.FileTree}
+		for _, version := range metaStruct.History {
+			trees = append(trees, version.FileTree)
+		}
+		for _, tree := range trees {
+			blocks, chunks, err := GetFileRecords(userdata.datastore, tree)
+			if err != nil {
+				return err
+			}
+			doomed = append(doomed, blocks...)
+			releasedChunks = append(releasedChunks, chunks...)
+		}
+	}
+
+	err = userdata.datastore.DeleteBatch(doomed)
+	if err != nil {
+		return err
+	}
+	return ReleaseChunks(userdata, releasedChunks)
+}
+
+func (userdata *User) ChangePassword(oldPassword string, newPassword string) error {
+	/*
+		Moves every access struct of the user to the locations and keys derived from the new password.
+		The copies under the new password and the user struct re-encrypted under it are committed
+		together, so a crash leaves either the old password working or the new one, and a file another
+		session adds in the meantime makes the move start over rather than be left behind.
+		Other sessions of the user have to log in again afterwards.
+	*/
+
+	// check the old password against this session
+	oldSourceKey := GetSourceKey(userdata.Username, oldPassword)
+	if !userlib.HMACEqual(oldSourceKey, userdata.sourceKey) {
+		return errors.New("old password is incorrect")
+	}
+	if oldPassword == newPassword {
+		return nil
+	}
+	newSourceKey := GetSourceKey(userdata.Username, newPassword)
+	var newUserdata User
+	err := RetryOnConflict(userdata, func(attempt *User) (err error) {
+		newUserdata, err = attempt.changePassword(newSourceKey)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	newUserdata.datastore = userdata.datastore
+	newUserdata.session = userdata.session
+	*userdata = newUserdata
+
+	// Delete the access structs of the old password
+	return DeleteRetiredAccess(userdata)
+}
+
+func (userdata *User) changePassword(newSourceKey []byte) (newUserdata User, err error) {
+	newUserdata = *userdata
+	newUserdata.sourceKey = newSourceKey
+
+	// Get every file in the user's namespace
+	fileIndexStruct, _, _, err := LoadFileIndex(userdata)
+	if err != nil {
+		return User{}, err
+	}
+
+	// Copy each access struct to where the new password expects it
+	migrated := make(map[userlib.UUID][]byte)
+	var retired []userlib.UUID
+	for filename := range fileIndexStruct.Files {
+		// skip files whose access struct was already removed
+		accessUUID, err := GetAccessUUID(*userdata, filename)
+		if err != nil {
+			return User{}, errors.New("failed to get accessUUID")
+		}
+		if _, ok := userdata.datastore.Get(accessUUID); !ok {
+			continue
+		}
+		_, accessStruct, _, _, err := LoadAccess(userdata, filename)
+		if err != nil {
+			return User{}, err
+		}
+		newAccessUUID, err := GetAccessUUID(newUserdata, filename)
+		if err != nil {
+			return User{}, errors.New("failed to get accessUUID")
+		}
+		newAccessSourceKey, err := GetAccessKey(newUserdata.sourceKey, filename)
+		if err != nil {
+			return User{}, errors.New("failed to get access sourcekey")
+		}
+		newAccessEncryptKey, newAccessHMACKey, err := GetTwoHASHKDFKeys(newAccessSourceKey, ENCRYPT, MAC)
+		if err != nil {
+			return User{}, errors.New("failed to get access encrypt and mac keys")
+		}
+		accessMsg, accessTag, err := EncryptThenMac(RecordAccess, newAccessUUID, accessStruct, newAccessEncryptKey, newAccessHMACKey)
+		if err != nil {
+			return User{}, err
+		}
+		migrated[newAccessUUID], err = GenerateUUIDVal(RecordAccess, accessMsg, accessTag)
+		if err != nil {
+			return User{}, err
+		}
+		retired = append(retired, accessUUID)
+	}
+	err = userdata.datastore.SetBatch(migrated)
+	if err != nil {
+		return User{}, err
+	}
+
+	// Re-encrypt the user struct under the new password, it is committed along with the copies
+	newUserdata.RetiredAccess = retired
+	err = StoreUser(&newUserdata)
+	if err != nil {
+		return User{}, err
+	}
+	return newUserdata, nil
+}
+
+func (userdata *User) ListFiles() (files []FileInfo, err error) {
+	// Get the file index
+	fileIndexStruct, _, _, err := LoadFileIndex(userdata)
+	if err != nil {
+		return nil, err
+	}
+
+	// List filenames in a stable order
+	files = make([]FileInfo, 0, len(fileIndexStruct.Files))
+	for filename, isOwner := range fileIndexStruct.Files {
+		files = append(files, FileInfo{Filename: filename, IsOwner: isOwner})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Filename < files[j].Filename
+	})
+	return files, nil
+}
+
+func (userdata *User) GetPermission(filename string) (permission Permission, err error) {
+	err = RetryOnConflict(userdata, func(attempt *User) (err error) {
+		permission, err = attempt.getPermission(filename)
+		return err
+	})
+	return permission, err
+}
+
+func (userdata *User) getPermission(filename string) (permission Permission, err error) {
+	// Get the access struct for the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
+	if err != nil {
+		return 0, err
+	}
+
+	// Sharees find the permission they were granted in their invitation
+	_, _, grant, err := GetMetaUUIDAndSourceKey(userdata.datastore, accessStruct)
+	if err != nil {
+		return 0, err
+	}
+	return grant.Permission, nil
+}
+
+func (userdata *User) ListVersions(filename string) (versions []int, err error) {
+	err = RetryOnConflict(userdata, func(attempt *User) (err error) {
+		versions, err = attempt.listVersions(filename)
+		return err
+	})
+	return versions, err
+}
+
+func (userdata *User) listVersions(filename string) (versions []int, err error) {
+	// Get the access struct and the meta of the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
+	if err != nil {
+		return nil, err
+	}
+	_, metaStruct, _, _, _, err := LoadMeta(userdata, accessStruct)
+	if err != nil {
+		return nil, err
+	}
+
+	// List the version numbers kept, oldest first and the current one last
+	for _, version := range metaStruct.History {
+		versions = append(versions, version.Number)
+	}
+	return append(versions, metaStruct.Version), nil
+}
+
+func (userdata *User) LoadFileVersion(filename string, version int) (content []byte, err error) {
+	err = RetryOnConflict(userdata, func(attempt *User) (err error) {
+		content, err = attempt.loadFileVersion(filename, version)
+		return err
+	})
+	return content, err
+}
+
+func (userdata *User) loadFileVersion(filename string, version int) (content []byte, err error) {
+	// Get the access struct and the meta of the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
+	if err != nil {
+		return nil, err
+	}
+	_, metaStruct, _, _, _, err := LoadMeta(userdata, accessStruct)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the tree of the version and read it
+	if version == metaStruct.Version {
+		content, _, _, err = ReadFileTree(userdata.datastore, metaStruct.FileTree)
+		return content, err
+	}
+	for _, kept := range metaStruct.History {
+		if kept.Number == version {
+			content, _, _, err = ReadFileTree(userdata.datastore, kept.FileTree)
+			return content, err
+		}
+	}
+	return nil, ErrVersionNotFound
+}
+
+func (userdata *User) SetVersionRetention(filename string, keep int) error {
+	if keep < 1 {
+		return errors.New("at least the current version must be kept")
+	}
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		return attempt.setVersionRetention(filename, keep)
+	})
+}
+
+func (userdata *User) setVersionRetention(filename string, keep int) error {
+	// Get the access struct and the meta, and check the user may write to the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
+	if err != nil {
+		return err
+	}
+	metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant, err := LoadMeta(userdata, accessStruct)
+	if err != nil {
+		return err
+	}
+	if !CanWrite(grant) {
+		return ErrReadOnly
+	}
+
+	// Drop the versions beyond the new retention and reclaim their blocks once the meta is stored
+	metaStruct.Retention = keep
+	metaStruct, droppedBlocks, droppedChunks, err := TrimHistory(userdata.datastore, metaStruct)
+	if err != nil {
+		return err
+	}
+	metaStruct, releasedChunks := TakeReleasedChunks(accessStruct, metaStruct, droppedChunks)
+	err = StoreMeta(userdata, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
+	if err != nil {
+		return err
+	}
+	err = userdata.datastore.DeleteBatch(droppedBlocks)
+	if err != nil {
+		return err
+	}
+	return ReleaseChunks(userdata, releasedChunks)
+}
+
+func (userdata *User) CompactFile(filename string) error {
+	/*
+		Rewrites the current version of the file into as few blocks as its content needs, under
+		fresh keys. The meta keeps its UUID and keys, so sharees are not affected.
+	*/
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		return attempt.compactFile(filename)
+	})
+}
+
+func (userdata *User) compactFile(filename string) error {
+	// Get the access struct and the meta, and check the user may write to the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
+	if err != nil {
+		return err
+	}
+	metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant, err := LoadMeta(userdata, accessStruct)
+	if err != nil {
+		return err
+	}
+	if !CanWrite(grant) {
+		return ErrReadOnly
+	}
+
+	// Rewrite the current tree, the old one is deleted once the meta points at the new one
+	var droppedBlocks, droppedChunks []userlib.UUID
+	metaStruct.FileTree, droppedBlocks, droppedChunks, err = CompactFileTree(userdata, metaStruct.FileTree, Deduplicates(accessStruct, metaStruct), metaStruct.Compressed)
+	if err != nil {
+		return err
+	}
+	metaStruct, releasedChunks := TakeReleasedChunks(accessStruct, metaStruct, droppedChunks)
+	err = StoreMeta(userdata, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
+	if err != nil {
+		return err
+	}
+	err = userdata.datastore.DeleteBatch(droppedBlocks)
+	if err != nil {
+		return err
+	}
+	return ReleaseChunks(userdata, releasedChunks)
+}
+
+func (userdata *User) SetCompactThreshold(filename string, extraBlocks int) error {
+	/*
+		Makes appends compact the file once its current version has more than extraBlocks blocks
+		beyond the ones its content needs. 0 turns automatic compaction off.
+	*/
+	if extraBlocks < 0 {
+		return errors.New("compaction threshold cannot be negative")
+	}
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		return attempt.setCompactThreshold(filename, extraBlocks)
+	})
+}
+
+func (userdata *User) setCompactThreshold(filename string, extraBlocks int) error {
+	// Get the access struct and the meta, and check the user may write to the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
+	if err != nil {
+		return err
+	}
+	metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant, err := LoadMeta(userdata, accessStruct)
+	if err != nil {
+		return err
+	}
+	if !CanWrite(grant) {
+		return ErrReadOnly
+	}
+
+	// Sign and store the meta with the new threshold
+	metaStruct.CompactThreshold = extraBlocks
+	return StoreMeta(userdata, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
+}
+
+func (userdata *User) SetDeduplication(filename string, enabled bool) error {
+	/*
+		Turns deduplication of the owner's file against their other files on or off. Turning it on
+		chunks the current version at once, every version the owner stores afterwards is chunked too.
+		Versions stored by other writers, and appends, are never chunked.
+	*/
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		return attempt.setDeduplication(filename, enabled)
+	})
+}
+
+func (userdata *User) setDeduplication(filename string, enabled bool) error {
+	// Get the access struct and the meta, only the owner holds the chunk table
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
+	if err != nil {
+		return err
+	}
+	if !accessStruct.IsOwner {
+		return errors.New("only the owner can change deduplication")
+	}
+	metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant, err := LoadMeta(userdata, accessStruct)
+	if err != nil {
+		return err
+	}
+	if metaStruct.Deduplicated == enabled {
+		return nil
+	}
+	metaStruct.Deduplicated = enabled
+
+	// Chunk the current version, the old tree is released once the meta points at the new one
+	var droppedBlocks, droppedChunks []userlib.UUID
+	if enabled {
+		metaStruct.FileTree, droppedBlocks, droppedChunks, err = CompactFileTree(userdata, metaStruct.FileTree, true, metaStruct.Compressed)
+		if err != nil {
+			return err
+		}
+	}
+	metaStruct, releasedChunks := TakeReleasedChunks(accessStruct, metaStruct, droppedChunks)
+	err = StoreMeta(userdata, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
+	if err != nil {
+		return err
+	}
+	err = userdata.datastore.DeleteBatch(droppedBlocks)
+	if err != nil {
+		return err
+	}
+	return ReleaseChunks(userdata, releasedChunks)
+}
+
+func (userdata *User) SetCompression(filename string, enabled bool) error {
+	/*
+		Turns compression of the file's blocks on or off, rewriting the current version at once.
+		Versions stored afterwards follow the setting, older versions keep theirs.
+		Compressed sizes depend on the content, so do not compress a file that mixes secrets
+		with data an attacker can choose: padding blurs the stored length but cannot hide it.
+	*/
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		return attempt.setCompression(filename, enabled)
+	})
+}
+
+func (userdata *User) setCompression(filename string, enabled bool) error {
+	// Get the access struct and the meta, and check the user may write to the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
+	if err != nil {
+		return err
+	}
+	metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant, err := LoadMeta(userdata, accessStruct)
+	if err != nil {
+		return err
+	}
+	if !CanWrite(grant) {
+		return ErrReadOnly
+	}
+	if metaStruct.Compression == enabled && metaStruct.Compressed == enabled {
+		return nil
+	}
+	metaStruct.Compression = enabled
+
+	// Rewrite the current tree, the old one is released once the meta points at the new one
+	var droppedBlocks, droppedChunks []userlib.UUID
+	metaStruct.FileTree, droppedBlocks, droppedChunks, err = CompactFileTree(userdata, metaStruct.FileTree, Deduplicates(accessStruct, metaStruct), enabled)
+	if err != nil {
+		return err
+	}
+	metaStruct, releasedChunks := TakeReleasedChunks(accessStruct, metaStruct, droppedChunks)
+	err = StoreMeta(userdata, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
+	if err != nil {
+		return err
+	}
+	err = userdata.datastore.DeleteBatch(droppedBlocks)
+	if err != nil {
+		return err
+	}
+	return ReleaseChunks(userdata, releasedChunks)
+}
+
+// Helper Functions
+
+// assumes password has sufficient entropy to create non-bruteforceable UUID and sourcekey
+// only use the username to determine where the stuff is at,
+func GetUserUUID(user string) (UUID userlib.UUID, err error) {
+	// generate uuid
+	userbytes := []byte(user)
+	salt1 := []byte("UUID")
+	UUID, err = uuid.FromBytes(userlib.Argon2Key(userbytes, salt1, LENGTH))
+
+	// check for error
+	if err != nil {
+		return uuid.UUID{}, errors.New(strings.ToTitle("conversion to UUID failed"))
+	}
+	return
+}
+
+func GetSourceKey(user, password string) (sourcekey []byte) {
+	passwordbytes := []byte(password)
+	sourcekey = userlib.Argon2Key(passwordbytes, []byte(user), LENGTH)
+	return
+}
+
+func GetAsynchKeys() (pk userlib.PKEEncKey, sk userlib.PKEDecKey, signpriv userlib.DSSignKey, signpub userlib.DSVerifyKey, err error) {
+	// generate asymmetric encryption keys
+	pk, sk, err = userlib.PKEKeyGen()
+
+	// generate asymmetric signature keys
+	signpriv, signpub, err1 := userlib.DSKeyGen()
+
+	// check for errors
+	if err != nil {
+		return pk, sk, signpriv, signpub, errors.New(strings.ToTitle("rSA KeyGen failed"))
+	}
+	if err1 != nil {
+		return pk, sk, signpriv, signpub, errors.New(strings.ToTitle("signature KeyGen failed"))
+	}
+	return
+}
+
+// given secure source key this should produce fast secure keys
+func GetTwoHASHKDFKeys(sourcekey []byte, purpose1, purpose2 string) (key1, key2 []byte, err error) {
+	// generate keys and check errors
+	key, err := userlib.HashKDF(sourcekey, []byte(purpose1))
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("key creation failed"))
+	}
+	key1 = key[:16]
+	key, err = userlib.HashKDF(sourcekey, []byte(purpose2))
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("key creation failed"))
+	}
+	key2 = key[:LENGTH]
+	return
+}
+
+func GetAccessUUID(user User, filename string) (UUID userlib.UUID, err error) {
+	// hash username and check error
+	accessbytes := []byte(filename)
+	accesshash, err := userlib.HashKDF(user.sourceKey, accessbytes)
+	if err != nil {
+		return uuid.UUID{}, errors.New(strings.ToTitle("hashing failed"))
+	}
+
+	// convert to byte and check error
+	UUID, err = uuid.FromBytes(accesshash[:LENGTH])
+	if err != nil {
+		return uuid.UUID{}, errors.New(strings.ToTitle("Conversion to UUID failed"))
+	}
+	return
+}
+
+// the UUID only depends on the user's invitation key, not their password, so the nodes they
+// created can still be found after ChangePassword
+func GetInvitationUUID(owner *User, sharee, filename string) (UUID userlib.UUID, err error) {
+	// hash username and check error
+	invitebytes := []byte(owner.Username + filename + sharee)
+	invitehash, err := userlib.HashKDF(owner.InvitationKey, invitebytes)
+	if err != nil {
+		return uuid.UUID{}, errors.New(strings.ToTitle("Hashing failed"))
+	}
+
+	// convert to byte and check error
+	UUID, err = uuid.FromBytes(invitehash[:LENGTH])
+	if err != nil {
+		return uuid.UUID{}, errors.New(strings.ToTitle("file not found"))
+	}
+	return
+}
+
+func GenerateUUIDVal(recordType RecordType, msg, tag []byte) (value []byte, err error) {
+	// package msg and tag into an envelope of the record's type
+	return PackEnvelope(recordType, msg, tag, nil), nil
+}
+
+func GenerateSignedUUIDVal(recordType RecordType, msg, tag, sig []byte) (value []byte, err error) {
+	// package msg, tag, and signature into an envelope of the record's type
+	return PackEnvelope(recordType, msg, tag, sig), nil
+}
+
+func EncryptThenMac(recordType RecordType, UUID userlib.UUID, txt interface{}, key1, key2 []byte) (msg, tag []byte, err error) {
+	// convert text to bytes and check for error
+	plaintext, err := json.Marshal(txt)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("marshal failed"))
+	}
+	return EncryptBytesThenMac(recordType, UUID, plaintext, key1, key2)
+}
+
+func EncryptBytesThenMac(recordType RecordType, UUID userlib.UUID, plaintext, key1, key2 []byte) (msg, tag []byte, err error) {
+	// encrypt, and mac along with the record type and UUID
+	rndbytes := userlib.RandomBytes(LENGTH)
+	msg = userlib.SymEnc(key1, rndbytes, plaintext)
+	tag, err = RecordTag(recordType, UUID, msg, key2)
+
+	// check for error and return
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("hmac failed"))
+	}
+	return
+}
+
+func EncryptThenMacAccess(accessUUID userlib.UUID, txt Access, key1, key2 []byte) (msg, tag []byte, err error) {
+	// convert text to bytes and check for error
+	plaintext, err := json.Marshal(txt)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("marshal failed"))
+	}
+
+	// encrypt, and mac along with the record type and UUID
+	rndbytes := userlib.RandomBytes(LENGTH)
+	msg = userlib.SymEnc(key1, rndbytes, plaintext)
+	tag, err = RecordTag(RecordAccess, accessUUID, msg, key2)
+
+	// check for error and return
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("hmac failed"))
+	}
+	return
+}
+
+// loads the invitation meta at invitationPtr and checks senderUsername signed it
+func LoadInvitationMeta(userdata *User, senderUsername string, invitationPtr userlib.UUID) (invitationMeta InvitationMeta, err error) {
+	// Get invitation metadata from Datastore
+	invitationMetaValue, ok := userdata.datastore.Get(invitationPtr)
+	if !ok {
+		return InvitationMeta{}, errors.New("no invitation meta")
+	}
+
+	// Unpack the invitation data, verify sender's signature, and decrypt the invitation
+	invitationMetaMsg, invitationMetaSig, invitationMetaSigned, err := OpenSignedRecord(invitationPtr, invitationMetaValue, RecordInvitationMeta)
+	if err != nil {
+		return InvitationMeta{}, errors.New("failed to unpack invitation data")
+	}
+	err = CheckSignature(userdata.keystore, invitationMetaSigned, invitationMetaSig, senderUsername)
+	if err != nil {
+		return InvitationMeta{}, errors.New("failed to verify invitation signature")
+	}
+	invitationMeta, err = DecryptAsynchMsg(invitationMetaMsg, userdata.RSAkey)
+	if err != nil {
+		return InvitationMeta{}, errors.New("failed to decrypt invitation")
+	}
+	return invitationMeta, nil
+}
+
+// checks the invitation meta at invitationPtr can still be accepted: only the latest invitation meta of
+// the node can be, once and before it expires. Nodes from before invitations were single use name none
+// and can be accepted once. now is the time of the accepting session.
+func CheckInvitationUsable(invitationMeta InvitationMeta, invitation Invitation, invitationPtr userlib.UUID, now time.Time) (err error) {
+	if invitation.Revoked {
+		return ErrAccessRevoked
+	}
+	if !invitationMeta.Expires.IsZero() && now.After(invitationMeta.Expires) {
+		return ErrInvitationExpired
+	}
+	if invitation.Consumed || (invitation.Pointer == uuid.Nil && invitation.Accepted) {
+		return ErrInvitationUsed
+	}
+	if invitation.Pointer != uuid.Nil && invitation.Pointer != invitationPtr {
+		return ErrInvitationUsed
+	}
 	return nil
 }
 
-// Helper Functions
+func EncryptThenSign(keystore Keystore, invitationMetaUUID userlib.UUID, txt InvitationMeta, user string, sk userlib.DSSignKey) (msg, sig []byte, err error) {
+	// convert to byte array, check for error
+	plaintext, err := json.Marshal(txt)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("marshal failed"))
+	}
+
+	// encrypt using user public key, check for error
+	pubkey, ok := keystore.Get(user + " public key")
+	if !ok {
+		return nil, nil, errors.New(strings.ToTitle("keystoreGet failed"))
+	}
+	ciphertext, err := userlib.PKEEnc(pubkey, plaintext)
+	if err != nil {
+		return nil, nil, errors.New(strings.ToTitle("encryption failed"))
+	}
+
+	// the expiry does not fit in the RSA plaintext, it follows the ciphertext where the signature still covers it
+	if !txt.Expires.IsZero() {
+		ciphertext = binary.BigEndian.AppendUint64(ciphertext, uint64(txt.Expires.UnixNano()))
+	}
+
+	// sign along with the record type and UUID, check for error, and return
+	sig, err = userlib.DSSign(sk, append(RecordAD(RecordInvitationMeta, invitationMetaUUID), ciphertext...))
+	return ciphertext, sig, err
+}
+
+func CheckTag(msg, tag, key2 []byte) (err error) {
+	// compute tag and check error
+	computedTag, err := userlib.HMACEval(key2, msg)
+	if err != nil {
+		return err
+	}
+
+	if userlib.HMACEqual(tag, computedTag) {
+		return
+	}
+	return errors.New("integrity check failed")
+}
+
+func CheckSignature(keystore Keystore, msg, sig []byte, user string) (err error) {
+	// get verification key, check error
+	sk, ok := keystore.Get(user + " signature key")
+	if !ok {
+		return errors.New("could not get sign key")
+	}
+
+	// verify signature
+	err = userlib.DSVerify(sk, msg, sig)
+	return
+}
+
+func DecryptFileMsg(msg, key1 []byte) (data File, err error) {
+	// decrypt msg
+	plaintext := userlib.SymDec(key1, msg)
+
+	// decode data to get original struct
+	return DecodeFile(plaintext)
+}
+
+func DecryptAccessMsg(msg, key1 []byte) (data Access, err error) {
+	// decrypt msg
+	plaintext := userlib.SymDec(key1, msg)
+
+	// unmarshal data to get original struct
+	err = json.Unmarshal(plaintext, &data)
+	return
+}
+
+func DecryptMetaMsg(msg, key1 []byte) (data Meta, err error) {
+	// decrypt msg
+	plaintext := userlib.SymDec(key1, msg)
+
+	// unmarshal data to get original struct
+	err = json.Unmarshal(plaintext, &data)
+	return
+}
+
+func DecryptInvitationMsg(msg, key1 []byte) (data Invitation, err error) {
+	// decrypt msg
+	plaintext := userlib.SymDec(key1, msg)
+
+	// unmarshal data to get original struct
+	err = json.Unmarshal(plaintext, &data)
+	return
+}
+
+func DecryptInvitationListMsg(msg, key1 []byte) (data InvitationList, err error) {
+	// decrypt msg
+	plaintext := userlib.SymDec(key1, msg)
+
+	// unmarshal data to get original struct
+	err = json.Unmarshal(plaintext, &data)
+	return
+}
+
+func DecryptInvitationMetaMsg(msg, key1 []byte) (data InvitationMeta, err error) {
+	// decrypt msg
+	plaintext := userlib.SymDec(key1, msg)
+
+	// unmarshal data to get original struct
+	err = json.Unmarshal(plaintext, &data)
+	return
+}
+
+func DecryptFileIndexMsg(msg, key1 []byte) (data FileIndex, err error) {
+	// decrypt msg
+	plaintext := userlib.SymDec(key1, msg)
+
+	// unmarshal data to get original struct
+	err = json.Unmarshal(plaintext, &data)
+	return
+}
+
+func DecryptAsynchMsg(msg []byte, pk userlib.PKEDecKey) (data InvitationMeta, err error) {
+	// split off the expiry, invitations from before they expired have none
+	var expires time.Time
+	if len(msg) == pk.PrivKey.Size()+8 {
+		expires = time.Unix(0, int64(binary.BigEndian.Uint64(msg[pk.PrivKey.Size():])))
+		msg = msg[:pk.PrivKey.Size()]
+	}
+
+	// decrypt msg
+	plaintext, err := userlib.PKEDec(pk, msg)
+	if err != nil {
+		return InvitationMeta{}, errors.New(strings.ToTitle("decryption failed"))
+	}
+
+	// unmarshal data to get original struct and check for error
+	err = json.Unmarshal(plaintext, &data)
+	if err != nil {
+		return InvitationMeta{}, errors.New(strings.ToTitle("unmarshalling failed"))
+	}
+	data.Expires = expires
+	return
+}
+
+func GetRandomKey(user *User) (key []byte, err error) {
+	// generate new random key
+	sourcekey, salt := user.sourceKey, userlib.RandomBytes(LENGTH)
+	hashedkey, err := userlib.HashKDF(sourcekey, salt)
+	key = hashedkey[:LENGTH]
+	// check for error
+	if err != nil {
+		return nil, errors.New(strings.ToTitle("file not found"))
+	}
+	return
+}
 
-// assumes password has sufficient entropy to create non-bruteforceable UUID and sourcekey
-// only use the username to determine where the stuff is at,
-func GetUserUUID(user string) (UUID userlib.UUID, err error) {
-	// generate uuid
-	userbytes := []byte(user)
-	salt1 := []byte("UUID")
-	UUID, err = uuid.FromBytes(userlib.Argon2Key(userbytes, salt1, LENGTH))
+func GetAccessStruct(invitation userlib.UUID, sourcekey []byte) (access interface{}) {
+	access = Access{InvitationUUID: invitation, InvitationSourcekey: sourcekey, IsOwner: false}
+	return
+}
 
-	// check for error
+func GetAccessKey(sourcekey []byte, filename string) (key []byte, err error) {
+	hashedkey, err := userlib.HashKDF(sourcekey, []byte(filename))
+	key = hashedkey[:LENGTH]
 	if err != nil {
-		return uuid.UUID{}, errors.New(strings.ToTitle("conversion to UUID failed"))
+		return nil, errors.New(strings.ToTitle("key creation failed"))
 	}
 	return
 }
 
-func GetSourceKey(user, password string) (sourcekey []byte) {
-	passwordbytes := []byte(password)
-	sourcekey = userlib.Argon2Key(passwordbytes, []byte(user), LENGTH)
+// only writers hold a key that can sign the meta
+func CanWrite(grant FileGrant) bool {
+	return grant.Permission == PermissionReadWrite && grant.FileSignKey.KeyType != ""
+}
+
+func GetMetaUUIDAndSourceKey(datastore Datastore, accessStruct Access) (metaUUID userlib.UUID, metaSourceKey []byte, grant FileGrant, err error) {
+	// owners keep everything in their access struct
+	if accessStruct.IsOwner {
+		return accessStruct.MetaUUID, accessStruct.MetaSourcekey, accessStruct.Grant, nil
+	}
+
+	// the user obtained access through an invitation, check it exists, check tag, unpack, and decrypt
+	invitationStruct, _, _, err := LoadInvitation(datastore, accessStruct.InvitationUUID, accessStruct.InvitationSourcekey)
+	if err != nil {
+		return uuid.Nil, nil, FileGrant{}, err
+	}
+	if invitationStruct.Revoked {
+		return uuid.Nil, nil, FileGrant{}, ErrAccessRevoked
+	}
+
+	// get UUID and sourcekey of meta file
+	return invitationStruct.MetaUUID, invitationStruct.MetaSourcekey, invitationStruct.Grant, nil
+}
+
+func UnpackCheckTagAndDecryptFile(datastore Datastore, fileUUID userlib.UUID, fileEncryptKey, fileHMACKey []byte) (fileStruct File, fileMsg []byte, err error) {
+	fileValue, ok := datastore.Get(fileUUID)
+	if !ok {
+		return File{}, nil, errors.New("file value was not found in DataStore")
+	}
+	fileMsg, _, err = OpenRecord(datastore, fileUUID, fileValue, RecordBlock, fileHMACKey)
+	if err != nil {
+		return File{}, nil, errors.New("integrity check failed: File has unauthorized modifications")
+	}
+	fileStruct, err = DecryptFileMsg(fileMsg, fileEncryptKey)
+	if err != nil {
+		return File{}, nil, errors.New("file could not be decrypted")
+	}
 	return
 }
 
-func GetAsynchKeys() (pk userlib.PKEEncKey, sk userlib.PKEDecKey, signpriv userlib.DSSignKey, signpub userlib.DSVerifyKey, err error) {
-	// generate asymmetric encryption keys
-	pk, sk, err = userlib.PKEKeyGen()
+func GetInvitationSourceKey(sourceKey []byte, user, filename string) (invitationSourceKey []byte, err error) {
+	hashedinvitationSourceKey, err := userlib.HashKDF(sourceKey, []byte(user+ACCESS+filename))
+	invitationSourceKey = hashedinvitationSourceKey[:LENGTH]
+	if err != nil {
+		return nil, errors.New("failed to get invitation li")
+	}
+	return
+}
+
+func LoadAccess(userdata *User, filename string) (accessUUID userlib.UUID, accessStruct Access, accessEncryptKey, accessHMACKey []byte, err error) {
+	// Get the access UUID and keys
+	accessUUID, err = GetAccessUUID(*userdata, filename)
+	if err != nil {
+		return uuid.Nil, Access{}, nil, nil, errors.New("failed to get accessUUID")
+	}
+	accessSourceKey, err := GetAccessKey(userdata.sourceKey, filename)
+	if err != nil {
+		return uuid.Nil, Access{}, nil, nil, errors.New("failed to get access sourcekey")
+	}
+	accessEncryptKey, accessHMACKey, err = GetTwoHASHKDFKeys(accessSourceKey, ENCRYPT, MAC)
+	if err != nil {
+		return uuid.Nil, Access{}, nil, nil, errors.New("failed to generate encryption and HMAC keys for Access Struct")
+	}
+
+	// Check if access exists, unpack, check tag, and decrypt
+	accessValue, ok := userdata.datastore.Get(accessUUID)
+	if !ok {
+		return uuid.Nil, Access{}, nil, nil, errors.New("file does not exist in user namespace")
+	}
+	accessMsg, _, err := OpenRecord(userdata.datastore, accessUUID, accessValue, RecordAccess, accessHMACKey)
+	if err != nil {
+		return uuid.Nil, Access{}, nil, nil, errors.New("integrity check failed: Access Struct has been tampered with")
+	}
+	accessStruct, err = DecryptAccessMsg(accessMsg, accessEncryptKey)
+	if err != nil {
+		return uuid.Nil, Access{}, nil, nil, errors.New("could not decrypt Access Struct")
+	}
+
+	// An owner whose ownership transfer was accepted has become a sharee
+	if accessStruct.IsOwner && accessStruct.Transfer.Ptr != uuid.Nil {
+		accessStruct, err = CompleteTransfer(userdata, filename, accessUUID, accessStruct, accessEncryptKey, accessHMACKey)
+		if err != nil {
+			return uuid.Nil, Access{}, nil, nil, err
+		}
+	}
+
+	// An owner who took the file in a transfer has to have claimed it, see transfer.go
+	if accessStruct.IsOwner && accessStruct.Epoch > 0 {
+		err = ClaimOwnership(userdata, accessStruct.MetaUUID, accessStruct.Epoch)
+		if err != nil {
+			return uuid.Nil, Access{}, nil, nil, err
+		}
+	}
+
+	// A sharee whose node was moved to a new sourcekey follows the forward to it
+	if !accessStruct.IsOwner {
+		invitationSourceKey, followed, err := FollowForwards(userdata, accessStruct.InvitationUUID, accessStruct.InvitationSourcekey)
+		if err != nil {
+			return uuid.Nil, Access{}, nil, nil, err
+		}
+		if len(followed) > 0 {
+			accessStruct.InvitationSourcekey = invitationSourceKey
+			err = EncryptMacAndStore(userdata.datastore, accessUUID, RecordAccess, accessStruct, accessEncryptKey, accessHMACKey)
+			if err != nil {
+				return uuid.Nil, Access{}, nil, nil, errors.New("failed to store access struct")
+			}
+			err = userdata.datastore.DeleteBatch(followed)
+			if err != nil {
+				return uuid.Nil, Access{}, nil, nil, err
+			}
+		}
+	}
+	return
+}
+
+func LoadMeta(userdata *User, accessStruct Access) (metaUUID userlib.UUID, metaStruct Meta, metaEncryptKey, metaHMACKey []byte, grant FileGrant, err error) {
+	datastore := userdata.datastore
+
+	// Get meta UUID and keys
+	metaUUID, metaSourceKey, grant, err := GetMetaUUIDAndSourceKey(datastore, accessStruct)
+	if err != nil {
+		return uuid.Nil, Meta{}, nil, nil, FileGrant{}, fmt.Errorf("could not get Meta UUID and sourcekey: %w", err)
+	}
+	metaEncryptKey, metaHMACKey, err = GetTwoHASHKDFKeys(metaSourceKey, ENCRYPT, MAC)
+	if err != nil {
+		return uuid.Nil, Meta{}, nil, nil, FileGrant{}, errors.New("could not get Meta encrypt and mac keys")
+	}
+
+	// Check if meta exists, unpack, check tag and signature, and decrypt
+	metaValue, ok := datastore.Get(metaUUID)
+	if !ok {
+		return uuid.Nil, Meta{}, nil, nil, FileGrant{}, ErrFileDeleted
+	}
+	metaMsg, metaSig, err := OpenRecord(datastore, metaUUID, metaValue, RecordMeta, metaHMACKey)
+	if err != nil {
+		return uuid.Nil, Meta{}, nil, nil, FileGrant{}, errors.New("integrity check failed: Meta struct has been tampered with")
+	}
+	err = userlib.DSVerify(grant.FileVerifyKey, metaMsg, metaSig)
+	if err != nil {
+		return uuid.Nil, Meta{}, nil, nil, FileGrant{}, errors.New("integrity check failed: Meta struct was not signed by a writer")
+	}
+	metaStruct, err = DecryptMetaMsg(metaMsg, metaEncryptKey)
+	if err != nil {
+		return uuid.Nil, Meta{}, nil, nil, FileGrant{}, errors.New("failed to decrypt Meta struct")
+	}
+
+	// reject a meta older than one this session has already seen
+	err = userdata.session.See(metaUUID, metaStruct.Sequence)
+	if err != nil {
+		return uuid.Nil, Meta{}, nil, nil, FileGrant{}, err
+	}
+	return
+}
+
+func StoreMeta(userdata *User, metaUUID userlib.UUID, metaStruct Meta, metaEncryptKey, metaHMACKey []byte, grant FileGrant) (err error) {
+	if !CanWrite(grant) {
+		return ErrReadOnly
+	}
+
+	// number the write after every meta this session has seen or stored
+	metaStruct.Sequence = userdata.session.Next(metaUUID, metaStruct.Sequence)
+
+	// encrypt and mac, sign, package, and store
+	metaMsg, metaTag, err := EncryptThenMac(RecordMeta, metaUUID, metaStruct, metaEncryptKey, metaHMACKey)
+	if err != nil {
+		return err
+	}
+	metaSig, err := userlib.DSSign(grant.FileSignKey, metaMsg)
+	if err != nil {
+		return errors.New("failed to sign Meta struct")
+	}
+	metaValue, err := GenerateSignedUUIDVal(RecordMeta, metaMsg, metaTag, metaSig)
+	if err != nil {
+		return err
+	}
+	err = userdata.datastore.Set(metaUUID, metaValue)
+	if err != nil {
+		return err
+	}
+	return userdata.session.See(metaUUID, metaStruct.Sequence)
+}
+
+func LoadInvitationList(datastore Datastore, accessStruct Access) (invitationListStruct InvitationList, invitationListEncryptKey, invitationListHMACKey []byte, err error) {
+	// Get invitation list keys
+	invitationListEncryptKey, invitationListHMACKey, err = GetTwoHASHKDFKeys(accessStruct.ListKey, ENCRYPT, MAC)
+	if err != nil {
+		return InvitationList{}, nil, nil, err
+	}
+
+	// Get value, unpack, check tag, and decrypt
+	invitationListValue, ok := datastore.Get(accessStruct.InvitationList)
+	if !ok {
+		return InvitationList{}, nil, nil, errors.New("failed to get invitation list from Datastore")
+	}
+	invitationListMsg, _, err := OpenRecord(datastore, accessStruct.InvitationList, invitationListValue, RecordInvitationList, invitationListHMACKey)
+	if err != nil {
+		return InvitationList{}, nil, nil, errors.New("integrity check failed: detected unauthorized modifications")
+	}
+	invitationListStruct, err = DecryptInvitationListMsg(invitationListMsg, invitationListEncryptKey)
+	if err != nil {
+		return InvitationList{}, nil, nil, errors.New("failed to decrypt invitation list struct")
+	}
+	return
+}
+
+// returns ErrReadOnly if filename is an existing file the user may not write, nil if it is theirs
+// to store, and whether the new version should be deduplicated and compressed
+func CheckCanStore(userdata *User, filename string) (chunked, compressed bool, err error) {
+	accessUUID, err := GetAccessUUID(*userdata, filename)
+	if err != nil {
+		return false, false, errors.New("failed to get accessUUID")
+	}
+	if _, ok := userdata.datastore.Get(accessUUID); !ok {
+		return false, false, nil
+	}
+	_, accessStruct, _, _, err := LoadAccess(userdata, filename)
+	if err != nil {
+		return false, false, err
+	}
+	_, metaStruct, _, _, grant, err := LoadMeta(userdata, accessStruct)
+	if err != nil {
+		return false, false, err
+	}
+	if !CanWrite(grant) {
+		return false, false, ErrReadOnly
+	}
+	return Deduplicates(accessStruct, metaStruct), metaStruct.Compression, nil
+}
+
+// makes tree the current version of filename, creating the file when the user has none by that name
+func StoreFileTree(userdata *User, filename string, tree FileTree) (err error) {
+	// Get accessUUID and keys
+	accessUUID, err := GetAccessUUID(*userdata, filename)
+	if err != nil {
+		return errors.New("failed to get accessUUID")
+	}
+	accessSourceKey, err := GetAccessKey(userdata.sourceKey, filename)
+	if err != nil {
+		return errors.New("failed to get access sourcekey")
+	}
+	accessEncryptKey, accessHMACKey, err := GetTwoHASHKDFKeys(accessSourceKey, ENCRYPT, MAC)
+	if err != nil {
+		return errors.New("failed to get access encrypt and mac keys")
+	}
+	_, ok := userdata.datastore.Get(accessUUID)
+
+	if ok {
+		// Access exists, get the access struct
+		_, accessStruct, _, _, err := LoadAccess(userdata, filename)
+		if err != nil {
+			return err
+		}
+
+		// Get the meta and check the user may write to the file
+		metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant, err := LoadMeta(userdata, accessStruct)
+		if err != nil {
+			return err
+		}
+		if !CanWrite(grant) {
+			return ErrReadOnly
+		}
+
+		// Keep the current tree as the latest old version and make the new one current
+		metaStruct.History = append(metaStruct.History, FileVersion{metaStruct.Version, metaStruct.FileTree})
+		metaStruct.FileTree = tree
+		metaStruct.Version++
+
+		// Drop the versions beyond retention, their blocks are reclaimed once the new meta is stored
+		metaStruct, droppedBlocks, droppedChunks, err := TrimHistory(userdata.datastore, metaStruct)
+		if err != nil {
+			return err
+		}
+		metaStruct, releasedChunks := TakeReleasedChunks(accessStruct, metaStruct, droppedChunks)
+
+		// Sign and store the updated meta
+		err = StoreMeta(userdata, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
+		if err != nil {
+			return err
+		}
+		if len(droppedBlocks) > 0 {
+			err = userdata.datastore.DeleteBatch(droppedBlocks)
+			if err != nil {
+				return err
+			}
+		}
+		err = ReleaseChunks(userdata, releasedChunks)
+		if err != nil {
+			return err
+		}
+
+	} else {
+		// Access does not exist. user must create a new file around the tree
+
+		// Generate the keys that sign the meta, the owner can always write
+		fileSignKey, fileVerifyKey, err := userlib.DSKeyGen()
+		if err != nil {
+			return errors.New("failed to generate file signature keys")
+		}
+		grant := FileGrant{
+			Permission:    PermissionReadWrite,
+			FileSignKey:   fileSignKey,
+			FileVerifyKey: fileVerifyKey,
+		}
+
+		// Generate meta UUID and keys
+		metaUUID := uuid.New()
+		metaSourceKey, err := GetRandomKey(userdata)
+		if err != nil {
+			return errors.New("failed to get meta sourcekey")
+		}
+		metaEncryptKey, metaHMACKey, err := GetTwoHASHKDFKeys(metaSourceKey, ENCRYPT, MAC)
+		if err != nil {
+			return errors.New("failed to get file HDKF")
+		}
+
+		// Construct the metadata struct (UUIDs and keys), encrypt, mac, sign, and store
+		metaStruct := Meta{FileTree: tree, Version: 1, Retention: DefaultVersionRetention}
+		err = StoreMeta(userdata, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
+		if err != nil {
+			return err
+		}
+
+		// set list key
+		userListKey, err := GetRandomKey(userdata)
+		if err != nil {
+			return err
+		}
+
+		invitationList := InvitationList{
+			Invitations: make(map[uuid.UUID][]byte),
+		}
+
+		invitationListEncryptKey, invitationListHMACKey, err := GetTwoHASHKDFKeys(userListKey, ENCRYPT, MAC)
+		if err != nil {
+			return errors.New("failed to generate encryption and HMAC keys for invite list Struct")
+		}
+
+		// Encrypt and mac meta and return it back to the datastore
+		inviteListUUID := uuid.New()
+		userListMsg, userListTag, err := EncryptThenMac(RecordInvitationList, inviteListUUID, invitationList, invitationListEncryptKey, invitationListHMACKey)
+		if err != nil {
+			return err
+		}
+
+		inviteListValue, err := GenerateUUIDVal(RecordInvitationList, userListMsg, userListTag)
+		if err != nil {
+			return err
+		}
+		err = userdata.datastore.Set(inviteListUUID, inviteListValue)
+		if err != nil {
+			return err
+		}
+
+		// Create the owner struct
+		ownerStruct := Access{
+			MetaUUID:       metaUUID,
+			MetaSourcekey:  metaSourceKey,
+			InvitationList: inviteListUUID,
+			ListKey:        userListKey,
+			IsOwner:        true,
+			Grant:          grant,
+		}
+
+		if !ownerStruct.IsOwner {
+			return errors.New("error making struct")
+		}
+
+		// access encrypt then mac
+		ownerMsg, ownerTag, err := EncryptThenMacAccess(accessUUID, ownerStruct, accessEncryptKey, accessHMACKey)
+		if err != nil {
+			return err
+		}
 
-	// generate asymmetric signature keys
-	signpriv, signpub, err1 := userlib.DSKeyGen()
+		// package the values
+		ownerValue, err := GenerateUUIDVal(RecordAccess, ownerMsg, ownerTag)
+		if err != nil {
+			return err
+		}
+		err = userdata.datastore.Set(accessUUID, ownerValue)
+		if err != nil {
+			return err
+		}
 
-	// check for errors
-	if err != nil {
-		return pk, sk, signpriv, signpub, errors.New(strings.ToTitle("rSA KeyGen failed"))
-	}
-	if err1 != nil {
-		return pk, sk, signpriv, signpub, errors.New(strings.ToTitle("signature KeyGen failed"))
+		// record the new file in the user's file index
+		err = AddToFileIndex(userdata, filename, true)
+		if err != nil {
+			return err
+		}
 	}
-	return
+	return nil
 }
 
-// given secure source key this should produce fast secure keys
-func GetTwoHASHKDFKeys(sourcekey []byte, purpose1, purpose2 string) (key1, key2 []byte, err error) {
-	// generate keys and check errors
-	key, err := userlib.HashKDF(sourcekey, []byte(purpose1))
-	if err != nil {
-		return nil, nil, errors.New(strings.ToTitle("key creation failed"))
+// stores the meta after an append. When the appends left the current version more than
+// CompactThreshold blocks over what its content needs, it is compacted first.
+func StoreAppendedMeta(userdata *User, accessStruct Access, metaUUID userlib.UUID, metaStruct Meta, metaEncryptKey, metaHMACKey []byte, grant FileGrant) (err error) {
+	var droppedBlocks, droppedChunks []userlib.UUID
+	if metaStruct.CompactThreshold > 0 {
+		blocks, length, err := FileTreeBlocks(userdata.datastore, metaStruct.FileTree)
+		if err != nil {
+			return err
+		}
+		needed := (length + BlockSize - 1) / BlockSize
+		if blocks-needed > metaStruct.CompactThreshold {
+			metaStruct.FileTree, droppedBlocks, droppedChunks, err = CompactFileTree(userdata, metaStruct.FileTree, Deduplicates(accessStruct, metaStruct), metaStruct.Compressed)
+			if err != nil {
+				return err
+			}
+		}
 	}
-	key1 = key[:16]
-	key, err = userlib.HashKDF(sourcekey, []byte(purpose2))
+	metaStruct, releasedChunks := TakeReleasedChunks(accessStruct, metaStruct, droppedChunks)
+	err = StoreMeta(userdata, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
 	if err != nil {
-		return nil, nil, errors.New(strings.ToTitle("key creation failed"))
+		return err
 	}
-	key2 = key[:LENGTH]
-	return
-}
-
-func GetAccessUUID(user User, filename string) (UUID userlib.UUID, err error) {
-	// hash username and check error
-	accessbytes := []byte(filename)
-	accesshash, err := userlib.HashKDF(user.sourceKey, accessbytes)
+	err = userdata.datastore.DeleteBatch(droppedBlocks)
 	if err != nil {
-		return uuid.UUID{}, errors.New(strings.ToTitle("hashing failed"))
+		return err
 	}
+	return ReleaseChunks(userdata, releasedChunks)
+}
 
-	// convert to byte and check error
-	UUID, err = uuid.FromBytes(accesshash[:LENGTH])
-	if err != nil {
-		return uuid.UUID{}, errors.New(strings.ToTitle("Conversion to UUID failed"))
-	}
+// returns the UUID of every block and index node of the tree, and of every chunk it uses
+func GetFileRecords(datastore Datastore, tree FileTree) (records, chunks []userlib.UUID, err error) {
+	_, records, chunks, err = ReadFileTree(datastore, tree)
 	return
 }
 
-func GetInvitationUUID(owner *User, sharee, filename string) (UUID userlib.UUID, err error) {
-	// hash username and check error
-	invitebytes := []byte(owner.Username + filename + sharee)
-	invitehash, err := userlib.HashKDF(owner.sourceKey, invitebytes)
-	if err != nil {
-		return uuid.UUID{}, errors.New(strings.ToTitle("Hashing failed"))
-	}
-
-	// convert to byte and check error
-	UUID, err = uuid.FromBytes(invitehash[:LENGTH])
-	if err != nil {
-		return uuid.UUID{}, errors.New(strings.ToTitle("file not found"))
+// drops the oldest versions until no more than Retention are kept and returns the blocks and chunks they used
+func TrimHistory(datastore Datastore, metaStruct Meta) (trimmed Meta, droppedBlocks, droppedChunks []userlib.UUID, err error) {
+	for len(metaStruct.History) > 0 && len(metaStruct.History) >= metaStruct.Retention {
+		blocks, chunks, err := GetFileRecords(datastore, metaStruct.History[0].FileTree)
+		if err != nil {
+			return Meta{}, nil, nil, err
+		}
+		droppedBlocks = append(droppedBlocks, blocks...)
+		droppedChunks = append(droppedChunks, chunks...)
+		metaStruct.History = metaStruct.History[1:]
 	}
-	return
+	return metaStruct, droppedBlocks, droppedChunks, nil
 }
 
-func GenerateUUIDVal(msg, tag []byte) (value []byte, err error) {
-	// create map
-	Map := map[string][]byte{
-		"Msg": msg,
-		"Tag": tag,
+// overwrites every block with random bytes of the same length before deleting it, so a
+// reader still holding on to a block only ever sees noise. What is left of the old bytes
+// depends on the backend: UserlibDatastore drops them from its map with the delete, while
+// FileDatastore, or any other backend that implements Purger, keeps them until it is
+// purged, which is done before returning.
+func SecureDeleteBlocks(datastore Datastore, blocks []userlib.UUID) (err error) {
+	if len(blocks) == 0 {
+		return nil
 	}
-
-	// generate byte array
-	value, err = json.Marshal(Map)
+	overwrites := make(map[userlib.UUID][]byte)
+	for blockUUID, value := range datastore.GetBatch(blocks) {
+		overwrites[blockUUID] = userlib.RandomBytes(len(value))
+	}
+	err = datastore.SetBatch(overwrites)
 	if err != nil {
-		return nil, errors.New(strings.ToTitle("file not found"))
+		return err
 	}
-	return
-}
-
-func UnpackValue(value []byte) (msg, tag []byte, err error) {
-	// unmarshall datastore value
-	unpackedData := make(map[string][]byte)
-	err = json.Unmarshal(value, &unpackedData)
-
-	// check for error unmarshalling and return
+	err = datastore.DeleteBatch(blocks)
 	if err != nil {
-		return nil, nil, errors.New(strings.ToTitle("unmarshal failed"))
+		return err
 	}
-	msg, tag = unpackedData["Msg"], unpackedData["Tag"]
-	return
+	if purger, ok := datastore.(Purger); ok {
+		return purger.Purge()
+	}
+	return nil
 }
 
-func EncryptThenMac(txt interface{}, key1, key2 []byte) (msg, tag []byte, err error) {
-	// convert text to bytes and check for error
-	plaintext, err := json.Marshal(txt)
+func EncryptMacAndStore(datastore Datastore, UUID userlib.UUID, recordType RecordType, txt interface{}, key1, key2 []byte) (err error) {
+	// encrypt and mac, package, and store
+	msg, tag, err := EncryptThenMac(recordType, UUID, txt, key1, key2)
 	if err != nil {
-		return nil, nil, errors.New(strings.ToTitle("marshal failed"))
+		return err
 	}
-
-	// encrypt and mac
-	rndbytes := userlib.RandomBytes(LENGTH)
-	msg = userlib.SymEnc(key1, rndbytes, plaintext)
-	tag, err = userlib.HMACEval(key2, msg)
-
-	// check for error and return
+	value, err := GenerateUUIDVal(recordType, msg, tag)
 	if err != nil {
-		return nil, nil, errors.New(strings.ToTitle("hmac failed"))
+		return err
 	}
-	return
+	return datastore.Set(UUID, value)
 }
 
-func EncryptThenMacAccess(txt Access, key1, key2 []byte) (msg, tag []byte, err error) {
-	// convert text to bytes and check for error
-	plaintext, err := json.Marshal(txt)
-	if err != nil {
-		return nil, nil, errors.New(strings.ToTitle("marshal failed"))
-	}
-
-	// encrypt and mac
-	rndbytes := userlib.RandomBytes(LENGTH)
-	msg = userlib.SymEnc(key1, rndbytes, plaintext)
-	tag, err = userlib.HMACEval(key2, msg)
-
-	// check for error and return
+func StoreInvitation(datastore Datastore, invitationUUID userlib.UUID, invitationSourceKey []byte, invitation Invitation) (err error) {
+	invitationEncryptKey, invitationHMACKey, err := GetTwoHASHKDFKeys(invitationSourceKey, ENCRYPT, MAC)
 	if err != nil {
-		return nil, nil, errors.New(strings.ToTitle("hmac failed"))
+		return errors.New("failed to generate keys for invite")
 	}
-	return
+	return EncryptMacAndStore(datastore, invitationUUID, RecordInvitation, invitation, invitationEncryptKey, invitationHMACKey)
 }
 
-func EncryptThenSign(txt InvitationMeta, user string, sk userlib.DSSignKey) (msg, sig []byte, err error) {
-	// convert to byte array, check for error
-	plaintext, err := json.Marshal(txt)
+func LoadInvitation(datastore Datastore, invitationUUID userlib.UUID, invitationSourceKey []byte) (invitationStruct Invitation, invitationEncryptKey, invitationHMACKey []byte, err error) {
+	// Get invitation keys
+	invitationEncryptKey, invitationHMACKey, err = GetTwoHASHKDFKeys(invitationSourceKey, ENCRYPT, MAC)
 	if err != nil {
-		return nil, nil, errors.New(strings.ToTitle("marshal failed"))
+		return Invitation{}, nil, nil, errors.New("could not get keys")
 	}
 
-	// encrypt using user public key, check for error
-	pubkey, ok := userlib.KeystoreGet(user + " public key")
+	// check if invitation exists, unpack, check tag, and decrypt
+	invitationValue, ok := datastore.Get(invitationUUID)
 	if !ok {
-		return nil, nil, errors.New(strings.ToTitle("keystoreGet failed"))
+		return Invitation{}, nil, nil, ErrFileDeleted
 	}
-	ciphertext, err := userlib.PKEEnc(pubkey, plaintext)
+	invitationMsg, _, err := OpenRecord(datastore, invitationUUID, invitationValue, RecordInvitation, invitationHMACKey)
 	if err != nil {
-		return nil, nil, errors.New(strings.ToTitle("encryption failed"))
+		return Invitation{}, nil, nil, errors.New("integrity check failed: Invitation struct has unauthorized modifications")
 	}
-
-	// sign, check for error, and return
-	sig, err = userlib.DSSign(sk, ciphertext)
-	return ciphertext, sig, err
-}
-
-func CheckTag(msg, tag, key2 []byte) (err error) {
-	// compute tag and check error
-	computedTag, err := userlib.HMACEval(key2, msg)
+	invitationStruct, err = DecryptInvitationMsg(invitationMsg, invitationEncryptKey)
 	if err != nil {
-		return err
-	}
-
-	if userlib.HMACEqual(tag, computedTag) {
-		return
-	}
-	return errors.New("integrity check failed")
-}
-
-func CheckSignature(msg, sig []byte, user string) (err error) {
-	// get verification key, check error
-	sk, ok := userlib.KeystoreGet(user + " signature key")
-	if !ok {
-		return errors.New("could not get sign key")
+		return Invitation{}, nil, nil, errors.New("could not decrypt Invitation Struct")
 	}
-
-	// verify signature
-	err = userlib.DSVerify(sk, msg, sig)
-	return
-}
-
-func DecryptFileMsg(msg, key1 []byte) (data File, err error) {
-	// decrypt msg
-	plaintext := userlib.SymDec(key1, msg)
-
-	// unmarshal data to get original struct
-	err = json.Unmarshal(plaintext, &data)
-	return
-}
-
-func DecryptAccessMsg(msg, key1 []byte) (data Access, err error) {
-	// decrypt msg
-	plaintext := userlib.SymDec(key1, msg)
-
-	// unmarshal data to get original struct
-	err = json.Unmarshal(plaintext, &data)
-	return
-}
-
-func DecryptMetaMsg(msg, key1 []byte) (data Meta, err error) {
-	// decrypt msg
-	plaintext := userlib.SymDec(key1, msg)
-
-	// unmarshal data to get original struct
-	err = json.Unmarshal(plaintext, &data)
 	return
 }
 
-func DecryptInvitationMsg(msg, key1 []byte) (data Invitation, err error) {
-	// decrypt msg
-	plaintext := userlib.SymDec(key1, msg)
-
-	// unmarshal data to get original struct
-	err = json.Unmarshal(plaintext, &data)
-	return
+// ShareNode is an invitation in the share tree together with where it hangs.
+type ShareNode struct {
+	InvitationUUID userlib.UUID
+	Sourcekey      []byte
+	Parent         userlib.UUID // uuid.Nil for users the owner invited directly
+	Invitation     Invitation
 }
 
-func DecryptInvitationListMsg(msg, key1 []byte) (data InvitationList, err error) {
-	// decrypt msg
-	plaintext := userlib.SymDec(key1, msg)
-
-	// unmarshal data to get original struct
-	err = json.Unmarshal(plaintext, &data)
-	return
-}
+// walks the share tree breadth first from the owner's invitation list, so every parent
+// comes before its children. A node whose record no longer exists is reported, nodes are
+// only ever removed together with the entry that lists them.
+func GetShareTree(datastore Datastore, invitationListStruct InvitationList) (shareTree []ShareNode, err error) {
+	queue := make([]ShareNode, 0, len(invitationListStruct.Invitations))
+	for invitationUUID, invitationSourceKey := range invitationListStruct.Invitations {
+		queue = append(queue, ShareNode{InvitationUUID: invitationUUID, Sourcekey: invitationSourceKey, Parent: uuid.Nil})
+	}
+
+	visited := make(map[userlib.UUID]bool)
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if visited[node.InvitationUUID] {
+			continue
+		}
+		visited[node.InvitationUUID] = true
 
-func DecryptInvitationMetaMsg(msg, key1 []byte) (data InvitationMeta, err error) {
-	// decrypt msg
-	plaintext := userlib.SymDec(key1, msg)
+		// every node listed has to be there, a missing one would hide its recipient and their subtree
+		node.Invitation, _, _, err = LoadInvitation(datastore, node.InvitationUUID, node.Sourcekey)
+		if err == ErrFileDeleted {
+			return nil, errors.New("integrity check failed: a node of the share tree is missing")
+		}
+		if err != nil {
+			return nil, err
+		}
+		shareTree = append(shareTree, node)
 
-	// unmarshal data to get original struct
-	err = json.Unmarshal(plaintext, &data)
-	return
+		for childUUID, childSourceKey := range node.Invitation.Children {
+			queue = append(queue, ShareNode{InvitationUUID: childUUID, Sourcekey: childSourceKey, Parent: node.InvitationUUID})
+		}
+	}
+	return shareTree, nil
 }
 
-func DecryptAsynchMsg(msg []byte, pk userlib.PKEDecKey) (data InvitationMeta, err error) {
-	// decrypt msg
-	plaintext, err := userlib.PKEDec(pk, msg)
+func LoadFileIndex(userdata *User) (fileIndexStruct FileIndex, fileIndexEncryptKey, fileIndexHMACKey []byte, err error) {
+	// Get file index keys
+	fileIndexEncryptKey, fileIndexHMACKey, err = GetTwoHASHKDFKeys(userdata.FileIndexKey, ENCRYPT, MAC)
 	if err != nil {
-		return InvitationMeta{}, errors.New(strings.ToTitle("decryption failed"))
+		return FileIndex{}, nil, nil, err
 	}
 
-	// unmarshal data to get original struct and check for error
-	err = json.Unmarshal(plaintext, &data)
-	if err != nil {
-		return InvitationMeta{}, errors.New(strings.ToTitle("unmarshalling failed"))
+	// Get value, unpack, check tag, and decrypt
+	fileIndexValue, ok := userdata.datastore.Get(userdata.FileIndex)
+	if !ok {
+		return FileIndex{}, nil, nil, errors.New("failed to get file index from Datastore")
 	}
-	return
-}
-
-func GetRandomKey(user *User) (key []byte, err error) {
-	// generate new random key
-	sourcekey, salt := user.sourceKey, userlib.RandomBytes(LENGTH)
-	hashedkey, err := userlib.HashKDF(sourcekey, salt)
-	key = hashedkey[:LENGTH]
-	// check for error
+	fileIndexMsg, _, err := OpenRecord(userdata.datastore, userdata.FileIndex, fileIndexValue, RecordFileIndex, fileIndexHMACKey)
 	if err != nil {
-		return nil, errors.New(strings.ToTitle("file not found"))
+		return FileIndex{}, nil, nil, errors.New("integrity check failed: file index has been tampered with")
 	}
-	return
-}
-
-func GetAccessStruct(invitation userlib.UUID, sourcekey []byte) (access interface{}) {
-	access = Access{InvitationUUID: invitation, InvitationSourcekey: sourcekey, IsOwner: false}
-	return
-}
-
-func GetAccessKey(sourcekey []byte, filename string) (key []byte, err error) {
-	hashedkey, err := userlib.HashKDF(sourcekey, []byte(filename))
-	key = hashedkey[:LENGTH]
+	fileIndexStruct, err = DecryptFileIndexMsg(fileIndexMsg, fileIndexEncryptKey)
 	if err != nil {
-		return nil, errors.New(strings.ToTitle("key creation failed"))
+		return FileIndex{}, nil, nil, errors.New("failed to decrypt file index")
+	}
+	if fileIndexStruct.Files == nil {
+		fileIndexStruct.Files = make(map[string]bool)
 	}
 	return
 }
 
-func AddFileToDatabase(fileUUID userlib.UUID, fileSourceKey, content []byte) (nextFileUUID userlib.UUID, err error) {
-	// generate UUID for next
-	nextFileUUID = uuid.New()
-
-	// generate keys
-	fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(fileSourceKey, ENCRYPT, MAC)
-	if err != nil {
-		return uuid.Nil, errors.New("failed to get keys")
-	}
-
-	// generate file struct
-	file := File{
-		Contents: content,
-		Next:     nextFileUUID,
-	}
-
-	// encrypt file struct
-	encryptedBytes, tag, err := EncryptThenMac(file, fileEncryptKey, fileHMACKey)
+func AddToFileIndex(userdata *User, filename string, isOwner bool) (err error) {
+	fileIndexStruct, fileIndexEncryptKey, fileIndexHMACKey, err := LoadFileIndex(userdata)
 	if err != nil {
-		return uuid.Nil, errors.New("failed to EncryptThenMac")
+		return err
 	}
+	fileIndexStruct.Files[filename] = isOwner
+	return EncryptMacAndStore(userdata.datastore, userdata.FileIndex, RecordFileIndex, fileIndexStruct, fileIndexEncryptKey, fileIndexHMACKey)
+}
 
-	// create value and add to Datastore
-	value, err := GenerateUUIDVal(encryptedBytes, tag)
+func RemoveFromFileIndex(userdata *User, filename string) (err error) {
+	fileIndexStruct, fileIndexEncryptKey, fileIndexHMACKey, err := LoadFileIndex(userdata)
 	if err != nil {
-		return uuid.Nil, errors.New("failed to package data for entry into DataStore")
+		return err
 	}
-	userlib.DatastoreSet(fileUUID, value)
-	return
-}
-
-func GetMetaUUIDAndSourceKey(accessStruct Access) (metaUUID userlib.UUID, metaSourceKey []byte, err error) {
-	// check if user obtained access through invitation
-	userOwnsFile := accessStruct.IsOwner
-	if !userOwnsFile {
-		// get UUID and keys for invitation
-		invitationUUID := accessStruct.InvitationUUID
-		invitationSourceKey := accessStruct.InvitationSourcekey
-		invitationEncryptKey, invitationHMACKey, err := GetTwoHASHKDFKeys(invitationSourceKey, ENCRYPT, MAC)
-		if err != nil {
-			return uuid.New(), nil, errors.New("could not get keys")
-		}
-
-		// check if invitation exists, check tag, unpack, and decrypt
-		invitationValue, ok := userlib.DatastoreGet(invitationUUID)
-		if !ok {
-			return uuid.Nil, nil, errors.New("invitation does not exist")
-		}
-		invitationMsg, invitationTag, err := UnpackValue(invitationValue)
-		if err != nil {
-			return uuid.Nil, nil, errors.New("could not unpack invitation value")
-		}
-		err = CheckTag(invitationMsg, invitationTag, invitationHMACKey)
-		if err != nil {
-			return uuid.Nil, nil, errors.New("integrity check failed: Invitation struct has unauthorized modifications")
-		}
-		invitationStruct, err := DecryptInvitationMsg(invitationMsg, invitationEncryptKey)
-		if err != nil {
-			return uuid.Nil, nil, errors.New("could not decrypt Invitation Struct")
-		}
-
-		// get UUID and sourcekey of meta file
-		metaUUID = invitationStruct.MetaUUID
-		metaSourceKey = invitationStruct.MetaSourcekey
-	} else {
-		metaUUID = accessStruct.MetaUUID
-		metaSourceKey = accessStruct.MetaSourcekey
+	if _, ok := fileIndexStruct.Files[filename]; !ok {
+		return nil
 	}
-	return
+	delete(fileIndexStruct.Files, filename)
+	return EncryptMacAndStore(userdata.datastore, userdata.FileIndex, RecordFileIndex, fileIndexStruct, fileIndexEncryptKey, fileIndexHMACKey)
 }
 
-func UnpackCheckTagAndDecryptFile(fileUUID userlib.UUID, fileEncryptKey, fileHMACKey []byte) (fileStruct File, err error) {
-	fileValue, ok := userlib.DatastoreGet(fileUUID)
-	if !ok {
-		return File{}, errors.New("file value was not found in DataStore")
-	}
-	fileMsg, fileTag, err := UnpackValue(fileValue)
+func StoreUser(userdata *User) (err error) {
+	// get user UUID and keys
+	userUUID, err := GetUserUUID(userdata.Username)
 	if err != nil {
-		return File{}, errors.New("file could not be unpacked")
-	}
-	err = CheckTag(fileMsg, fileTag, fileHMACKey)
-	if err != nil {
-		return File{}, errors.New("integrity check failed: File has unauthorized modifications")
+		return err
 	}
-	fileStruct, err = DecryptFileMsg(fileMsg, fileEncryptKey)
+	encryptKey, hmacKey, err := GetTwoHASHKDFKeys(userdata.sourceKey, ENCRYPT, MAC)
 	if err != nil {
-		return File{}, errors.New("file could not be decrypted")
+		return errors.New("GetTwoHASHKDFKeys error")
 	}
-	return
+
+	// encrypt, mac, and store
+	return EncryptMacAndStore(userdata.datastore, userUUID, RecordUser, *userdata, encryptKey, hmacKey)
 }
 
-func GetInvitationSourceKey(sourceKey []byte, user, filename string) (invitationSourceKey []byte, err error) {
-	hashedinvitationSourceKey, err := userlib.HashKDF(sourceKey, []byte(user+ACCESS+filename))
-	invitationSourceKey = hashedinvitationSourceKey[:LENGTH]
+func DeleteRetiredAccess(userdata *User) (err error) {
+	// delete the access structs, then forget about them
+	err = userdata.datastore.DeleteBatch(userdata.RetiredAccess)
 	if err != nil {
-		return nil, errors.New("failed to get invitation li")
+		return err
 	}
-	return
+	userdata.RetiredAccess = nil
+	return StoreUser(userdata)
 }
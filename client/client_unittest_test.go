@@ -0,0 +1,663 @@
+package client
+
+// White-box tests of the storage backends, transactions, envelopes, sharing and ownership
+// transfer. They live in a _test.go file so that go test runs them along with the unit tests in
+// client_unittest.go.
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+
+	. "github.com/onsi/ginkgo/v2"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestClientUnitSpecs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Client Unit Tests")
+}
+
+var _ = Describe("Client White-box Tests", func() {
+
+	BeforeEach(func() {
+		userlib.DatastoreClear()
+		userlib.KeystoreClear()
+	})
+
+	Describe("Unit Tests", func() {
+		Specify("FileDatastore Test: a torn write is discarded on recovery", func() {
+			path := GinkgoT().TempDir() + "/datastore.log"
+			store, err := OpenFileDatastore(path)
+			Expect(err).To(BeNil())
+
+			kept, torn := userlib.UUID{1}, userlib.UUID{2}
+			Expect(store.Set(kept, []byte("kept"))).To(BeNil())
+			Expect(store.SetBatch(map[userlib.UUID][]byte{torn: []byte("torn"), kept: []byte("overwritten")})).To(BeNil())
+			Expect(store.Close()).To(BeNil())
+
+			// chop the last byte off the batch frame as if we crashed mid-write
+			info, err := os.Stat(path)
+			Expect(err).To(BeNil())
+			Expect(os.Truncate(path, info.Size()-1)).To(BeNil())
+
+			store, err = OpenFileDatastore(path)
+			Expect(err).To(BeNil())
+			value, ok := store.Get(kept)
+			Expect(ok).To(BeTrue())
+			Expect(value).To(Equal([]byte("kept")))
+			_, ok = store.Get(torn)
+			Expect(ok).To(BeFalse())
+
+			// the log is writable again after the truncated tail is dropped
+			Expect(store.Set(torn, []byte("again"))).To(BeNil())
+			Expect(store.Close()).To(BeNil())
+			store, err = OpenFileDatastore(path)
+			Expect(err).To(BeNil())
+			value, ok = store.Get(torn)
+			Expect(ok).To(BeTrue())
+			Expect(value).To(Equal([]byte("again")))
+			Expect(store.Close()).To(BeNil())
+		})
+
+		Specify("FileDatastore Test: a corrupt frame before the last one is reported, not truncated", func() {
+			path := GinkgoT().TempDir() + "/datastore.log"
+			store, err := OpenFileDatastore(path)
+			Expect(err).To(BeNil())
+			first, second, third := userlib.UUID{1}, userlib.UUID{2}, userlib.UUID{3}
+			Expect(store.Set(first, []byte("first"))).To(BeNil())
+			Expect(store.Set(second, []byte("second"))).To(BeNil())
+			Expect(store.Set(third, []byte("third"))).To(BeNil())
+			Expect(store.Close()).To(BeNil())
+
+			// flip a byte of the second value, the third frame follows it
+			log, err := os.ReadFile(path)
+			Expect(err).To(BeNil())
+			at := bytes.Index(log, []byte("second"))
+			Expect(at).To(BeNumerically(">", 0))
+			log[at] ^= 0xff
+			Expect(os.WriteFile(path, log, 0600)).To(BeNil())
+
+			_, err = OpenFileDatastore(path)
+			Expect(err).ToNot(BeNil())
+			after, err := os.ReadFile(path)
+			Expect(err).To(BeNil())
+			Expect(after).To(Equal(log))
+
+			// the same damage to the last frame is a torn write and is dropped
+			Expect(os.WriteFile(path, log[:at+len("second")+frameTrailSize], 0600)).To(BeNil())
+			store, err = OpenFileDatastore(path)
+			Expect(err).To(BeNil())
+			value, ok := store.Get(first)
+			Expect(ok).To(BeTrue())
+			Expect(value).To(Equal([]byte("first")))
+			_, ok = store.Get(second)
+			Expect(ok).To(BeFalse())
+			Expect(store.Close()).To(BeNil())
+		})
+
+		Specify("FileDatastore Test: a log can only be open once at a time", func() {
+			path := GinkgoT().TempDir() + "/datastore.log"
+			store, err := OpenFileDatastore(path)
+			Expect(err).To(BeNil())
+			_, err = OpenFileDatastore(path)
+			Expect(err).To(Equal(ErrDatastoreInUse))
+
+			// compacting keeps the log locked
+			Expect(store.Set(userlib.UUID{1}, []byte("old"))).To(BeNil())
+			Expect(store.Set(userlib.UUID{1}, []byte("new"))).To(BeNil())
+			Expect(store.Compact()).To(BeNil())
+			_, err = OpenFileDatastore(path)
+			Expect(err).To(Equal(ErrDatastoreInUse))
+
+			Expect(store.Close()).To(BeNil())
+			store, err = OpenFileDatastore(path)
+			Expect(err).To(BeNil())
+			value, _ := store.Get(userlib.UUID{1})
+			Expect(value).To(Equal([]byte("new")))
+			Expect(store.Close()).To(BeNil())
+		})
+
+		Specify("FileDatastore Test: securely deleted blocks are purged from the log", func() {
+			path := GinkgoT().TempDir() + "/datastore.log"
+			store, err := OpenFileDatastore(path)
+			Expect(err).To(BeNil())
+			block, kept := userlib.UUID{1}, userlib.UUID{2}
+			secret := []byte("secret block content")
+			Expect(store.SetBatch(map[userlib.UUID][]byte{block: secret, kept: []byte("kept")})).To(BeNil())
+
+			Expect(SecureDeleteBlocks(store, []userlib.UUID{block})).To(BeNil())
+			log, err := os.ReadFile(path)
+			Expect(err).To(BeNil())
+			Expect(bytes.Contains(log, secret)).To(BeFalse())
+			_, ok := store.Get(block)
+			Expect(ok).To(BeFalse())
+			value, _ := store.Get(kept)
+			Expect(value).To(Equal([]byte("kept")))
+			Expect(store.Close()).To(BeNil())
+		})
+
+		Specify("Concurrency Test: a commit only goes through while nothing was written since it started", func() {
+			path := GinkgoT().TempDir() + "/datastore.log"
+			store, err := OpenFileDatastore(path)
+			Expect(err).To(BeNil())
+			read, written, missing := userlib.UUID{1}, userlib.UUID{2}, userlib.UUID{3}
+			Expect(store.SetBatch(map[userlib.UUID][]byte{read: []byte("read"), written: []byte("old")})).To(BeNil())
+
+			// the transaction sees its own writes, the store only once it commits
+			tx := NewTransaction(store)
+			value, ok := tx.Get(read)
+			Expect(ok).To(BeTrue())
+			Expect(value).To(Equal([]byte("read")))
+			_, ok = tx.Get(missing)
+			Expect(ok).To(BeFalse())
+			Expect(tx.Set(written, []byte("new"))).To(BeNil())
+			Expect(tx.Delete(read)).To(BeNil())
+			value, _ = tx.Get(written)
+			Expect(value).To(Equal([]byte("new")))
+			_, ok = tx.Get(read)
+			Expect(ok).To(BeFalse())
+			value, _ = store.Get(written)
+			Expect(value).To(Equal([]byte("old")))
+
+			// any write to the store in the meantime fails the commit, even one that is undone again
+			Expect(store.Set(missing, []byte("appeared"))).To(BeNil())
+			Expect(store.Delete(missing)).To(BeNil())
+			Expect(tx.Current()).To(BeFalse())
+			Expect(tx.Commit()).To(Equal(ErrConflict))
+			value, _ = store.Get(written)
+			Expect(value).To(Equal([]byte("old")))
+
+			// started over, the attempt commits
+			tx = NewTransaction(store)
+			Expect(tx.Set(written, []byte("new"))).To(BeNil())
+			Expect(tx.Delete(read)).To(BeNil())
+			Expect(tx.Current()).To(BeTrue())
+			Expect(tx.Commit()).To(BeNil())
+
+			// the commit is one frame, which survives reopening the log
+			Expect(store.Close()).To(BeNil())
+			store, err = OpenFileDatastore(path)
+			Expect(err).To(BeNil())
+			value, _ = store.Get(written)
+			Expect(value).To(Equal([]byte("new")))
+			_, ok = store.Get(read)
+			Expect(ok).To(BeFalse())
+			Expect(store.Close()).To(BeNil())
+		})
+
+		Specify("Concurrency Test: committing to the userlib datastore does not read back what the attempt read", func() {
+			userlib.DatastoreClear()
+			block, written := userlib.UUID{1}, userlib.UUID{2}
+			content := userlib.RandomBytes(64 * 1024)
+			Expect(UserlibDatastore{}.Set(block, content)).To(BeNil())
+
+			tx := NewTransaction(UserlibDatastore{})
+			value, ok := tx.Get(block)
+			Expect(ok).To(BeTrue())
+			Expect(value).To(Equal(content))
+			Expect(tx.Set(written, []byte("new"))).To(BeNil())
+			bandwidth := userlib.DatastoreGetBandwidth()
+			Expect(tx.Commit()).To(BeNil())
+			Expect(userlib.DatastoreGetBandwidth() - bandwidth).To(BeNumerically("<", 1024))
+
+			// a write from elsewhere still fails the commit
+			tx = NewTransaction(UserlibDatastore{})
+			tx.Get(block)
+			Expect(tx.Set(written, []byte("newer"))).To(BeNil())
+			Expect(UserlibDatastore{}.Set(block, []byte("replaced"))).To(BeNil())
+			Expect(tx.Commit()).To(Equal(ErrConflict))
+			value, _ = UserlibDatastore{}.Get(written)
+			Expect(value).To(Equal([]byte("new")))
+		})
+
+		Specify("Compression Test: compressed blocks are padded and only kept when smaller", func() {
+			text := make([]byte, BlockSize)
+			for i := range text {
+				text[i] = "compressible"[i%12]
+			}
+			fileStruct, err := CompressBlock(text)
+			Expect(err).To(BeNil())
+			Expect(fileStruct.Compressed).To(BeTrue())
+			Expect(len(fileStruct.Contents) % compressionPadding).To(Equal(0))
+			contents, err := DecompressBlock(fileStruct)
+			Expect(err).To(BeNil())
+			Expect(contents).To(Equal(text))
+
+			random := userlib.RandomBytes(BlockSize)
+			fileStruct, err = CompressBlock(random)
+			Expect(err).To(BeNil())
+			Expect(fileStruct.Compressed).To(BeFalse())
+			Expect(fileStruct.Contents).To(Equal(random))
+
+			// a bomb that inflates past BlockSize is rejected
+			fileStruct, err = CompressBlock(append(text, text...))
+			Expect(err).To(BeNil())
+			_, err = DecompressBlock(fileStruct)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Envelope Test: legacy records are still read and rewritten into envelopes", func() {
+			alice, err := InitUser("alice", "password")
+			Expect(err).To(BeNil())
+			bob, err := InitUser("bob", "password")
+			Expect(err).To(BeNil())
+			content := userlib.RandomBytes(2*BlockSize + 5)
+			Expect(alice.StoreFile("file", content)).To(BeNil())
+			invite, err := alice.CreateInvitation("file", "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, "file")).To(BeNil())
+
+			// turn the records alice reads back into JSON maps tagged over the msg alone, as
+			// they were stored before the envelope
+			userUUID, err := GetUserUUID("alice")
+			Expect(err).To(BeNil())
+			_, userHMACKey, err := GetTwoHASHKDFKeys(GetSourceKey("alice", "password"), ENCRYPT, MAC)
+			Expect(err).To(BeNil())
+			_, _, fileIndexHMACKey, err := LoadFileIndex(alice)
+			Expect(err).To(BeNil())
+			accessUUID, accessStruct, _, accessHMACKey, err := LoadAccess(alice, "file")
+			Expect(err).To(BeNil())
+			metaUUID, metaStruct, _, metaHMACKey, _, err := LoadMeta(alice, accessStruct)
+			Expect(err).To(BeNil())
+			fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(metaStruct.FileSourcekey, ENCRYPT, MAC)
+			Expect(err).To(BeNil())
+			root, err := LoadIndexNode(alice.datastore, IndexEntry{UUID: metaStruct.Root, Hash: metaStruct.RootHash}, fileEncryptKey, fileHMACKey)
+			Expect(err).To(BeNil())
+
+			legacy := make(map[userlib.UUID][]byte)
+			toLegacy := func(UUID userlib.UUID, hmacKey []byte) {
+				value, ok := userlib.DatastoreGet(UUID)
+				Expect(ok).To(BeTrue())
+				_, msg, _, sig, _, err := UnpackEnvelope(value)
+				Expect(err).To(BeNil())
+				tag, err := userlib.HMACEval(hmacKey, msg)
+				Expect(err).To(BeNil())
+				fields := map[string][]byte{"Msg": msg, "Tag": tag}
+				if len(sig) > 0 {
+					fields["Sig"] = sig
+				}
+				legacy[UUID], err = json.Marshal(fields)
+				Expect(err).To(BeNil())
+				Expect(len(legacy[UUID])).To(BeNumerically(">", len(value)))
+				userlib.DatastoreSet(UUID, legacy[UUID])
+			}
+			toLegacy(userUUID, userHMACKey)
+			toLegacy(alice.FileIndex, fileIndexHMACKey)
+			bobAccessUUID, _, _, bobAccessHMACKey, err := LoadAccess(bob, "file")
+			Expect(err).To(BeNil())
+			toLegacy(accessUUID, accessHMACKey)
+			toLegacy(metaUUID, metaHMACKey)
+			toLegacy(metaStruct.Root, fileHMACKey)
+			for _, entry := range root.Entries {
+				toLegacy(entry.UUID, fileHMACKey)
+			}
+
+			// and bob's access struct into a version 1 envelope, tagged over the msg alone too
+			value, ok := userlib.DatastoreGet(bobAccessUUID)
+			Expect(ok).To(BeTrue())
+			recordType, msg, _, _, _, err := UnpackEnvelope(value)
+			Expect(err).To(BeNil())
+			tag, err := userlib.HMACEval(bobAccessHMACKey, msg)
+			Expect(err).To(BeNil())
+			legacy[bobAccessUUID] = PackEnvelope(recordType, msg, tag, nil)
+			legacy[bobAccessUUID][2] = legacyEnvelopeVersion
+			userlib.DatastoreSet(bobAccessUUID, legacy[bobAccessUUID])
+
+			// everything still loads, and a record is rewritten by the time it is returned
+			aliceLaptop, err := GetUser("alice", "password")
+			Expect(err).To(BeNil())
+			value, _ = userlib.DatastoreGet(userUUID)
+			Expect(bytes.HasPrefix(value, envelopeMagic)).To(BeTrue())
+			Expect(value[2]).To(Equal(byte(envelopeVersion)))
+			data, err := aliceLaptop.LoadFile("file")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+			data, err = bob.LoadFile("file")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+			for key, old := range legacy {
+				value, _ := userlib.DatastoreGet(key)
+				Expect(bytes.HasPrefix(value, envelopeMagic)).To(BeTrue())
+				Expect(value[2]).To(Equal(byte(envelopeVersion)))
+				Expect(value).ToNot(Equal(old))
+			}
+
+			// writes go on from the rewritten records
+			Expect(aliceLaptop.AppendToFile("file", []byte("more"))).To(BeNil())
+			data, err = bob.LoadFile("file")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(append(content, []byte("more")...)))
+
+			// blocks and index nodes written before the binary encoding decode too
+			plaintext, err := json.Marshal(File{Contents: []byte("old block"), Compressed: false})
+			Expect(err).To(BeNil())
+			fileStruct, err := DecodeFile(plaintext)
+			Expect(err).To(BeNil())
+			Expect(fileStruct.Contents).To(Equal([]byte("old block")))
+			Expect(DecodeFile(EncodeFile(fileStruct))).To(Equal(fileStruct))
+
+			// a damaged envelope is rejected
+			envelope := PackEnvelope(RecordBlock, []byte("msg"), []byte("tag"), nil)
+			_, _, _, _, _, err = UnpackEnvelope(envelope[:len(envelope)-1])
+			Expect(err).ToNot(BeNil())
+			_, _, _, _, _, err = UnpackEnvelope(append(envelope, 0))
+			Expect(err).ToNot(BeNil())
+
+			// a current record passed off as a legacy one no longer matches its tag
+			value, _ = userlib.DatastoreGet(accessUUID)
+			value[2] = legacyEnvelopeVersion
+			userlib.DatastoreSet(accessUUID, value)
+			_, err = aliceLaptop.LoadFile("file")
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("ListAccess Test: a sharee cannot rewrite the grant in their own node", func() {
+			alice, err := InitUser("alice", "password")
+			Expect(err).To(BeNil())
+			bob, err := InitUser("bob", "password")
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile("file", []byte("original"))).To(BeNil())
+			invite, err := alice.CreateInvitationWithPermission("file", "bob", PermissionRead)
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, "file")).To(BeNil())
+			entries, err := alice.ListAccess("file")
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+
+			// bob holds the keys of his node, so the mac still checks out, but alice's signature does not
+			_, accessStruct, _, _, err := LoadAccess(bob, "file")
+			Expect(err).To(BeNil())
+			invitation, invitationEncryptKey, invitationHMACKey, err := LoadInvitation(bob.datastore, accessStruct.InvitationUUID, accessStruct.InvitationSourcekey)
+			Expect(err).To(BeNil())
+			invitation.Grant.Permission = PermissionReadWrite
+			Expect(EncryptMacAndStore(bob.datastore, accessStruct.InvitationUUID, RecordInvitation, invitation, invitationEncryptKey, invitationHMACKey)).To(BeNil())
+			_, err = alice.ListAccess("file")
+			Expect(err).ToNot(BeNil())
+
+			// nor can he sign it himself
+			Expect(SignGrant(bob, accessStruct.InvitationUUID, &invitation)).To(BeNil())
+			Expect(EncryptMacAndStore(bob.datastore, accessStruct.InvitationUUID, RecordInvitation, invitation, invitationEncryptKey, invitationHMACKey)).To(BeNil())
+			_, err = alice.ListAccess("file")
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("ListAccess Test: a node removed from the share tree is reported, not skipped", func() {
+			alice, err := InitUser("alice", "password")
+			Expect(err).To(BeNil())
+			bob, err := InitUser("bob", "password")
+			Expect(err).To(BeNil())
+			charles, err := InitUser("charles", "password")
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile("file", []byte("original"))).To(BeNil())
+			invite, err := alice.CreateInvitation("file", "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, "file")).To(BeNil())
+			invite, err = bob.CreateInvitation("file", "charles")
+			Expect(err).To(BeNil())
+			Expect(charles.AcceptInvitation("bob", invite, "file")).To(BeNil())
+			entries, err := alice.ListAccess("file")
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(2))
+
+			// removing bob's node would hide him and charles below him
+			_, accessStruct, _, _, err := LoadAccess(bob, "file")
+			Expect(err).To(BeNil())
+			userlib.DatastoreDelete(accessStruct.InvitationUUID)
+			_, err = alice.ListAccess("file")
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("ListAccess Test: the accepted flag of a node cannot be flipped", func() {
+			alice, err := InitUser("alice", "password")
+			Expect(err).To(BeNil())
+			bob, err := InitUser("bob", "password")
+			Expect(err).To(BeNil())
+			charles, err := InitUser("charles", "password")
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile("file", []byte("original"))).To(BeNil())
+			invite, err := alice.CreateInvitation("file", "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, "file")).To(BeNil())
+			_, err = bob.CreateInvitation("file", "charles")
+			Expect(err).To(BeNil())
+			entries, err := alice.ListAccess("file")
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+
+			// bob holds the keys of the node he made for charles, but cannot claim charles accepted it
+			_, accessStruct, _, _, err := LoadAccess(bob, "file")
+			Expect(err).To(BeNil())
+			own, _, _, err := LoadInvitation(bob.datastore, accessStruct.InvitationUUID, accessStruct.InvitationSourcekey)
+			Expect(err).To(BeNil())
+			Expect(own.Children).To(HaveLen(1))
+			for childUUID, childSourceKey := range own.Children {
+				child, childEncryptKey, childHMACKey, err := LoadInvitation(bob.datastore, childUUID, childSourceKey)
+				Expect(err).To(BeNil())
+				child.Accepted = true
+				Expect(EncryptMacAndStore(bob.datastore, childUUID, RecordInvitation, child, childEncryptKey, childHMACKey)).To(BeNil())
+				_, err = alice.ListAccess("file")
+				Expect(err).ToNot(BeNil())
+
+				// nor sign it himself
+				child.AcceptSig, err = SignAcceptance(bob, childUUID, child)
+				Expect(err).To(BeNil())
+				Expect(EncryptMacAndStore(bob.datastore, childUUID, RecordInvitation, child, childEncryptKey, childHMACKey)).To(BeNil())
+				_, err = alice.ListAccess("file")
+				Expect(err).ToNot(BeNil())
+
+				// charles' own acceptance is what lists him
+				child.AcceptSig, err = SignAcceptance(charles, childUUID, child)
+				Expect(err).To(BeNil())
+				Expect(EncryptMacAndStore(bob.datastore, childUUID, RecordInvitation, child, childEncryptKey, childHMACKey)).To(BeNil())
+				entries, err = alice.ListAccess("file")
+				Expect(err).To(BeNil())
+				Expect(entries).To(HaveLen(2))
+			}
+
+			// clearing the flag of a node that was accepted is caught too
+			own.Accepted = false
+			_, ownEncryptKey, ownHMACKey, err := LoadInvitation(bob.datastore, accessStruct.InvitationUUID, accessStruct.InvitationSourcekey)
+			Expect(err).To(BeNil())
+			Expect(EncryptMacAndStore(bob.datastore, accessStruct.InvitationUUID, RecordInvitation, own, ownEncryptKey, ownHMACKey)).To(BeNil())
+			_, err = alice.ListAccess("file")
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Transfer Test: an old owner keeps no keys to the share tree once revoked", func() {
+			alice, err := InitUser("alice", "password")
+			Expect(err).To(BeNil())
+			bob, err := InitUser("bob", "password")
+			Expect(err).To(BeNil())
+			charles, err := InitUser("charles", "password")
+			Expect(err).To(BeNil())
+			doris, err := InitUser("doris", "password")
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile("file", []byte("original"))).To(BeNil())
+			for _, recipient := range []*User{bob, charles} {
+				invite, err := alice.CreateInvitation("file", recipient.Username)
+				Expect(err).To(BeNil())
+				Expect(recipient.AcceptInvitation("alice", invite, "file")).To(BeNil())
+			}
+
+			// alice remembers every node of the share tree while she still owns the file
+			_, accessStruct, _, _, err := LoadAccess(alice, "file")
+			Expect(err).To(BeNil())
+			invitationListStruct, _, _, err := LoadInvitationList(alice.datastore, accessStruct)
+			Expect(err).To(BeNil())
+			shareTree, err := GetShareTree(alice.datastore, invitationListStruct)
+			Expect(err).To(BeNil())
+			Expect(shareTree).To(HaveLen(2))
+			transfer, err := alice.TransferOwnership("file", "doris")
+			Expect(err).To(BeNil())
+			Expect(doris.AcceptOwnership("alice", transfer, "file")).To(BeNil())
+			Expect(doris.RevokeAccess("file", "alice")).To(BeNil())
+
+			// none of the nodes opens under the keys she kept
+			for _, node := range shareTree {
+				_, _, _, err = LoadInvitation(alice.datastore, node.InvitationUUID, node.Sourcekey)
+				Expect(err).ToNot(BeNil())
+			}
+
+			// nor can she point bob at a node of her own, only the owner's forwards are followed
+			for _, node := range shareTree {
+				if node.Invitation.Recipient != "bob" {
+					continue
+				}
+				forgedSourceKey := userlib.RandomBytes(16)
+				Expect(StoreInvitation(alice.datastore, node.InvitationUUID, forgedSourceKey, node.Invitation)).To(BeNil())
+				forwardUUID, err := GetForwardUUID(node.InvitationUUID, node.Sourcekey)
+				Expect(err).To(BeNil())
+				forged, err := SealForward(alice, forwardUUID, "bob", forgedSourceKey, nil)
+				Expect(err).To(BeNil())
+				Expect(alice.datastore.Set(forwardUUID, forged)).To(BeNil())
+				_, err = bob.LoadFile("file")
+				Expect(err).ToNot(BeNil())
+			}
+
+			// charles follows the owner's forward
+			data, err := charles.LoadFile("file")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte("original")))
+		})
+
+		Specify("Transfer Test: an accept that loses to a revoke leaves no claim behind", func() {
+			alice, err := InitUser("alice", "password")
+			Expect(err).To(BeNil())
+			bob, err := InitUser("bob", "password")
+			Expect(err).To(BeNil())
+			charles, err := InitUser("charles", "password")
+			Expect(err).To(BeNil())
+			doris, err := InitUser("doris", "password")
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile("file", []byte("original"))).To(BeNil())
+			for _, recipient := range []*User{bob, charles, doris} {
+				invite, err := alice.CreateInvitation("file", recipient.Username)
+				Expect(err).To(BeNil())
+				Expect(recipient.AcceptInvitation("alice", invite, "file")).To(BeNil())
+			}
+			_, accessStruct, _, _, err := LoadAccess(alice, "file")
+			Expect(err).To(BeNil())
+			claimKey := GetOwnerKeystoreKey(accessStruct.MetaUUID, 1)
+			transfer, err := alice.TransferOwnership("file", "bob")
+			Expect(err).To(BeNil())
+
+			// bob's accept runs while alice revokes charles, which moves the invitation list
+			tx := NewTransaction(bob.datastore)
+			attempt := *bob
+			attempt.datastore = tx
+			attempt.session = bob.session.Fork()
+			_, _, err = attempt.acceptOwnership("alice", transfer, "file")
+			Expect(err).To(BeNil())
+			Expect(alice.RevokeAccess("file", "charles")).To(BeNil())
+			Expect(tx.Commit()).To(Equal(ErrConflict))
+			_, ok := userlib.KeystoreGet(claimKey)
+			Expect(ok).To(BeFalse())
+
+			// started over, the offer no longer opens the list and nothing is claimed
+			Expect(bob.AcceptOwnership("alice", transfer, "file")).ToNot(BeNil())
+			_, ok = userlib.KeystoreGet(claimKey)
+			Expect(ok).To(BeFalse())
+
+			// a claim left behind by such an accept does not cut the sharees off the owner's forwards
+			Expect(ClaimOwnership(bob, accessStruct.MetaUUID, 1)).To(BeNil())
+			Expect(alice.StoreFile("file", []byte("updated"))).To(BeNil())
+			Expect(alice.RevokeAccess("file", "doris")).To(BeNil())
+			data, err := bob.LoadFile("file")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte("updated")))
+			_, err = doris.LoadFile("file")
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Lock Test: a writer cannot pass a lease off as another user's", func() {
+			alice, err := InitUser("alice", "password")
+			Expect(err).To(BeNil())
+			bob, err := InitUser("bob", "password")
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile("file", []byte("original"))).To(BeNil())
+			invite, err := alice.CreateInvitation("file", "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, "file")).To(BeNil())
+			_, accessStruct, _, _, err := LoadAccess(bob, "file")
+			Expect(err).To(BeNil())
+			metaUUID, _, _, metaHMACKey, grant, err := LoadMeta(bob, accessStruct)
+			Expect(err).To(BeNil())
+			Expect(CanWrite(grant)).To(BeTrue())
+
+			// bob holds the file sign key, but a lease naming alice has to carry her signature
+			forged := Lease{Holder: "alice", Expires: SessionTime(bob).Add(time.Hour), Sequence: 1}
+			leaseUUID, err := GetLeaseUUID(metaUUID)
+			Expect(err).To(BeNil())
+			signed, err := LeaseSigned(leaseUUID, forged)
+			Expect(err).To(BeNil())
+			forged.HolderSig, err = userlib.DSSign(bob.Sigkey, signed)
+			Expect(err).To(BeNil())
+			Expect(StoreLease(bob, metaUUID, forged, metaHMACKey, grant)).To(BeNil())
+			_, _, err = alice.GetLock("file")
+			Expect(err).ToNot(BeNil())
+			Expect(alice.LockFile("file", time.Minute)).ToNot(BeNil())
+
+			// nor can he reuse a lease alice signed for another file
+			Expect(alice.StoreFile("other", []byte("other"))).To(BeNil())
+			Expect(alice.LockFile("other", time.Minute)).To(BeNil())
+			_, otherAccess, _, _, err := LoadAccess(alice, "other")
+			Expect(err).To(BeNil())
+			otherMetaUUID, _, _, otherMetaHMACKey, otherGrant, err := LoadMeta(alice, otherAccess)
+			Expect(err).To(BeNil())
+			lease, exists, err := LoadLease(alice, otherMetaUUID, otherMetaHMACKey, otherGrant)
+			Expect(err).To(BeNil())
+			Expect(exists).To(BeTrue())
+			Expect(StoreLease(bob, metaUUID, lease, metaHMACKey, grant)).To(BeNil())
+			_, _, err = alice.GetLock("file")
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Permission Test: a reader holding the file keys cannot forge blocks or meta", func() {
+			alice, err := InitUser("alice", "password")
+			Expect(err).To(BeNil())
+			bob, err := InitUser("bob", "password")
+			Expect(err).To(BeNil())
+			for _, filename := range []string{"block", "meta"} {
+				Expect(alice.StoreFile(filename, []byte("original"))).To(BeNil())
+				invite, err := alice.CreateInvitationWithPermission(filename, "bob", PermissionRead)
+				Expect(err).To(BeNil())
+				Expect(bob.AcceptInvitation("alice", invite, filename)).To(BeNil())
+			}
+
+			// bob can decrypt and mac everything a writer can, only the sign key is missing
+			_, accessStruct, _, _, err := LoadAccess(bob, "block")
+			Expect(err).To(BeNil())
+			_, metaStruct, _, _, grant, err := LoadMeta(bob, accessStruct)
+			Expect(err).To(BeNil())
+			Expect(CanWrite(grant)).To(BeFalse())
+
+			// a block with a valid mac no longer matches the hash in the index
+			fileEncryptKey, fileHMACKey, err := GetTwoHASHKDFKeys(metaStruct.FileSourcekey, ENCRYPT, MAC)
+			Expect(err).To(BeNil())
+			root, err := LoadIndexNode(bob.datastore, IndexEntry{UUID: metaStruct.Root, Hash: metaStruct.RootHash}, fileEncryptKey, fileHMACKey)
+			Expect(err).To(BeNil())
+			forged, _, err := SealFileRecord(RecordBlock, root.Entries[0].UUID, EncodeFile(File{Contents: []byte("forged!!")}), fileEncryptKey, fileHMACKey)
+			Expect(err).To(BeNil())
+			Expect(bob.datastore.Set(root.Entries[0].UUID, forged)).To(BeNil())
+			_, err = alice.LoadFile("block")
+			Expect(err).ToNot(BeNil())
+
+			// nor does a meta with a valid mac but no signature
+			_, accessStruct, _, _, err = LoadAccess(bob, "meta")
+			Expect(err).To(BeNil())
+			metaUUID, metaStruct, metaEncryptKey, metaHMACKey, _, err := LoadMeta(bob, accessStruct)
+			Expect(err).To(BeNil())
+			metaStruct.FileTree, err = WriteFileTree(bob, []byte("forged!!"), false)
+			Expect(err).To(BeNil())
+			Expect(EncryptMacAndStore(bob.datastore, metaUUID, RecordMeta, metaStruct, metaEncryptKey, metaHMACKey)).To(BeNil())
+			_, err = alice.LoadFile("meta")
+			Expect(err).ToNot(BeNil())
+		})
+	})
+})
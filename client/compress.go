@@ -0,0 +1,61 @@
+package client
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// Files can opt in to compression with SetCompression. Every block is DEFLATE compressed on its
+// own before it is encrypted, and the File record says whether it was, so a tree can mix
+// compressed and plain blocks and deduplicated chunks can be shared between files either way.
+//
+// Compression makes the length of the ciphertext depend on the content. When a block mixes
+// data an attacker chooses with data they want to learn, they can watch the stored length
+// shrink as their guesses match (as in CRIME and BREACH). Blocks are compressed without a
+// shared dictionary and padded to a multiple of compressionPadding bytes, which blurs the
+// leak but does not remove it, so compression is off unless the file asks for it.
+
+const compressionPadding = 1024
+
+// returns the File record for block, compressed and padded unless that does not make it smaller
+func CompressBlock(block []byte) (fileStruct File, err error) {
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.BestCompression)
+	if err != nil {
+		return File{}, err
+	}
+	_, err = writer.Write(block)
+	if err != nil {
+		return File{}, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return File{}, err
+	}
+
+	// the compressed stream ends itself, so the padding after it is never read back
+	padded := (buffer.Len() + compressionPadding - 1) / compressionPadding * compressionPadding
+	if padded >= len(block) {
+		return File{Contents: block}, nil
+	}
+	buffer.Write(make([]byte, padded-buffer.Len()))
+	return File{Contents: buffer.Bytes(), Compressed: true}, nil
+}
+
+// returns the content of a File record, decompressing it if needed
+func DecompressBlock(fileStruct File) (contents []byte, err error) {
+	if !fileStruct.Compressed {
+		return fileStruct.Contents, nil
+	}
+	reader := flate.NewReader(bytes.NewReader(fileStruct.Contents))
+	defer reader.Close()
+
+	// no block is longer than BlockSize, so never inflate past it
+	contents, err = io.ReadAll(io.LimitReader(reader, BlockSize+1))
+	if err != nil || len(contents) > BlockSize {
+		return nil, errors.New("integrity check failed: File block could not be decompressed")
+	}
+	return contents, nil
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// Several sessions, of the same user or of the users a file is shared with, can change a file
+// at the same time. Operations that read records and write them back run optimistically: each
+// attempt reads and writes through a Transaction, which keeps the writes to itself and remembers
+// the write sequence of the datastore when the attempt started. The writes are then committed
+// with one CompareAndSetBatch, which only goes through if nothing was written to the datastore
+// since. Only the sequence is read back, not the records the attempt read, so committing costs
+// the same however many blocks the attempt loaded; in exchange an attempt also starts over when
+// another session wrote records it never looked at. An attempt that lost the race is thrown away
+// and started over from a fresh read, so a commit never builds on records another session has
+// replaced, and concurrent appends never drop each other's blocks.
+//
+// Readers run the same way with nothing to commit. A read that fails while the datastore is no
+// longer at its sequence (it reached some of them before another session's commit and some after) is
+// started over rather than reported. Every operation that writes a meta, an access struct or
+// the share tree runs this way. Only records nothing else refers to yet are written straight
+// through, such as the blocks a stream writer stores before Close indexes them, and the blocks
+// SecureDeleteBlocks overwrites once nothing refers to them any more.
+
+const conflictAttempts = 100                   // attempts before ErrConflict is returned
+const conflictBackoff = 100 * time.Microsecond // longest wait before the second attempt, doubling up to 64 times that
+
+// Transaction is the Datastore one attempt at an operation reads and writes through.
+// It is used by a single attempt and is not safe for concurrent use.
+type Transaction struct {
+	datastore Datastore
+	sequence  uint64                  // write sequence of the datastore when the attempt started
+	written   uint64                  // writes the attempt made, which its own sequence counts on top
+	writes    map[userlib.UUID][]byte // last value written to every key, nil for keys that were deleted
+}
+
+func NewTransaction(datastore Datastore) *Transaction {
+	return &Transaction{
+		datastore: datastore,
+		sequence:  datastore.Sequence(),
+		writes:    make(map[userlib.UUID][]byte),
+	}
+}
+
+func (tx *Transaction) Get(key userlib.UUID) (value []byte, ok bool) {
+	if value, written := tx.writes[key]; written {
+		return value, value != nil
+	}
+	return tx.datastore.Get(key)
+}
+
+func (tx *Transaction) Set(key userlib.UUID, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	tx.writes[key] = value
+	tx.written++
+	return nil
+}
+
+func (tx *Transaction) Delete(key userlib.UUID) error {
+	tx.writes[key] = nil
+	tx.written++
+	return nil
+}
+
+func (tx *Transaction) GetBatch(keys []userlib.UUID) (values map[userlib.UUID][]byte) {
+	values = make(map[userlib.UUID][]byte)
+	var unwritten []userlib.UUID
+	for _, key := range keys {
+		value, written := tx.writes[key]
+		if !written {
+			unwritten = append(unwritten, key)
+		} else if value != nil {
+			values[key] = value
+		}
+	}
+	stored := tx.datastore.GetBatch(unwritten)
+	for key, value := range stored {
+		values[key] = value
+	}
+	return values
+}
+
+func (tx *Transaction) SetBatch(entries map[userlib.UUID][]byte) error {
+	for key, value := range entries {
+		tx.Set(key, value)
+	}
+	return nil
+}
+
+func (tx *Transaction) DeleteBatch(keys []userlib.UUID) error {
+	for _, key := range keys {
+		tx.Delete(key)
+	}
+	return nil
+}
+
+// the sequence of what the attempt sees, which its own writes move on
+func (tx *Transaction) Sequence() (sequence uint64) {
+	return tx.sequence + tx.written
+}
+
+// compares against what the attempt sees, and adds entries to its writes
+func (tx *Transaction) CompareAndSetBatch(sequence uint64, entries map[userlib.UUID][]byte) (swapped bool, err error) {
+	if tx.Sequence() != sequence {
+		return false, nil
+	}
+	if len(entries) == 0 {
+		return true, nil
+	}
+	for key, value := range entries {
+		tx.writes[key] = value
+	}
+	tx.written++
+	return true, nil
+}
+
+// writes everything the attempt wrote in one step, returning ErrConflict if another session
+// wrote to the datastore in the meantime
+func (tx *Transaction) Commit() (err error) {
+	if len(tx.writes) == 0 {
+		return nil
+	}
+	swapped, err := tx.datastore.CompareAndSetBatch(tx.sequence, tx.writes)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return ErrConflict
+	}
+	return nil
+}
+
+// reports whether nothing was written to the datastore since the attempt started
+func (tx *Transaction) Current() bool {
+	return tx.datastore.Sequence() == tx.sequence
+}
+
+// runs op against a Transaction over the user's datastore and commits what it wrote, starting
+// over while another session changes the records op read before the commit. op is handed a
+// copy of the user that reads and writes through the transaction, and what it sees is only
+// remembered by the session once it committed.
+func RetryOnConflict(userdata *User, op func(attempt *User) error) (err error) {
+	for tries := 0; tries < conflictAttempts; tries++ {
+		if tries > 0 {
+			wait := conflictBackoff << minInt(tries-1, 6)
+			time.Sleep(time.Duration(rand.Int63n(int64(wait))))
+		}
+		tx := NewTransaction(userdata.datastore)
+		attempt := *userdata
+		attempt.datastore = tx
+		attempt.session = userdata.session.Fork()
+
+		err = op(&attempt)
+		if err == nil {
+			err = tx.Commit()
+		} else if !tx.Current() {
+			// the failure may come from reading records halfway through another commit
+			err = ErrConflict
+		}
+		if err == ErrConflict {
+			continue
+		}
+		if err == nil {
+			userdata.session.Merge(attempt.session)
+			userdata.InboxSequence = attempt.InboxSequence
+		}
+		return err
+	}
+	return ErrConflict
+}
@@ -0,0 +1,256 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// An owner can have the versions they store of a file deduplicated against their other files.
+// The content is cut into chunks at boundaries picked by a rolling hash, so an edit only changes
+// the chunks around it, and every chunk is sealed once at a UUID and under a key both derived
+// from the chunk and the chunk key in the owner's chunk table. Storing a chunk again, in any of
+// the owner's files, only counts one more reference to it in the chunk table.
+//
+// The boundaries, UUIDs and keys are all keyed by the chunk key, so neither the datastore nor
+// other users can tell whether two users store the same content. Sharees do learn the UUIDs and
+// keys of the chunks in files shared with them, so revoking someone from a deduplicated file
+// replaces the chunk key before the file is chunked again under its new keys. The chunks the file
+// had are left to the owner's other files that still use them, and chunks stored from then on
+// are no longer deduplicated against the chunks stored under an earlier chunk key.
+//
+// Only the owner reaches the chunk table. Other writers never create chunks, and the chunks of
+// anything they drop are queued in the meta until the owner next writes the file.
+
+const chunkMinSize = 16 * 1024 // no boundary is looked for before this many bytes
+const chunkMaskBits = 15       // a boundary then follows on average every 32 KB, BlockSize at most
+
+// ChunkTable is the owner's count of the references to each of their chunks.
+type ChunkTable struct {
+	Key    []byte // used to generate the boundaries, UUIDs and keys of chunks, replaced on revoke
+	Chunks map[userlib.UUID]ChunkRef
+}
+
+type ChunkRef struct {
+	Refs int
+	Hash []byte // hash of the ciphertext of the chunk, for the index entries of later references
+}
+
+func LoadChunkTable(userdata *User) (chunkTableStruct ChunkTable, chunkTableEncryptKey, chunkTableHMACKey []byte, err error) {
+	// Get chunk table keys
+	chunkTableEncryptKey, chunkTableHMACKey, err = GetTwoHASHKDFKeys(userdata.ChunkKey, ENCRYPT, MAC)
+	if err != nil {
+		return ChunkTable{}, nil, nil, err
+	}
+
+	// Get value, unpack, check tag, and decrypt
+	chunkTableValue, ok := userdata.datastore.Get(userdata.ChunkTable)
+	if !ok {
+		return ChunkTable{}, nil, nil, errors.New("failed to get chunk table from Datastore")
+	}
+	chunkTableMsg, _, err := OpenRecord(userdata.datastore, userdata.ChunkTable, chunkTableValue, RecordChunkTable, chunkTableHMACKey)
+	if err != nil {
+		return ChunkTable{}, nil, nil, errors.New("integrity check failed: chunk table has been tampered with")
+	}
+	err = json.Unmarshal(userlib.SymDec(chunkTableEncryptKey, chunkTableMsg), &chunkTableStruct)
+	if err != nil {
+		return ChunkTable{}, nil, nil, errors.New("failed to decrypt chunk table")
+	}
+	if len(chunkTableStruct.Key) != LENGTH {
+		return ChunkTable{}, nil, nil, errors.New("integrity check failed: chunk table has no chunk key")
+	}
+	if chunkTableStruct.Chunks == nil {
+		chunkTableStruct.Chunks = make(map[userlib.UUID]ChunkRef)
+	}
+	return
+}
+
+// replaces the chunk key, so chunks stored from now on get boundaries, UUIDs and keys nobody
+// learned from an earlier chunk
+func RotateChunkKey(userdata *User) (err error) {
+	chunkTableStruct, chunkTableEncryptKey, chunkTableHMACKey, err := LoadChunkTable(userdata)
+	if err != nil {
+		return err
+	}
+	chunkTableStruct.Key, err = GetRandomKey(userdata)
+	if err != nil {
+		return errors.New("failed to get chunk key")
+	}
+	return EncryptMacAndStore(userdata.datastore, userdata.ChunkTable, RecordChunkTable, chunkTableStruct, chunkTableEncryptKey, chunkTableHMACKey)
+}
+
+// cuts content into chunks where the rolling hash keyed by tableKey has chunkMaskBits zero bits
+func SplitChunks(tableKey []byte, content []byte) (chunks [][]byte, err error) {
+	// Derive the table of the rolling hash from the chunk key
+	var gear [256]uint64
+	for i := 0; i < len(gear); i += 8 {
+		random, err := userlib.HashKDF(tableKey, []byte("chunk boundary "+strconv.Itoa(i)))
+		if err != nil {
+			return nil, errors.New("failed to derive chunk boundary table")
+		}
+		for j := 0; j < 8; j++ {
+			gear[i+j] = binary.BigEndian.Uint64(random[8*j:])
+		}
+	}
+
+	mask := uint64(1)<<chunkMaskBits - 1
+	for len(content) > 0 {
+		end := minInt(len(content), BlockSize)
+		var hash uint64
+		for i := chunkMinSize; i < end; i++ {
+			hash = hash<<1 + gear[content[i]]
+			if hash&mask == 0 {
+				end = i + 1
+				break
+			}
+		}
+		chunks = append(chunks, content[:end])
+		content = content[end:]
+	}
+	return chunks, nil
+}
+
+// returns the UUID and source key of a chunk under the chunk key tableKey
+func ChunkIdentity(tableKey []byte, chunk []byte) (chunkUUID userlib.UUID, chunkKey []byte, err error) {
+	uuidKey, err := userlib.HashKDF(tableKey, []byte("chunk uuid"))
+	if err != nil {
+		return uuid.Nil, nil, errors.New("failed to derive chunk uuid key")
+	}
+	keyKey, err := userlib.HashKDF(tableKey, []byte("chunk key"))
+	if err != nil {
+		return uuid.Nil, nil, errors.New("failed to derive chunk key")
+	}
+	chunkHMAC, err := userlib.HMACEval(uuidKey[:LENGTH], chunk)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	chunkUUID, err = uuid.FromBytes(chunkHMAC[:LENGTH])
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	chunkKey, err = userlib.HMACEval(keyKey[:LENGTH], chunk)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	return chunkUUID, chunkKey[:chunkKeySize], nil
+}
+
+// writes content as a new tree whose blocks are chunks shared with the owner's other files.
+// Chunks already stored keep the compression they were first stored with.
+func WriteChunkedFileTree(userdata *User, content []byte, compressed bool) (tree FileTree, err error) {
+	chunkTableStruct, chunkTableEncryptKey, chunkTableHMACKey, err := LoadChunkTable(userdata)
+	if err != nil {
+		return FileTree{}, err
+	}
+	fileSourceKey, err := GetRandomKey(userdata)
+	if err != nil {
+		return FileTree{}, errors.New("failed to get file sourcekey")
+	}
+	chunks, err := SplitChunks(chunkTableStruct.Key, content)
+	if err != nil {
+		return FileTree{}, err
+	}
+
+	// Seal the chunks the owner does not have yet and count a reference to every chunk
+	records := make(map[userlib.UUID][]byte)
+	var entries []IndexEntry
+	for _, chunk := range chunks {
+		chunkUUID, chunkKey, err := ChunkIdentity(chunkTableStruct.Key, chunk)
+		if err != nil {
+			return FileTree{}, err
+		}
+		ref, ok := chunkTableStruct.Chunks[chunkUUID]
+		if !ok {
+			chunkEncryptKey, chunkHMACKey, err := GetTwoHASHKDFKeys(chunkKey, ENCRYPT, MAC)
+			if err != nil {
+				return FileTree{}, errors.New("failed to get keys for chunk")
+			}
+			records[chunkUUID], ref.Hash, err = SealBlock(chunkUUID, chunk, compressed, chunkEncryptKey, chunkHMACKey)
+			if err != nil {
+				return FileTree{}, err
+			}
+		}
+		ref.Refs++
+		chunkTableStruct.Chunks[chunkUUID] = ref
+		entries = append(entries, IndexEntry{UUID: chunkUUID, Length: len(chunk), Hash: ref.Hash, Key: chunkKey})
+	}
+
+	// Build the index over the chunks under the new file key
+	tree, err = BuildFileTree(records, fileSourceKey, compressed, entries)
+	if err != nil {
+		return FileTree{}, err
+	}
+
+	// The chunks are stored before the table counts them, so the table never counts a missing chunk
+	err = userdata.datastore.SetBatch(records)
+	if err != nil {
+		return FileTree{}, err
+	}
+	err = EncryptMacAndStore(userdata.datastore, userdata.ChunkTable, RecordChunkTable, chunkTableStruct, chunkTableEncryptKey, chunkTableHMACKey)
+	if err != nil {
+		return FileTree{}, err
+	}
+	return tree, nil
+}
+
+// writes content as a new tree, deduplicated against the owner's other files when chunked
+func WriteContentTree(userdata *User, content []byte, chunked, compressed bool) (tree FileTree, err error) {
+	if chunked {
+		return WriteChunkedFileTree(userdata, content, compressed)
+	}
+	return WriteFileTree(userdata, content, compressed)
+}
+
+// reports whether versions the user writes to the file are deduplicated, which only the owner can do
+func Deduplicates(accessStruct Access, metaStruct Meta) bool {
+	return accessStruct.IsOwner && metaStruct.Deduplicated
+}
+
+// is called before the meta is stored with the chunks the file no longer uses. The owner takes
+// them and every chunk queued by other writers, to release once the meta is stored. Other
+// writers cannot reach the owner's chunk table, so they queue theirs in the meta instead.
+func TakeReleasedChunks(accessStruct Access, metaStruct Meta, chunks []userlib.UUID) (updated Meta, release []userlib.UUID) {
+	if !accessStruct.IsOwner {
+		metaStruct.ReleasedChunks = append(metaStruct.ReleasedChunks, chunks...)
+		return metaStruct, nil
+	}
+	release = append(metaStruct.ReleasedChunks, chunks...)
+	metaStruct.ReleasedChunks = nil
+	return metaStruct, release
+}
+
+// drops one reference to each chunk and deletes the chunks nothing references anymore
+func ReleaseChunks(userdata *User, chunks []userlib.UUID) (err error) {
+	if len(chunks) == 0 {
+		return nil
+	}
+	chunkTableStruct, chunkTableEncryptKey, chunkTableHMACKey, err := LoadChunkTable(userdata)
+	if err != nil {
+		return err
+	}
+	var unused []userlib.UUID
+	for _, chunkUUID := range chunks {
+		ref, ok := chunkTableStruct.Chunks[chunkUUID]
+		if !ok {
+			continue
+		}
+		ref.Refs--
+		if ref.Refs > 0 {
+			chunkTableStruct.Chunks[chunkUUID] = ref
+			continue
+		}
+		delete(chunkTableStruct.Chunks, chunkUUID)
+		unused = append(unused, chunkUUID)
+	}
+
+	// The table is stored before the chunks are deleted, so it never counts a missing chunk
+	err = EncryptMacAndStore(userdata.datastore, userdata.ChunkTable, RecordChunkTable, chunkTableStruct, chunkTableEncryptKey, chunkTableHMACKey)
+	if err != nil {
+		return err
+	}
+	return userdata.datastore.DeleteBatch(unused)
+}
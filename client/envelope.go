@@ -0,0 +1,191 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// Every record is stored in a binary envelope:
+//
+//	[magic 2 bytes][version byte][record type byte]
+//	[msg length uint32][msg][tag length uint32][tag][sig length uint32][sig]
+//
+// where msg is the ciphertext, tag its MAC (or the sender's signature for invitation metas)
+// and sig the signature of a meta, empty for every other record.
+//
+// The tag of an envelope covers the record type and the UUID the record is stored at along
+// with the msg, so a record moved to another UUID, or read as another type of record sealed
+// under the same keys, fails its integrity check. Tags are computed under a key derived from
+// the record's MAC key, so no tag can also pass as the tag of an older record.
+//
+// Records written before version 2 (version 1 envelopes, and before them JSON maps of base64
+// fields, {"Msg","Tag"} plus "Sig" for metas) have a tag over the msg alone. They are still
+// read: OpenRecord checks the old tag, re-tags the record and rewrites it in place into a
+// current envelope before returning it. Until then they are not bound to their type or UUID.
+// Invitation metas are signed by their sender rather than MAC'd, and the signature covers the
+// record type and UUID the same way.
+
+// RecordType says what a record holds, it is kept in the envelope.
+type RecordType byte
+
+const (
+	RecordUser RecordType = iota + 1
+	RecordAccess
+	RecordMeta
+	RecordInvitation
+	RecordInvitationList
+	RecordInvitationMeta
+	RecordFileIndex
+	RecordChunkTable
+	RecordBlock
+	RecordIndexNode
+	RecordLease
+	RecordInboxEntry
+	RecordTransferOffer
+	RecordNodeForward
+	RecordInboxHead
+	RecordHandover
+)
+
+var envelopeMagic = []byte{0xf5, 0x5e}
+
+const envelopeVersion = 2
+const legacyEnvelopeVersion = 1 // tags cover the msg alone
+const envelopeHeaderSize = 4
+
+func PackEnvelope(recordType RecordType, msg, tag, sig []byte) (value []byte) {
+	value = make([]byte, 0, envelopeHeaderSize+12+len(msg)+len(tag)+len(sig))
+	value = append(value, envelopeMagic...)
+	value = append(value, envelopeVersion, byte(recordType))
+	for _, field := range [][]byte{msg, tag, sig} {
+		value = binary.BigEndian.AppendUint32(value, uint32(len(field)))
+		value = append(value, field...)
+	}
+	return value
+}
+
+// unpacks an envelope, legacy is set for JSON maps and envelopes written before version 2
+func UnpackEnvelope(value []byte) (recordType RecordType, msg, tag, sig []byte, legacy bool, err error) {
+	if !bytes.HasPrefix(value, envelopeMagic) {
+		unpackedData := make(map[string][]byte)
+		err = json.Unmarshal(value, &unpackedData)
+		if err != nil {
+			return 0, nil, nil, nil, false, errors.New("unmarshal failed")
+		}
+		return 0, unpackedData["Msg"], unpackedData["Tag"], unpackedData["Sig"], true, nil
+	}
+	if len(value) < envelopeHeaderSize || (value[2] != envelopeVersion && value[2] != legacyEnvelopeVersion) {
+		return 0, nil, nil, nil, false, errors.New("unknown envelope version")
+	}
+	recordType, legacy = RecordType(value[3]), value[2] == legacyEnvelopeVersion
+	value = value[envelopeHeaderSize:]
+	fields := make([][]byte, 3)
+	for i := range fields {
+		if len(value) < 4 {
+			return 0, nil, nil, nil, false, errors.New("envelope is truncated")
+		}
+		length := binary.BigEndian.Uint32(value)
+		value = value[4:]
+		if uint64(len(value)) < uint64(length) {
+			return 0, nil, nil, nil, false, errors.New("envelope is truncated")
+		}
+		fields[i], value = value[:length], value[length:]
+	}
+	if len(value) != 0 {
+		return 0, nil, nil, nil, false, errors.New("envelope has trailing bytes")
+	}
+	return recordType, fields[0], fields[1], fields[2], legacy, nil
+}
+
+// returns the associated data tags and invitation signatures cover along with the msg
+func RecordAD(recordType RecordType, UUID userlib.UUID) (ad []byte) {
+	ad = make([]byte, 0, 1+LENGTH)
+	ad = append(ad, byte(recordType))
+	return append(ad, UUID[:]...)
+}
+
+// returns the tag of a record of recordType stored at UUID
+func RecordTag(recordType RecordType, UUID userlib.UUID, msg, hmacKey []byte) (tag []byte, err error) {
+	tagKey, err := userlib.HashKDF(hmacKey, []byte("record tag"))
+	if err != nil {
+		return nil, errors.New("failed to derive record tag key")
+	}
+	return userlib.HMACEval(tagKey[:LENGTH], append(RecordAD(recordType, UUID), msg...))
+}
+
+// unpacks the value read at UUID and checks it is an untampered record of recordType, returning
+// its msg and signature. A legacy record is checked against its old tag and rewritten in place
+// into a current envelope before it is returned, so it is only ever read in the old format once.
+func OpenRecord(datastore Datastore, UUID userlib.UUID, value []byte, recordType RecordType, hmacKey []byte) (msg, sig []byte, err error) {
+	storedType, msg, tag, sig, legacy, err := UnpackEnvelope(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if legacy {
+		if storedType != 0 && storedType != recordType {
+			return nil, nil, errors.New("integrity check failed: record has the wrong type")
+		}
+		err = CheckTag(msg, tag, hmacKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		tag, err = RecordTag(recordType, UUID, msg, hmacKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = UpgradeRecord(datastore, UUID, value, PackEnvelope(recordType, msg, tag, sig))
+		if err != nil {
+			return nil, nil, err
+		}
+		return msg, sig, nil
+	}
+	if storedType != recordType {
+		return nil, nil, errors.New("integrity check failed: record has the wrong type")
+	}
+	expected, err := RecordTag(recordType, UUID, msg, hmacKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !userlib.HMACEqual(tag, expected) {
+		return nil, nil, errors.New("integrity check failed")
+	}
+	return msg, sig, nil
+}
+
+// replaces the legacy value read at UUID with upgraded, unless another session replaced it since
+func UpgradeRecord(datastore Datastore, UUID userlib.UUID, value, upgraded []byte) (err error) {
+	for {
+		sequence := datastore.Sequence()
+		current, ok := datastore.Get(UUID)
+		if !ok || !bytes.Equal(current, value) {
+			return nil
+		}
+		swapped, err := datastore.CompareAndSetBatch(sequence, map[userlib.UUID][]byte{UUID: upgraded})
+		if err != nil {
+			return err
+		}
+		if swapped {
+			return nil
+		}
+	}
+}
+
+// unpacks a signed record of recordType read at UUID, returning its msg, its signature and the
+// bytes the signature covers, which are the msg alone for legacy records
+func OpenSignedRecord(UUID userlib.UUID, value []byte, recordType RecordType) (msg, sig, signed []byte, err error) {
+	storedType, msg, sig, _, legacy, err := UnpackEnvelope(value)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if legacy {
+		return msg, sig, msg, nil
+	}
+	if storedType != recordType {
+		return nil, nil, nil, errors.New("integrity check failed: record has the wrong type")
+	}
+	return msg, sig, append(RecordAD(recordType, UUID), msg...), nil
+}
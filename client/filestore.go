@@ -0,0 +1,405 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// FileDatastore is a crash-safe Datastore persisted to a single append-only log file.
+//
+// Every Set, Delete or batch is written as one frame:
+//
+//	[payload length uint32][payload][crc32 of payload uint32]
+//
+// where the payload is a sequence of entries:
+//
+//	[op byte][UUID 16 bytes][value length uint32][value]
+//
+// A frame is fsynced before the call returns, so a write that returned nil survives a crash.
+// On open the log is replayed and a torn or corrupt final frame is truncated away,
+// which makes every frame (and therefore every batch) all-or-nothing. A crash can only tear
+// the frame that was being appended, so a corrupt frame with others after it is reported
+// rather than truncated along with every frame that follows.
+//
+// The log is locked while it is open, so a second process, or a second FileDatastore in the
+// same one, cannot append frames to it at the same time.
+type FileDatastore struct {
+	mu    sync.Mutex
+	file  *os.File
+	path  string
+	size  int64                        // offset where the next frame is appended
+	index map[userlib.UUID]valueExtent // live keys to their value in the log
+	dead  int64                        // bytes in the log that are no longer live
+	seq   uint64                       // write sequence, bumped by every frame appended
+}
+
+// ErrDatastoreInUse is returned by OpenFileDatastore for a log another FileDatastore has open.
+var ErrDatastoreInUse = errors.New("datastore is in use by another process")
+
+type valueExtent struct {
+	offset int64
+	length uint32
+}
+
+type logEntry struct {
+	op    byte
+	key   userlib.UUID
+	value []byte
+}
+
+const (
+	logOpSet    byte = 1
+	logOpDelete byte = 2
+
+	frameHeaderSize = 4
+	frameTrailSize  = 4
+	entryHeaderSize = 1 + LENGTH + 4
+)
+
+// OpenFileDatastore opens (or creates) the log at path and recovers its index.
+func OpenFileDatastore(path string) (store *FileDatastore, err error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = lockLog(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	store = &FileDatastore{
+		file:  file,
+		path:  path,
+		index: make(map[userlib.UUID]valueExtent),
+	}
+	err = store.recover()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// recover replays every intact frame and truncates a torn final frame, a corrupt frame before
+// the final one is returned as an error.
+func (store *FileDatastore) recover() (err error) {
+	info, err := store.file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+
+	var offset int64
+	for offset+frameHeaderSize+frameTrailSize <= fileSize {
+		header := make([]byte, frameHeaderSize)
+		_, err = store.file.ReadAt(header, offset)
+		if err != nil {
+			return err
+		}
+		payloadLength := int64(binary.BigEndian.Uint32(header))
+		frameEnd := offset + frameHeaderSize + payloadLength + frameTrailSize
+		if frameEnd > fileSize {
+			break
+		}
+
+		frame := make([]byte, payloadLength+frameTrailSize)
+		_, err = store.file.ReadAt(frame, offset+frameHeaderSize)
+		if err != nil {
+			return err
+		}
+		payload, checksum := frame[:payloadLength], frame[payloadLength:]
+		entries, ok := decodeLogPayload(payload)
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(checksum) || !ok {
+			if frameEnd == fileSize {
+				break
+			}
+			return fmt.Errorf("datastore log is corrupt at offset %d", offset)
+		}
+		store.apply(entries, offset+frameHeaderSize)
+		offset = frameEnd
+	}
+
+	// drop the torn tail so the next frame starts on a clean boundary
+	if offset != fileSize {
+		err = store.file.Truncate(offset)
+		if err != nil {
+			return err
+		}
+		err = store.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	store.size = offset
+	return nil
+}
+
+// apply updates the in-memory index for a frame whose payload starts at payloadOffset.
+func (store *FileDatastore) apply(entries []logEntry, payloadOffset int64) {
+	offset := payloadOffset
+	for _, entry := range entries {
+		old, exists := store.index[entry.key]
+		if exists {
+			store.dead += entryHeaderSize + int64(old.length)
+		}
+		switch entry.op {
+		case logOpSet:
+			store.index[entry.key] = valueExtent{offset + entryHeaderSize, uint32(len(entry.value))}
+		case logOpDelete:
+			delete(store.index, entry.key)
+			store.dead += entryHeaderSize
+		}
+		offset += entryHeaderSize + int64(len(entry.value))
+	}
+}
+
+// append writes the entries as a single frame and fsyncs it. Caller holds mu.
+func (store *FileDatastore) append(entries []logEntry) (err error) {
+	if store.file == nil {
+		return errors.New("datastore is closed")
+	}
+	payload := encodeLogPayload(entries)
+	frame := make([]byte, 0, frameHeaderSize+len(payload)+frameTrailSize)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(payload))
+
+	_, err = store.file.WriteAt(frame, store.size)
+	if err == nil {
+		err = store.file.Sync()
+	}
+	if err != nil {
+		// never leave a partial frame behind a successful one
+		store.file.Truncate(store.size)
+		return err
+	}
+	store.apply(entries, store.size+frameHeaderSize)
+	store.size += int64(len(frame))
+	store.seq++
+	return nil
+}
+
+func (store *FileDatastore) Get(key userlib.UUID) (value []byte, ok bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.get(key)
+}
+
+func (store *FileDatastore) get(key userlib.UUID) (value []byte, ok bool) {
+	extent, ok := store.index[key]
+	if !ok || store.file == nil {
+		return nil, false
+	}
+	value = make([]byte, extent.length)
+	_, err := store.file.ReadAt(value, extent.offset)
+	if err != nil && !(err == io.EOF && extent.length == 0) {
+		return nil, false
+	}
+	return value, true
+}
+
+func (store *FileDatastore) Set(key userlib.UUID, value []byte) error {
+	return store.SetBatch(map[userlib.UUID][]byte{key: value})
+}
+
+func (store *FileDatastore) Delete(key userlib.UUID) error {
+	return store.DeleteBatch([]userlib.UUID{key})
+}
+
+func (store *FileDatastore) GetBatch(keys []userlib.UUID) (values map[userlib.UUID][]byte) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	values = make(map[userlib.UUID][]byte)
+	for _, key := range keys {
+		value, ok := store.get(key)
+		if ok {
+			values[key] = value
+		}
+	}
+	return
+}
+
+func (store *FileDatastore) SetBatch(entries map[userlib.UUID][]byte) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	logEntries := make([]logEntry, 0, len(entries))
+	for key, value := range entries {
+		logEntries = append(logEntries, logEntry{logOpSet, key, value})
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.append(logEntries)
+}
+
+func (store *FileDatastore) DeleteBatch(keys []userlib.UUID) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var logEntries []logEntry
+	for _, key := range keys {
+		if _, ok := store.index[key]; ok {
+			logEntries = append(logEntries, logEntry{logOpDelete, key, nil})
+		}
+	}
+	if len(logEntries) == 0 {
+		return nil
+	}
+	return store.append(logEntries)
+}
+
+func (store *FileDatastore) Sequence() (sequence uint64) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.seq
+}
+
+func (store *FileDatastore) CompareAndSetBatch(sequence uint64, entries map[userlib.UUID][]byte) (swapped bool, err error) {
+	logEntries := make([]logEntry, 0, len(entries))
+	for key, value := range entries {
+		if value == nil {
+			logEntries = append(logEntries, logEntry{logOpDelete, key, nil})
+		} else {
+			logEntries = append(logEntries, logEntry{logOpSet, key, value})
+		}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.seq != sequence {
+		return false, nil
+	}
+	if len(logEntries) == 0 {
+		return true, nil
+	}
+	return true, store.append(logEntries)
+}
+
+// Compact rewrites the log with only the live entries once at least half of it is dead.
+// The new log is fsynced and renamed over the old one, so a crash leaves one of the two intact.
+func (store *FileDatastore) Compact() (err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.file == nil {
+		return errors.New("datastore is closed")
+	}
+	if store.dead*2 < store.size {
+		return nil
+	}
+	return store.rewrite()
+}
+
+// Purge rewrites the log as soon as any of it is dead, so deleted and overwritten values no
+// longer sit in the file. SecureDeleteBlocks calls it once the blocks are gone.
+func (store *FileDatastore) Purge() (err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.file == nil {
+		return errors.New("datastore is closed")
+	}
+	if store.dead == 0 {
+		return nil
+	}
+	return store.rewrite()
+}
+
+// rewrite replaces the log with one holding only the live entries. Caller holds mu.
+func (store *FileDatastore) rewrite() (err error) {
+
+	entries := make([]logEntry, 0, len(store.index))
+	for key := range store.index {
+		value, ok := store.get(key)
+		if !ok {
+			return errors.New("failed to read live entry during compaction")
+		}
+		entries = append(entries, logEntry{logOpSet, key, value})
+	}
+
+	tmpPath := store.path + ".compact"
+	os.Remove(tmpPath)
+	tmp, err := OpenFileDatastore(tmpPath)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		err = tmp.append(entries)
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	err = os.Rename(tmpPath, store.path)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(store.path)
+
+	store.file.Close()
+	store.file, store.size, store.index, store.dead = tmp.file, tmp.size, tmp.index, 0
+	return nil
+}
+
+// Close flushes and releases the underlying log file.
+func (store *FileDatastore) Close() (err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.file == nil {
+		return nil
+	}
+	err = store.file.Sync()
+	closeErr := store.file.Close()
+	store.file = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func encodeLogPayload(entries []logEntry) (payload []byte) {
+	for _, entry := range entries {
+		payload = append(payload, entry.op)
+		payload = append(payload, entry.key[:]...)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(entry.value)))
+		payload = append(payload, entry.value...)
+	}
+	return
+}
+
+func decodeLogPayload(payload []byte) (entries []logEntry, ok bool) {
+	for len(payload) > 0 {
+		if len(payload) < entryHeaderSize {
+			return nil, false
+		}
+		var entry logEntry
+		entry.op = payload[0]
+		copy(entry.key[:], payload[1:1+LENGTH])
+		valueLength := int(binary.BigEndian.Uint32(payload[1+LENGTH : entryHeaderSize]))
+		payload = payload[entryHeaderSize:]
+		if len(payload) < valueLength || (entry.op != logOpSet && entry.op != logOpDelete) {
+			return nil, false
+		}
+		entry.value = payload[:valueLength]
+		payload = payload[valueLength:]
+		entries = append(entries, entry)
+	}
+	return entries, true
+}
+
+// syncDir fsyncs the directory holding path so a rename is durable.
+func syncDir(path string) {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package client
+
+import (
+	"os"
+)
+
+// the log is not locked where there are no advisory file locks, only one FileDatastore may have it open
+func lockLog(file *os.File) (err error) {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+// takes an exclusive lock on the open log. The system drops it when the file is closed or the
+// process exits, so the log of a process that crashed opens again.
+func lockLog(file *os.File) (err error) {
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrDatastoreInUse
+	}
+	return err
+}
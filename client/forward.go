@@ -0,0 +1,152 @@
+package client
+
+import (
+	"errors"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// RevokeAccess moves the file to new meta keys and hands them to every remaining node of the
+// share tree, but anyone who once held the sourcekey of a node could read them there. An owner
+// revoked after transferring the file held the sourcekey of every node. Revoking therefore also
+// gives every remaining node a fresh sourcekey, at the same UUID, and moves the invitation list to
+// a new UUID and key. Parents and the invitation list learn the new sourcekeys directly. The
+// recipient of a node only knows the old one, so the owner leaves them a forward: the new
+// sourcekey sealed for the recipient and signed by the owner, at a UUID derived from the node's
+// UUID and its old sourcekey. Recipients follow the forwards of their node, and then delete them,
+// the next time they load the file, or when they accept an invitation to the node.
+//
+// A forward always leads straight to the current sourcekey of its node: revoking again re-seals the
+// forwards that were not followed yet, and so does the new owner when a transfer is accepted, so
+// every forward is signed by the current owner.
+//
+// Whoever knew the old sourcekey can also find the forward and replace it, so it is only followed
+// when the current owner of the file signed it. The creator of the file is signed into the grant
+// of every node, and the forward carries the handovers of every ownership transfer since, which
+// VerifyOwner in transfer.go walks to the current owner.
+
+// NodeForward is left for the recipient of a node that got a new sourcekey.
+type NodeForward struct {
+	Sender        string
+	NodeSourcekey []byte
+	Handovers     []Handover // the handovers from the creator of the file to the sender
+}
+
+// returns the UUID of the forward left for the node at invitationUUID from invitationSourceKey
+func GetForwardUUID(invitationUUID userlib.UUID, invitationSourceKey []byte) (forwardUUID userlib.UUID, err error) {
+	forwardHash, err := userlib.HashKDF(invitationSourceKey, append([]byte("forward"), invitationUUID[:]...))
+	if err != nil {
+		return uuid.Nil, errors.New("failed to derive forward UUID")
+	}
+	forwardUUID, err = uuid.FromBytes(forwardHash[:LENGTH])
+	if err != nil {
+		return uuid.Nil, errors.New("failed to derive forward UUID")
+	}
+	return forwardUUID, nil
+}
+
+// seals the forward at forwardUUID to newSourceKey for recipientUsername
+func SealForward(userdata *User, forwardUUID userlib.UUID, recipientUsername string, newSourceKey []byte, handovers []Handover) (forwardValue []byte, err error) {
+	forward := NodeForward{Sender: userdata.Username, NodeSourcekey: newSourceKey, Handovers: handovers}
+	return SealForUser(userdata, recipientUsername, RecordNodeForward, forwardUUID, forward)
+}
+
+// re-seals the forwards, forward UUID to the node it leads to, that were not followed yet. Forwards to
+// the nodes in sourceKeys now lead to the sourcekey there, forwards to other nodes are left as they
+// are and lead to a tombstone. Returns the forwards still waiting and the values to store.
+func ResealForwards(userdata *User, forwards map[userlib.UUID]userlib.UUID, shareTree []ShareNode, sourceKeys map[userlib.UUID][]byte, handovers []Handover) (pending map[userlib.UUID]userlib.UUID, forwardValues map[userlib.UUID][]byte, err error) {
+	recipients := make(map[userlib.UUID]string)
+	for _, node := range shareTree {
+		recipients[node.InvitationUUID] = node.Invitation.Recipient
+	}
+	forwardUUIDs := make([]userlib.UUID, 0, len(forwards))
+	for forwardUUID := range forwards {
+		forwardUUIDs = append(forwardUUIDs, forwardUUID)
+	}
+	waiting := userdata.datastore.GetBatch(forwardUUIDs)
+
+	pending = make(map[userlib.UUID]userlib.UUID)
+	forwardValues = make(map[userlib.UUID][]byte)
+	for forwardUUID, invitationUUID := range forwards {
+		if _, ok := waiting[forwardUUID]; !ok {
+			continue
+		}
+		pending[forwardUUID] = invitationUUID
+		sourceKey, ok := sourceKeys[invitationUUID]
+		if !ok {
+			continue
+		}
+		forwardValues[forwardUUID], err = SealForward(userdata, forwardUUID, recipients[invitationUUID], sourceKey, handovers)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return pending, forwardValues, nil
+}
+
+// follows the forwards left for the node at invitationUUID from invitationSourceKey, and returns the
+// sourcekey the node is under now and the forwards followed, which the caller deletes once it stored
+// the new sourcekey. The node a forward leads to has to be the user's, and the last forward has to be
+// signed by the current owner of the file.
+func FollowForwards(userdata *User, invitationUUID userlib.UUID, invitationSourceKey []byte) (sourceKey []byte, followed []userlib.UUID, err error) {
+	// Follow the forwards until a sourcekey has none
+	sourceKey = invitationSourceKey
+	var last NodeForward
+	var signed, sig []byte
+	seen := make(map[userlib.UUID]bool)
+	for {
+		forwardUUID, err := GetForwardUUID(invitationUUID, sourceKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		forwardValue, ok := userdata.datastore.Get(forwardUUID)
+		if !ok {
+			break
+		}
+		if seen[forwardUUID] {
+			return nil, nil, errors.New("integrity check failed: forwards lead in a circle")
+		}
+		seen[forwardUUID] = true
+		last = NodeForward{}
+		signed, sig, err = OpenSealed(userdata, RecordNodeForward, forwardUUID, forwardValue, &last)
+		if err != nil {
+			return nil, nil, err
+		}
+		sourceKey = last.NodeSourcekey
+		followed = append(followed, forwardUUID)
+	}
+	if len(followed) == 0 {
+		return sourceKey, nil, nil
+	}
+
+	// The node has to open under the new sourcekey and be the user's, granted by its sharer
+	invitation, _, _, err := LoadInvitation(userdata.datastore, invitationUUID, sourceKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if invitation.Revoked {
+		return nil, nil, ErrAccessRevoked
+	}
+	if invitation.Recipient != userdata.Username {
+		return nil, nil, errors.New("integrity check failed: forward leads to someone else's invitation")
+	}
+	err = VerifyGrant(userdata.keystore, invitationUUID, invitation)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The last forward has to come from the current owner
+	owner, err := VerifyOwner(userdata.keystore, userdata.datastore, invitation.MetaUUID, invitation.Creator, last.Handovers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if last.Sender != owner {
+		return nil, nil, errors.New("integrity check failed: forward was not sent by the owner")
+	}
+	err = CheckSignature(userdata.keystore, signed, sig, owner)
+	if err != nil {
+		return nil, nil, errors.New("failed to verify forward signature")
+	}
+	return sourceKey, followed, nil
+}
@@ -0,0 +1,405 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Every user has an inbox CreateInvitation drops a note in, so the recipient can find the
+// invitation pointer without it being passed to them out of band. The inbox only ever grows:
+// a sender seals the entry for the recipient and appends it at the next slot, a UUID derived
+// from the recipient's username and the number of entries sent to them so far. The inbox head,
+// at a UUID derived from the recipient's username, holds that number in the clear for senders
+// to append after, along with what the recipient kept of the entries, sealed for themselves.
+// Only the recipient moves the slots into their part of the head and removes entries from it,
+// when they are accepted or can no longer be accepted, so nobody else learns who invited whom
+// or can drop entries the recipient has seen.
+//
+// The sender only has the recipient's public key, so an entry is sealed under a fresh
+// symmetric key that is encrypted to the recipient, and signed by the sender along with the
+// record type and UUID. The recipient's part of the head counts the slots moved into it, and
+// the user struct remembers the most the user has seen, so a head that was put back, cut short
+// or removed is noticed. That, a head that does not open, or a slot below the count that is
+// missing or does not verify, is reported as ErrInboxTampered. The recipient then starts over
+// from the slots after the ones they have seen, so it is only reported once. Someone can still overwrite a
+// slot the recipient did not read yet, which is no worse than never sending them the entry.
+// SealForUser and OpenSealed are also used for the ownership transfers of transfer.go and the
+// forwards of forward.go.
+
+// InboxEntry is the note a sender leaves in the recipient's inbox.
+type InboxEntry struct {
+	Sender        string
+	Filename      string // the sender's name for the file, suggested to the recipient
+	InvitationPtr userlib.UUID
+}
+
+// InboxHead is kept in the clear at the head of an inbox.
+type InboxHead struct {
+	Count  uint64 // entries ever appended, the next one goes to slot Count
+	Sealed []byte // the recipient's InboxState, sealed for themselves, empty until they first read the inbox
+}
+
+// InboxState is what the recipient kept of their inbox, oldest entry first.
+type InboxState struct {
+	Sequence uint64 // the slots moved into Entries so far
+	Entries  []InboxEntry
+}
+
+// PendingInvitation is an invitation in the inbox that can still be accepted, as returned by ListPendingInvitations.
+type PendingInvitation struct {
+	Sender        string
+	Filename      string
+	Expires       time.Time // zero for invitations that do not expire
+	InvitationPtr userlib.UUID
+}
+
+// returns the UUID of the head of the inbox of username
+func GetInboxHeadUUID(username string) (headUUID userlib.UUID, err error) {
+	headHash := userlib.Hash([]byte(username + " inbox"))
+	headUUID, err = uuid.FromBytes(headHash[:LENGTH])
+	if err != nil {
+		return uuid.Nil, errors.New("failed to get inbox UUID")
+	}
+	return headUUID, nil
+}
+
+// returns the UUID of slot number index of the inbox of username
+func GetInboxSlotUUID(username string, index uint64) (slotUUID userlib.UUID, err error) {
+	slotHash := userlib.Hash([]byte(username + " inbox " + strconv.FormatUint(index, 10)))
+	slotUUID, err = uuid.FromBytes(slotHash[:LENGTH])
+	if err != nil {
+		return uuid.Nil, errors.New("failed to get inbox UUID")
+	}
+	return slotUUID, nil
+}
+
+// loads the head of the inbox of username, ok is false for an inbox nobody wrote to
+func LoadInboxHead(userdata *User, username string) (head InboxHead, ok bool, err error) {
+	headUUID, err := GetInboxHeadUUID(username)
+	if err != nil {
+		return InboxHead{}, false, err
+	}
+	value, ok := userdata.datastore.Get(headUUID)
+	if !ok {
+		return InboxHead{}, false, nil
+	}
+	storedType, msg, _, _, legacy, err := UnpackEnvelope(value)
+	if err != nil || legacy || storedType != RecordInboxHead {
+		return InboxHead{}, false, ErrInboxTampered
+	}
+	err = json.Unmarshal(msg, &head)
+	if err != nil {
+		return InboxHead{}, false, ErrInboxTampered
+	}
+	return head, true, nil
+}
+
+// stores the head of the inbox of username
+func StoreInboxHead(userdata *User, username string, head InboxHead) (err error) {
+	headUUID, err := GetInboxHeadUUID(username)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(head)
+	if err != nil {
+		return errors.New("failed to marshal inbox head")
+	}
+	value, err := GenerateUUIDVal(RecordInboxHead, msg, nil)
+	if err != nil {
+		return err
+	}
+	return userdata.datastore.Set(headUUID, value)
+}
+
+// seals entry for recipientUsername and appends it to their inbox
+func AppendToInbox(userdata *User, recipientUsername string, entry InboxEntry) (err error) {
+	head, _, err := LoadInboxHead(userdata, recipientUsername)
+	if err != nil {
+		return err
+	}
+	slotUUID, err := GetInboxSlotUUID(recipientUsername, head.Count)
+	if err != nil {
+		return err
+	}
+	entryValue, err := SealForUser(userdata, recipientUsername, RecordInboxEntry, slotUUID, entry)
+	if err != nil {
+		return err
+	}
+	err = userdata.datastore.Set(slotUUID, entryValue)
+	if err != nil {
+		return err
+	}
+	head.Count++
+	return StoreInboxHead(userdata, recipientUsername, head)
+}
+
+// loads the user's own inbox and moves the entries appended since into the state, returning the
+// slots they were read from. tampered is set, along with what could be read, when the inbox was
+// tampered with.
+func LoadInbox(userdata *User) (head InboxHead, state InboxState, read []userlib.UUID, tampered bool, err error) {
+	// The head has to be there, and open, once the user has seen it
+	head, ok, err := LoadInboxHead(userdata, userdata.Username)
+	if err == ErrInboxTampered {
+		head, ok, tampered = InboxHead{}, false, true
+	} else if err != nil {
+		return InboxHead{}, InboxState{}, nil, false, err
+	}
+	if !ok && userdata.InboxSequence > 0 {
+		tampered = true
+	}
+	if len(head.Sealed) > 0 {
+		headUUID, err := GetInboxHeadUUID(userdata.Username)
+		if err != nil {
+			return InboxHead{}, InboxState{}, nil, false, err
+		}
+		signed, sig, err := OpenSealed(userdata, RecordInboxHead, headUUID, head.Sealed, &state)
+		if err != nil || CheckSignature(userdata.keystore, signed, sig, userdata.Username) != nil {
+			state, tampered = InboxState{}, true
+		}
+	}
+
+	// Nothing the user has seen may have gone missing since
+	if state.Sequence < userdata.InboxSequence || head.Count < state.Sequence {
+		tampered = true
+	}
+	if tampered {
+		// start over after what the user has seen, and pick up the slots filled since
+		state = InboxState{Sequence: maxUint64(state.Sequence, userdata.InboxSequence)}
+		head.Count = maxUint64(head.Count, state.Sequence)
+		for {
+			slotUUID, err := GetInboxSlotUUID(userdata.Username, head.Count)
+			if err != nil {
+				return InboxHead{}, InboxState{}, nil, false, err
+			}
+			if _, ok := userdata.datastore.Get(slotUUID); !ok {
+				break
+			}
+			head.Count++
+		}
+	}
+
+	// Read the entries appended since, every slot up to the count has to hold one
+	var slots []userlib.UUID
+	for index := state.Sequence; index < head.Count; index++ {
+		slotUUID, err := GetInboxSlotUUID(userdata.Username, index)
+		if err != nil {
+			return InboxHead{}, InboxState{}, nil, false, err
+		}
+		slots = append(slots, slotUUID)
+	}
+	values := userdata.datastore.GetBatch(slots)
+	for _, slotUUID := range slots {
+		value, ok := values[slotUUID]
+		if !ok {
+			tampered = true
+			continue
+		}
+		read = append(read, slotUUID)
+		entry, err := OpenInboxEntry(userdata, slotUUID, value)
+		if err != nil {
+			tampered = true
+			continue
+		}
+		state.Entries = append(state.Entries, entry)
+	}
+	state.Sequence = head.Count
+	return head, state, read, tampered, nil
+}
+
+// seals the state into the head of the user's own inbox, removes the slots that were read into it
+// and remembers how far the user has read
+func StoreInbox(userdata *User, head InboxHead, state InboxState, read []userlib.UUID) (err error) {
+	headUUID, err := GetInboxHeadUUID(userdata.Username)
+	if err != nil {
+		return err
+	}
+	head.Sealed, err = SealForUser(userdata, userdata.Username, RecordInboxHead, headUUID, state)
+	if err != nil {
+		return err
+	}
+	err = StoreInboxHead(userdata, userdata.Username, head)
+	if err != nil {
+		return err
+	}
+	err = userdata.datastore.DeleteBatch(read)
+	if err != nil {
+		return err
+	}
+	if state.Sequence > userdata.InboxSequence {
+		userdata.InboxSequence = state.Sequence
+		return StoreUser(userdata)
+	}
+	return nil
+}
+
+// removes the entries for the invitations at invitationPtrs from the user's own inbox
+func RemoveFromInbox(userdata *User, invitationPtrs []userlib.UUID) (err error) {
+	removed := make(map[userlib.UUID]bool)
+	for _, invitationPtr := range invitationPtrs {
+		removed[invitationPtr] = true
+	}
+	head, state, read, tampered, err := LoadInbox(userdata)
+	if err != nil {
+		return err
+	}
+	var kept []InboxEntry
+	for _, entry := range state.Entries {
+		if !removed[entry.InvitationPtr] {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) != len(state.Entries) || len(read) > 0 || tampered {
+		state.Entries = kept
+		err = StoreInbox(userdata, head, state, read)
+		if err != nil {
+			return err
+		}
+	}
+	if tampered {
+		return ErrInboxTampered
+	}
+	return nil
+}
+
+// encrypts txt under a fresh key that is encrypted to recipientUsername, and signs it along with
+// the record type and UUID as the user
+func SealForUser(userdata *User, recipientUsername string, recordType RecordType, UUID userlib.UUID, txt interface{}) (value []byte, err error) {
+	// Encrypt the record under a fresh key, and the key to the recipient
+	pubkey, ok := userdata.keystore.Get(recipientUsername + " public key")
+	if !ok {
+		return nil, errors.New("recipient user does not exist in the system")
+	}
+	recordKey := userlib.RandomBytes(LENGTH)
+	sealedKey, err := userlib.PKEEnc(pubkey, recordKey)
+	if err != nil {
+		return nil, errors.New("failed to encrypt record key")
+	}
+	plaintext, err := json.Marshal(txt)
+	if err != nil {
+		return nil, errors.New("failed to marshal record")
+	}
+	msg := append(sealedKey, userlib.SymEnc(recordKey, userlib.RandomBytes(LENGTH), plaintext)...)
+
+	// sign along with the record type and UUID
+	sig, err := userlib.DSSign(userdata.Sigkey, append(RecordAD(recordType, UUID), msg...))
+	if err != nil {
+		return nil, errors.New("failed to sign record")
+	}
+	return GenerateUUIDVal(recordType, msg, sig)
+}
+
+// decrypts a record sealed by SealForUser into v, the caller checks sig over signed with the sender's key
+func OpenSealed(userdata *User, recordType RecordType, UUID userlib.UUID, value []byte, v interface{}) (signed, sig []byte, err error) {
+	// Unpack, sealed records never had older formats
+	storedType, msg, sig, _, legacy, err := UnpackEnvelope(value)
+	if err != nil || legacy || storedType != recordType {
+		return nil, nil, errors.New("failed to unpack sealed record")
+	}
+
+	// Decrypt the key and then the record
+	keySize := userdata.RSAkey.PrivKey.Size()
+	if len(msg) < keySize+userlib.AESBlockSizeBytes {
+		return nil, nil, errors.New("failed to unpack sealed record")
+	}
+	recordKey, err := userlib.PKEDec(userdata.RSAkey, msg[:keySize])
+	if err != nil || len(recordKey) != LENGTH {
+		return nil, nil, errors.New("failed to decrypt sealed record")
+	}
+	err = json.Unmarshal(userlib.SymDec(recordKey, msg[keySize:]), v)
+	if err != nil {
+		return nil, nil, errors.New("failed to decrypt sealed record")
+	}
+	return append(RecordAD(recordType, UUID), msg...), sig, nil
+}
+
+// opens the inbox entry stored at slotUUID and checks its sender signed it for the slot it is kept at
+func OpenInboxEntry(userdata *User, slotUUID userlib.UUID, value []byte) (entry InboxEntry, err error) {
+	signed, sig, err := OpenSealed(userdata, RecordInboxEntry, slotUUID, value, &entry)
+	if err != nil {
+		return InboxEntry{}, err
+	}
+
+	// The sender named inside must have signed it, along with the slot
+	err = CheckSignature(userdata.keystore, signed, sig, entry.Sender)
+	if err != nil {
+		return InboxEntry{}, errors.New("failed to verify inbox entry signature")
+	}
+	return entry, nil
+}
+
+// reports the expiry of the invitation an inbox entry points at, or an error if it can no longer be accepted
+func PendingExpiry(userdata *User, entry InboxEntry) (expires time.Time, err error) {
+	invitationMeta, err := LoadInvitationMeta(userdata, entry.Sender, entry.InvitationPtr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	invitationSourceKey, _, err := FollowForwards(userdata, invitationMeta.InvitationUUID, invitationMeta.InvitationSourcekey)
+	if err != nil {
+		return time.Time{}, err
+	}
+	invitation, _, _, err := LoadInvitation(userdata.datastore, invitationMeta.InvitationUUID, invitationSourceKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+	err = CheckInvitationUsable(invitationMeta, invitation, entry.InvitationPtr, SessionTime(userdata))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if invitation.Sharer != entry.Sender || invitation.Recipient != userdata.Username {
+		return time.Time{}, errors.New("invitation was not sent by sender to this user")
+	}
+	return invitationMeta.Expires, nil
+}
+
+func (userdata *User) ListPendingInvitations() (pending []PendingInvitation, err error) {
+	/*
+		Lists the invitations in the user's inbox that can still be accepted, oldest first. Pass
+		Sender and InvitationPtr to AcceptInvitation, Filename is the name the sender uses.
+		Entries that can no longer be accepted are removed. Entries that were removed or forged
+		by someone else are removed too and reported with ErrInboxTampered, along with the rest.
+	*/
+	var tampered bool
+	err = RetryOnConflict(userdata, func(attempt *User) error {
+		pending = nil
+		head, state, read, inboxTampered, err := LoadInbox(attempt)
+		if err != nil {
+			return err
+		}
+		tampered = inboxTampered
+
+		// Keep the entries that can still be accepted
+		var kept []InboxEntry
+		for _, entry := range state.Entries {
+			expires, err := PendingExpiry(attempt, entry)
+			if err != nil {
+				continue
+			}
+			kept = append(kept, entry)
+			pending = append(pending, PendingInvitation{
+				Sender:        entry.Sender,
+				Filename:      entry.Filename,
+				Expires:       expires,
+				InvitationPtr: entry.InvitationPtr,
+			})
+		}
+
+		// Store what is left, unless nothing changed
+		if len(kept) == len(state.Entries) && len(read) == 0 && !tampered {
+			return nil
+		}
+		state.Entries = kept
+		return StoreInbox(attempt, head, state, read)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tampered {
+		return pending, ErrInboxTampered
+	}
+	return pending, nil
+}
@@ -0,0 +1,284 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A writer can lock a file for a multi-step edit with LockFile. The lock is a lease kept next
+// to the meta, at a UUID derived from the meta UUID and under keys derived from the meta keys,
+// so everyone the file is shared with can see who holds it and until when. The lease is signed
+// with the file sign key like the meta, so only writers can take it, and its holder signs it
+// with their own key too, so no writer can pass a lease off as another user's.
+//
+// A lease is held by the User session that took it, other sessions of the same user are
+// locked out too. It lapses by itself once its ttl has passed, so a client that crashed while
+// holding it only locks the file out for that long. Expiry is judged by the clock the session
+// was opened with, see SessionOptions.
+//
+// Unlocking leaves a released lease behind rather than deleting it, so the lease keeps counting
+// its writes. Sessions remember the highest count they have seen, as they do for metas, and
+// report an older lease put back by the datastore with ErrRollback.
+//
+// Locks are advisory: StoreFile, AppendToFile and the other writes do not check them, they
+// only keep out other LockFile calls. RevokeAccess moves the lease to the new meta keys unless
+// it was held by a revoked user, in which case the owner releases it.
+
+// Lease is the record LockFile stores next to the meta.
+type Lease struct {
+	Holder    string       // username of the holder, or of whoever released the lease
+	Session   userlib.UUID // the session of the holder that took the lease
+	Expires   time.Time    // zero once the lease was released
+	Sequence  Sequence     // counts the writes to the lease, see rollback.go
+	HolderSig []byte       // signature of the holder over the lease without it, see LeaseSigned
+}
+
+// FileLock describes who holds the lock of a file, as returned by GetLock.
+type FileLock struct {
+	Holder  string
+	Expires time.Time
+}
+
+// returns the UUID the lease of the meta at metaUUID is kept at
+func GetLeaseUUID(metaUUID userlib.UUID) (leaseUUID userlib.UUID, err error) {
+	leaseHash := userlib.Hash(append(metaUUID[:], []byte("lease")...))
+	leaseUUID, err = uuid.FromBytes(leaseHash[:LENGTH])
+	if err != nil {
+		return uuid.Nil, errors.New("failed to get lease UUID")
+	}
+	return leaseUUID, nil
+}
+
+// returns the keys of the lease, derived from the meta keys so every sharee has them
+func GetLeaseKeys(metaHMACKey []byte) (leaseEncryptKey, leaseHMACKey []byte, err error) {
+	leaseSourceKey, err := userlib.HashKDF(metaHMACKey, []byte("lease"))
+	if err != nil {
+		return nil, nil, errors.New("failed to derive lease keys")
+	}
+	return GetTwoHASHKDFKeys(leaseSourceKey[:LENGTH], ENCRYPT, MAC)
+}
+
+// returns the bytes the holder of a lease stored at leaseUUID signs
+func LeaseSigned(leaseUUID userlib.UUID, lease Lease) (signed []byte, err error) {
+	lease.HolderSig = nil
+	leaseBytes, err := json.Marshal(lease)
+	if err != nil {
+		return nil, errors.New("failed to marshal lease")
+	}
+	return append(RecordAD(RecordLease, leaseUUID), leaseBytes...), nil
+}
+
+// loads the lease of the meta at metaUUID, exists is false when the file was never locked. The
+// lease has to be signed by its holder and no older than one the session has already seen.
+func LoadLease(userdata *User, metaUUID userlib.UUID, metaHMACKey []byte, grant FileGrant) (lease Lease, exists bool, err error) {
+	leaseUUID, err := GetLeaseUUID(metaUUID)
+	if err != nil {
+		return Lease{}, false, err
+	}
+	leaseEncryptKey, leaseHMACKey, err := GetLeaseKeys(metaHMACKey)
+	if err != nil {
+		return Lease{}, false, err
+	}
+
+	// Check if the lease exists, unpack, check tag and signature, and decrypt
+	leaseValue, ok := userdata.datastore.Get(leaseUUID)
+	if !ok {
+		return Lease{}, false, nil
+	}
+	leaseMsg, leaseSig, err := OpenRecord(userdata.datastore, leaseUUID, leaseValue, RecordLease, leaseHMACKey)
+	if err != nil {
+		return Lease{}, false, errors.New("integrity check failed: lease has been tampered with")
+	}
+	err = userlib.DSVerify(grant.FileVerifyKey, leaseMsg, leaseSig)
+	if err != nil {
+		return Lease{}, false, errors.New("integrity check failed: lease was not signed by a writer")
+	}
+	err = json.Unmarshal(userlib.SymDec(leaseEncryptKey, leaseMsg), &lease)
+	if err != nil {
+		return Lease{}, false, errors.New("failed to decrypt lease")
+	}
+
+	// Check the holder signed the lease, and that it is not older than one seen before
+	signed, err := LeaseSigned(leaseUUID, lease)
+	if err != nil {
+		return Lease{}, false, err
+	}
+	err = CheckSignature(userdata.keystore, signed, lease.HolderSig, lease.Holder)
+	if err != nil {
+		return Lease{}, false, errors.New("integrity check failed: lease was not signed by its holder")
+	}
+	err = userdata.session.See(leaseUUID, lease.Sequence)
+	if err != nil {
+		return Lease{}, false, err
+	}
+	return lease, true, nil
+}
+
+// has the user sign lease as its holder, numbering the write after the lease it replaces, which
+// was read at sequence
+func SignLease(userdata *User, metaUUID userlib.UUID, lease Lease, sequence Sequence) (signedLease Lease, err error) {
+	leaseUUID, err := GetLeaseUUID(metaUUID)
+	if err != nil {
+		return Lease{}, err
+	}
+	lease.Holder = userdata.Username
+	lease.Sequence = userdata.session.Next(leaseUUID, sequence)
+	signed, err := LeaseSigned(leaseUUID, lease)
+	if err != nil {
+		return Lease{}, err
+	}
+	lease.HolderSig, err = userlib.DSSign(userdata.Sigkey, signed)
+	if err != nil {
+		return Lease{}, errors.New("failed to sign lease")
+	}
+	return lease, nil
+}
+
+// encrypts, macs and signs the lease of the meta at metaUUID and stores it, the lease is already
+// signed by its holder
+func StoreLease(userdata *User, metaUUID userlib.UUID, lease Lease, metaHMACKey []byte, grant FileGrant) (err error) {
+	if !CanWrite(grant) {
+		return ErrReadOnly
+	}
+	leaseUUID, err := GetLeaseUUID(metaUUID)
+	if err != nil {
+		return err
+	}
+	leaseEncryptKey, leaseHMACKey, err := GetLeaseKeys(metaHMACKey)
+	if err != nil {
+		return err
+	}
+	leaseMsg, leaseTag, err := EncryptThenMac(RecordLease, leaseUUID, lease, leaseEncryptKey, leaseHMACKey)
+	if err != nil {
+		return err
+	}
+	leaseSig, err := userlib.DSSign(grant.FileSignKey, leaseMsg)
+	if err != nil {
+		return errors.New("failed to sign lease")
+	}
+	leaseValue, err := GenerateSignedUUIDVal(RecordLease, leaseMsg, leaseTag, leaseSig)
+	if err != nil {
+		return err
+	}
+	err = userdata.datastore.Set(leaseUUID, leaseValue)
+	if err != nil {
+		return err
+	}
+	return userdata.session.See(leaseUUID, lease.Sequence)
+}
+
+// reports whether the lease still keeps the session with sessionID out at time now
+func LeaseHeldByOther(lease Lease, sessionID userlib.UUID, now time.Time) bool {
+	return lease.Session != sessionID && now.Before(lease.Expires)
+}
+
+// returns the time on the clock the session was opened with
+func SessionTime(userdata *User) time.Time {
+	return userdata.clock.Now()
+}
+
+// returns ErrLocked with who holds the lease and until when
+func LockedError(lease Lease) error {
+	return fmt.Errorf("%w: held by %s until %s", ErrLocked, lease.Holder, lease.Expires.Format(time.RFC3339))
+}
+
+func (userdata *User) LockFile(filename string, ttl time.Duration) (err error) {
+	/*
+		Locks filename for ttl, or extends the lock this session already holds by ttl from now.
+		Fails with ErrLocked while another session holds an unexpired lock.
+	*/
+	if ttl <= 0 {
+		return errors.New("ttl must be positive")
+	}
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		// Get the access struct and the meta, and check the user may write to the file
+		_, accessStruct, _, _, err := LoadAccess(attempt, filename)
+		if err != nil {
+			return err
+		}
+		metaUUID, _, _, metaHMACKey, grant, err := LoadMeta(attempt, accessStruct)
+		if err != nil {
+			return err
+		}
+		if !CanWrite(grant) {
+			return ErrReadOnly
+		}
+
+		// Take the lease unless someone else holds it
+		lease, exists, err := LoadLease(attempt, metaUUID, metaHMACKey, grant)
+		if err != nil {
+			return err
+		}
+		if exists && LeaseHeldByOther(lease, attempt.session.id, SessionTime(attempt)) {
+			return LockedError(lease)
+		}
+		lease, err = SignLease(attempt, metaUUID, Lease{Session: attempt.session.id, Expires: SessionTime(attempt).Add(ttl)}, lease.Sequence)
+		if err != nil {
+			return err
+		}
+		return StoreLease(attempt, metaUUID, lease, metaHMACKey, grant)
+	})
+}
+
+func (userdata *User) UnlockFile(filename string) (err error) {
+	/*
+		Releases the lock this session holds on filename. Unlocking a file nobody holds is a no-op,
+		unlocking one another session holds fails with ErrLocked.
+	*/
+	return RetryOnConflict(userdata, func(attempt *User) error {
+		_, accessStruct, _, _, err := LoadAccess(attempt, filename)
+		if err != nil {
+			return err
+		}
+		metaUUID, _, _, metaHMACKey, grant, err := LoadMeta(attempt, accessStruct)
+		if err != nil {
+			return err
+		}
+		lease, exists, err := LoadLease(attempt, metaUUID, metaHMACKey, grant)
+		if err != nil || !exists || !SessionTime(attempt).Before(lease.Expires) {
+			return err
+		}
+		if LeaseHeldByOther(lease, attempt.session.id, SessionTime(attempt)) {
+			return LockedError(lease)
+		}
+
+		// Leave the lease behind released, so it keeps its count
+		lease, err = SignLease(attempt, metaUUID, Lease{}, lease.Sequence)
+		if err != nil {
+			return err
+		}
+		return StoreLease(attempt, metaUUID, lease, metaHMACKey, grant)
+	})
+}
+
+func (userdata *User) GetLock(filename string) (lock FileLock, locked bool, err error) {
+	/*
+		Reports who holds the lock of filename and until when, locked is false if nobody does.
+		Every user the file is shared with can see it.
+	*/
+	err = RetryOnConflict(userdata, func(attempt *User) error {
+		_, accessStruct, _, _, err := LoadAccess(attempt, filename)
+		if err != nil {
+			return err
+		}
+		metaUUID, _, _, metaHMACKey, grant, err := LoadMeta(attempt, accessStruct)
+		if err != nil {
+			return err
+		}
+		lease, exists, err := LoadLease(attempt, metaUUID, metaHMACKey, grant)
+		if err != nil {
+			return err
+		}
+		lock, locked = FileLock{Holder: lease.Holder, Expires: lease.Expires}, exists && SessionTime(attempt).Before(lease.Expires)
+		return nil
+	})
+	if err != nil || !locked {
+		return FileLock{}, false, err
+	}
+	return lock, true, nil
+}
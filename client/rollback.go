@@ -0,0 +1,107 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// A datastore attacker can put back an older copy of a record: it is still MAC'd and signed,
+// and still sits at the UUID and has the type its tag covers. Every meta therefore carries a
+// sequence number that each write increments, and each User session remembers the highest
+// sequence number it has seen for every meta. A meta older than that is reported with
+// ErrRollback rather than returned.
+//
+// Blocks and index nodes need no counter of their own, the meta pins them through the root
+// hash. A block or node whose tag checks out for its UUID but whose hash is not the one its
+// index entry expects is an older copy, and is reported with ErrRollback as well. (A reader
+// holding the file keys can also seal such a record, which is reported the same way.)
+//
+// A new session starts with nothing remembered, so it cannot tell a meta that was rolled back
+// before it first read the file.
+
+// Sequence counts the writes to a meta. It is encoded with a fixed width so an append always
+// writes the same number of bytes.
+type Sequence uint64
+
+const sequenceDigits = 20 // digits of the largest uint64
+
+func (sequence Sequence) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%0*d"`, sequenceDigits, uint64(sequence))), nil
+}
+
+func (sequence *Sequence) UnmarshalJSON(data []byte) error {
+	var digits string
+	err := json.Unmarshal(data, &digits)
+	if err != nil {
+		return err
+	}
+	value, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return errors.New("invalid sequence number")
+	}
+	*sequence = Sequence(value)
+	return nil
+}
+
+// sessionCache is what a User session remembers about the files it has read.
+type sessionCache struct {
+	mu        sync.Mutex
+	id        userlib.UUID              // tells the sessions of a user apart, see lease.go
+	sequences map[userlib.UUID]Sequence // highest sequence number seen for each meta
+}
+
+func newSessionCache() *sessionCache {
+	return &sessionCache{id: uuid.New(), sequences: make(map[userlib.UUID]Sequence)}
+}
+
+// returns the sequence number of the next write of the meta at metaUUID, which was read at sequence
+func (cache *sessionCache) Next(metaUUID userlib.UUID, sequence Sequence) Sequence {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if seen := cache.sequences[metaUUID]; seen > sequence {
+		sequence = seen
+	}
+	return sequence + 1
+}
+
+// records that the meta at metaUUID was seen at sequence, returning ErrRollback if the session
+// has already seen a later one
+func (cache *sessionCache) See(metaUUID userlib.UUID, sequence Sequence) (err error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if sequence < cache.sequences[metaUUID] {
+		return ErrRollback
+	}
+	cache.sequences[metaUUID] = sequence
+	return nil
+}
+
+// returns a copy of the cache for one attempt at an operation, see RetryOnConflict
+func (cache *sessionCache) Fork() *sessionCache {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	fork := &sessionCache{id: cache.id, sequences: make(map[userlib.UUID]Sequence)}
+	for metaUUID, sequence := range cache.sequences {
+		fork.sequences[metaUUID] = sequence
+	}
+	return fork
+}
+
+// takes in everything an attempt that was committed has seen
+func (cache *sessionCache) Merge(fork *sessionCache) {
+	fork.mu.Lock()
+	defer fork.mu.Unlock()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for metaUUID, sequence := range fork.sequences {
+		if sequence > cache.sequences[metaUUID] {
+			cache.sequences[metaUUID] = sequence
+		}
+	}
+}
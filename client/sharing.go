@@ -0,0 +1,212 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// ListAccess reports who a file is shared with from the share tree. The nodes of the tree are
+// MAC'd with keys their recipient holds too, so the recipient could rewrite who granted them
+// access, when, or with which permission. The sharer therefore also signs those facts, bound to
+// the node's UUID, with their own signature key, and ListAccess checks every signature and that
+// every node was granted by the recipient of its parent. Revoking rewrites nodes but keeps the
+// signed facts as they are, inviting a recipient again signs them anew.
+//
+// Whether a node was accepted cannot be signed by the sharer, who is not around when it happens,
+// so the recipient signs that with their own key when they accept. ListAccess only lists nodes
+// that carry it and reports a node whose Accepted flag does not match it as tampered with. A
+// recipient can still strip their own acceptance, which hides them from ListAccess but not from
+// RevokeAccess.
+
+// AccessEntry is a user with access to a file, as returned by ListAccess.
+type AccessEntry struct {
+	Username   string
+	GrantedBy  string
+	Granted    time.Time
+	Permission Permission
+}
+
+// GrantRecord is what the sharer of an invitation signs.
+type GrantRecord struct {
+	File       userlib.UUID // the meta the invitation was created for, which stays with the file
+	Creator    string       // who created the file, see forward.go
+	Sharer     string
+	Recipient  string
+	Permission Permission
+	Granted    time.Time
+}
+
+// AcceptRecord is what the recipient of an invitation signs once they accepted it.
+type AcceptRecord struct {
+	Sharer    string
+	Recipient string
+	Accepted  bool
+}
+
+// returns the bytes the sharer signs for the invitation at invitationUUID
+func GrantStatement(invitationUUID userlib.UUID, invitation Invitation) (statement []byte, err error) {
+	grantBytes, err := json.Marshal(GrantRecord{
+		File:       invitation.MetaUUID,
+		Creator:    invitation.Creator,
+		Sharer:     invitation.Sharer,
+		Recipient:  invitation.Recipient,
+		Permission: invitation.Grant.Permission,
+		Granted:    invitation.Granted,
+	})
+	if err != nil {
+		return nil, errors.New("failed to marshal grant")
+	}
+	return append(RecordAD(RecordInvitation, invitationUUID), grantBytes...), nil
+}
+
+// stamps the invitation with the time of the grant and signs it as its sharer
+func SignGrant(userdata *User, invitationUUID userlib.UUID, invitation *Invitation) (err error) {
+	invitation.Granted = SessionTime(userdata)
+	statement, err := GrantStatement(invitationUUID, *invitation)
+	if err != nil {
+		return err
+	}
+	invitation.GrantSig, err = userlib.DSSign(userdata.Sigkey, statement)
+	if err != nil {
+		return errors.New("failed to sign grant")
+	}
+	return nil
+}
+
+// checks the sharer of the invitation signed it as it is
+func VerifyGrant(keystore Keystore, invitationUUID userlib.UUID, invitation Invitation) (err error) {
+	statement, err := GrantStatement(invitationUUID, invitation)
+	if err != nil {
+		return err
+	}
+	err = CheckSignature(keystore, statement, invitation.GrantSig, invitation.Sharer)
+	if err != nil {
+		return errors.New("integrity check failed: share tree has been tampered with")
+	}
+	return nil
+}
+
+// returns the bytes the recipient signs once they accepted the invitation at invitationUUID
+func AcceptStatement(invitationUUID userlib.UUID, invitation Invitation) (statement []byte, err error) {
+	acceptBytes, err := json.Marshal(AcceptRecord{
+		Sharer:    invitation.Sharer,
+		Recipient: invitation.Recipient,
+		Accepted:  true,
+	})
+	if err != nil {
+		return nil, errors.New("failed to marshal acceptance")
+	}
+	return append(RecordAD(RecordInvitation, invitationUUID), acceptBytes...), nil
+}
+
+// signs, as its recipient, that the invitation at invitationUUID was accepted
+func SignAcceptance(userdata *User, invitationUUID userlib.UUID, invitation Invitation) (sig []byte, err error) {
+	statement, err := AcceptStatement(invitationUUID, invitation)
+	if err != nil {
+		return nil, err
+	}
+	sig, err = userlib.DSSign(userdata.Sigkey, statement)
+	if err != nil {
+		return nil, errors.New("failed to sign acceptance")
+	}
+	return sig, nil
+}
+
+// checks the invitation was accepted exactly when its recipient signed that they accepted it
+func VerifyAcceptance(keystore Keystore, invitationUUID userlib.UUID, invitation Invitation) (err error) {
+	if invitation.Accepted != (len(invitation.AcceptSig) > 0) {
+		return errors.New("integrity check failed: share tree has been tampered with")
+	}
+	if !invitation.Accepted {
+		return nil
+	}
+	statement, err := AcceptStatement(invitationUUID, invitation)
+	if err != nil {
+		return err
+	}
+	err = CheckSignature(keystore, statement, invitation.AcceptSig, invitation.Recipient)
+	if err != nil {
+		return errors.New("integrity check failed: share tree has been tampered with")
+	}
+	return nil
+}
+
+func (userdata *User) ListAccess(filename string) (entries []AccessEntry, err error) {
+	/*
+		Lists every user who accepted an invitation to filename, directly or through another sharee,
+		with who granted it and when. The owner sees everyone, a sharee the users below them.
+	*/
+	err = RetryOnConflict(userdata, func(attempt *User) error {
+		_, accessStruct, _, _, err := LoadAccess(attempt, filename)
+		if err != nil {
+			return err
+		}
+
+		// Walk the tree below the caller: the owner's invitation list, or a sharee's own node
+		var below InvitationList
+		if accessStruct.IsOwner {
+			below, _, _, err = LoadInvitationList(attempt.datastore, accessStruct)
+		} else {
+			var own Invitation
+			own, _, _, err = LoadInvitation(attempt.datastore, accessStruct.InvitationUUID, accessStruct.InvitationSourcekey)
+			below.Invitations = own.Children
+		}
+		if err != nil {
+			return err
+		}
+		shareTree, err := GetShareTree(attempt.datastore, below)
+		if err != nil {
+			return err
+		}
+
+		// Every node has to be signed by the recipient of its parent, parents come before their children.
+		// Users invited directly may also have been invited by an earlier owner.
+		recipients := map[userlib.UUID]string{uuid.Nil: attempt.Username}
+		earlierOwners := make(map[string]bool)
+		for _, owner := range below.Owners {
+			earlierOwners[owner] = true
+		}
+		entries = nil
+		for _, node := range shareTree {
+			sharer := node.Invitation.Sharer
+			if node.Invitation.Revoked || (sharer != recipients[node.Parent] && !(node.Parent == uuid.Nil && earlierOwners[sharer])) {
+				return errors.New("integrity check failed: share tree has been tampered with")
+			}
+			err = VerifyGrant(attempt.keystore, node.InvitationUUID, node.Invitation)
+			if err != nil {
+				return err
+			}
+			err = VerifyAcceptance(attempt.keystore, node.InvitationUUID, node.Invitation)
+			if err != nil {
+				return err
+			}
+			recipients[node.InvitationUUID] = node.Invitation.Recipient
+			if node.Invitation.Accepted {
+				entries = append(entries, AccessEntry{
+					Username:   node.Invitation.Recipient,
+					GrantedBy:  node.Invitation.Sharer,
+					Granted:    node.Invitation.Granted,
+					Permission: node.Invitation.Grant.Permission,
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// oldest grant first
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].Granted.Equal(entries[j].Granted) {
+			return entries[i].Granted.Before(entries[j].Granted)
+		}
+		return entries[i].Username < entries[j].Username
+	})
+	return entries, nil
+}
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// Datastore is the untrusted key-value store that every encrypted record
+// (User, Access, Meta, File, Invitation, ...) is written to.
+// Implementations must be safe to share between multiple User sessions.
+type Datastore interface {
+	Get(key userlib.UUID) (value []byte, ok bool)
+	Set(key userlib.UUID, value []byte) error
+	Delete(key userlib.UUID) error
+
+	// batch variants, missing keys are left out of the returned map
+	GetBatch(keys []userlib.UUID) (values map[userlib.UUID][]byte)
+	SetBatch(entries map[userlib.UUID][]byte) error
+	DeleteBatch(keys []userlib.UUID) error
+
+	// Sequence returns the write sequence of the datastore, which changes with every write.
+	Sequence() (sequence uint64)
+
+	// CompareAndSetBatch writes entries, where a nil value deletes the key, as one atomic step,
+	// but only if nothing was written since Sequence returned sequence. It reports whether the
+	// entries were written.
+	CompareAndSetBatch(sequence uint64, entries map[userlib.UUID][]byte) (swapped bool, err error)
+}
+
+// Purger is implemented by datastores that keep deleted values around, such as the log of
+// FileDatastore, until Purge drops them for good.
+type Purger interface {
+	Purge() error
+}
+
+// Keystore is the trusted store for public encryption and verification keys.
+type Keystore interface {
+	Get(key string) (value userlib.PublicKeyType, ok bool)
+	Set(key string, value userlib.PublicKeyType) error
+}
+
+// Clock is where a session reads the time from, to judge when leases and invitations expire
+// and to stamp grants.
+type Clock interface {
+	Now() time.Time
+}
+
+// SessionOptions are what a session created by InitUserWithOptions or GetUserWithOptions runs
+// against. Fields left zero are DefaultDatastore, the userlib keystore and SystemClock.
+type SessionOptions struct {
+	Datastore Datastore
+	Keystore  Keystore
+	Clock     Clock
+}
+
+// returns the backends of options, with the defaults filled in
+func (options SessionOptions) backends() (datastore Datastore, keystore Keystore, clock Clock) {
+	datastore, keystore, clock = options.Datastore, options.Keystore, options.Clock
+	if datastore == nil {
+		datastore = DefaultDatastore
+	}
+	if keystore == nil {
+		keystore = UserlibKeystore{}
+	}
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	return datastore, keystore, clock
+}
+
+// SystemClock is the default Clock, it reads the system clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// OffsetClock is a Clock running a duration ahead of the system clock, which Advance moves on.
+// It lets a session whose system clock lags behind catch up, and lets tests see time pass
+// without waiting. It is safe for concurrent use.
+type OffsetClock struct {
+	mu     sync.Mutex
+	offset time.Duration
+}
+
+func (clock *OffsetClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return time.Now().Add(clock.offset)
+}
+
+// Advance moves the clock on by d.
+func (clock *OffsetClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.offset += d
+}
+
+// UserlibDatastore is the default Datastore backed by the in-memory userlib map.
+type UserlibDatastore struct{}
+
+// UserlibKeystore is the default Keystore backed by the in-memory userlib map.
+type UserlibKeystore struct{}
+
+// DefaultDatastore is where InitUser and GetUser keep users. It is the userlib map unless the
+// program points it at another backend, such as a FileDatastore, before it creates any user.
+var DefaultDatastore Datastore = UserlibDatastore{}
+
+// userlibMu guards the userlib maps, which are not safe for concurrent use on their own
+var userlibMu sync.Mutex
+
+// userlibSequence is the write sequence of the userlib datastore, bumped by every write made
+// through UserlibDatastore. The userlib map lives in this process, so the counter next to it
+// sees every session's writes without adding a record of its own to the map. Guarded by userlibMu.
+var userlibSequence uint64
+
+func (UserlibDatastore) Get(key userlib.UUID) (value []byte, ok bool) {
+	userlibMu.Lock()
+	defer userlibMu.Unlock()
+	return userlib.DatastoreGet(key)
+}
+
+func (UserlibDatastore) Set(key userlib.UUID, value []byte) error {
+	userlibMu.Lock()
+	defer userlibMu.Unlock()
+	userlib.DatastoreSet(key, value)
+	userlibSequence++
+	return nil
+}
+
+func (UserlibDatastore) Delete(key userlib.UUID) error {
+	userlibMu.Lock()
+	defer userlibMu.Unlock()
+	userlib.DatastoreDelete(key)
+	userlibSequence++
+	return nil
+}
+
+func (UserlibDatastore) GetBatch(keys []userlib.UUID) (values map[userlib.UUID][]byte) {
+	userlibMu.Lock()
+	defer userlibMu.Unlock()
+	values = make(map[userlib.UUID][]byte)
+	for _, key := range keys {
+		value, ok := userlib.DatastoreGet(key)
+		if ok {
+			values[key] = value
+		}
+	}
+	return
+}
+
+func (UserlibDatastore) SetBatch(entries map[userlib.UUID][]byte) error {
+	userlibMu.Lock()
+	defer userlibMu.Unlock()
+	for key, value := range entries {
+		userlib.DatastoreSet(key, value)
+	}
+	userlibSequence++
+	return nil
+}
+
+func (UserlibDatastore) DeleteBatch(keys []userlib.UUID) error {
+	userlibMu.Lock()
+	defer userlibMu.Unlock()
+	for _, key := range keys {
+		userlib.DatastoreDelete(key)
+	}
+	userlibSequence++
+	return nil
+}
+
+func (UserlibDatastore) Sequence() (sequence uint64) {
+	userlibMu.Lock()
+	defer userlibMu.Unlock()
+	return userlibSequence
+}
+
+func (UserlibDatastore) CompareAndSetBatch(sequence uint64, entries map[userlib.UUID][]byte) (swapped bool, err error) {
+	userlibMu.Lock()
+	defer userlibMu.Unlock()
+
+	// only the sequence is read back, never the records the caller read
+	if userlibSequence != sequence {
+		return false, nil
+	}
+	if len(entries) == 0 {
+		return true, nil
+	}
+	for key, value := range entries {
+		if value == nil {
+			userlib.DatastoreDelete(key)
+		} else {
+			userlib.DatastoreSet(key, value)
+		}
+	}
+	userlibSequence++
+	return true, nil
+}
+
+func (UserlibKeystore) Get(key string) (value userlib.PublicKeyType, ok bool) {
+	userlibMu.Lock()
+	defer userlibMu.Unlock()
+	return userlib.KeystoreGet(key)
+}
+
+func (UserlibKeystore) Set(key string, value userlib.PublicKeyType) error {
+	userlibMu.Lock()
+	defer userlibMu.Unlock()
+	return userlib.KeystoreSet(key, value)
+}
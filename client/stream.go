@@ -0,0 +1,445 @@
+package client
+
+import (
+	"errors"
+	"io"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+)
+
+// Readers and writers move a file through the client one block at a time, so the whole
+// content is never held in memory.
+//
+// A reader checks every block against the root hash of the version it loaded the meta of, like
+// LoadFile does. StoreFile puts a new version in a tree of its own, so a reader goes on with the
+// version it opened while that version is kept. Appends and overwrites rewrite the index nodes
+// and blocks of the current version in place though, so a read that follows one no longer
+// matches the root hash. A read that fails loads the meta again and carries on from the same
+// offset in the current version, so the reader also returns what was appended since it opened.
+//
+// A writer seals each block and stores it as soon as BlockSize bytes have been written, but
+// the index over the blocks is only written and signed into the meta on Close. Until then
+// the file is unchanged for everyone, and a writer that is never closed leaves its blocks
+// behind unreferenced. Close commits the index and meta like AppendToFile does, starting over
+// from the current meta when another session changed the file in the meantime. A Close that
+// fails deletes the blocks the writer stored, since nothing refers to them.
+//
+// A writer that replaces a deduplicated file cuts the content into chunks as it goes, at the
+// boundaries StoreFile would pick, and stores every chunk the owner does not have yet. Close
+// counts the chunks in the owner's chunk table in the same commit as the new version, checking
+// that the chunks nothing counted yet are still the ones the writer stored.
+
+// ErrEndOfFile is returned by the Read of a reader from OpenReader once the whole file was read.
+// It is io.EOF, so io.ReadAll and the rest of the io helpers stop at it.
+var ErrEndOfFile = io.EOF
+
+// WriteMode is what OpenWriter does with the content already in the file.
+type WriteMode int
+
+const (
+	WriteTruncate WriteMode = iota + 1 // replace the content as StoreFile does, creating the file if needed
+	WriteAppend                        // add to the end of the content as AppendToFile does
+)
+
+type fileReader struct {
+	userdata *User
+	filename string
+	tree     FileTree // version the reader last loaded the meta of
+	size     int
+	offset   int    // where the next block is read from
+	buffer   []byte // read from the file but not yet returned
+}
+
+type fileWriter struct {
+	userdata       *User
+	filename       string
+	mode           WriteMode
+	fileSourceKey  []byte // key of the tree the blocks are sealed under
+	fileEncryptKey []byte
+	fileHMACKey    []byte
+	compressed     bool           // whether the blocks are compressed
+	chunked        bool           // whether the blocks are chunks shared with the owner's other files
+	chunkTableKey  []byte         // chunk key of the owner's chunk table, for chunked writers
+	entries        []IndexEntry   // blocks stored so far, in order
+	indexNodes     []userlib.UUID // index nodes Close stored for a truncating writer
+	buffer         []byte         // written but not yet sealed into a block
+	closed         bool
+}
+
+func (userdata *User) OpenReader(filename string) (reader io.ReadCloser, err error) {
+	fileReader := &fileReader{userdata: userdata, filename: filename}
+	err = RetryOnConflict(userdata, fileReader.load)
+	if err != nil {
+		return nil, err
+	}
+	return fileReader, nil
+}
+
+// loads the current version of the file, as one attempt of OpenReader
+func (reader *fileReader) load(userdata *User) (err error) {
+	// Get the access struct and the meta of the file
+	_, accessStruct, _, _, err := LoadAccess(userdata, reader.filename)
+	if err != nil {
+		return err
+	}
+	_, metaStruct, _, _, _, err := LoadMeta(userdata, accessStruct)
+	if err != nil {
+		return err
+	}
+
+	// Only the root is read up front, blocks are read as they are needed
+	reader.tree = metaStruct.FileTree
+	reader.size, err = FileTreeLength(userdata.datastore, metaStruct.FileTree)
+	return err
+}
+
+func (userdata *User) OpenWriter(filename string, mode WriteMode) (writer io.WriteCloser, err error) {
+	if mode != WriteTruncate && mode != WriteAppend {
+		return nil, errors.New("unknown write mode")
+	}
+	fileWriter := &fileWriter{userdata: userdata, filename: filename, mode: mode}
+	err = RetryOnConflict(userdata, fileWriter.open)
+	if err != nil {
+		return nil, err
+	}
+	fileWriter.fileEncryptKey, fileWriter.fileHMACKey, err = GetTwoHASHKDFKeys(fileWriter.fileSourceKey, ENCRYPT, MAC)
+	if err != nil {
+		return nil, errors.New("failed to get keys for File")
+	}
+	return fileWriter, nil
+}
+
+// checks the user may write the file and picks the keys the blocks are sealed under, as one attempt of OpenWriter
+func (writer *fileWriter) open(userdata *User) (err error) {
+	if writer.mode == WriteTruncate {
+		// The new content goes to a fresh tree under new keys, as for StoreFile
+		writer.chunked, writer.compressed, err = CheckCanStore(userdata, writer.filename)
+		if err != nil {
+			return err
+		}
+		writer.fileSourceKey, err = GetRandomKey(userdata)
+		if err != nil {
+			return errors.New("failed to get file sourcekey")
+		}
+		if writer.chunked {
+			chunkTableStruct, _, _, err := LoadChunkTable(userdata)
+			if err != nil {
+				return err
+			}
+			writer.chunkTableKey = chunkTableStruct.Key
+		}
+		return nil
+	}
+
+	// The new blocks join the current tree, so they are sealed under its keys
+	_, accessStruct, _, _, err := LoadAccess(userdata, writer.filename)
+	if err != nil {
+		return err
+	}
+	_, metaStruct, _, _, grant, err := LoadMeta(userdata, accessStruct)
+	if err != nil {
+		return err
+	}
+	if !CanWrite(grant) {
+		return ErrReadOnly
+	}
+	writer.fileSourceKey, writer.compressed = metaStruct.FileSourcekey, metaStruct.Compressed
+	return nil
+}
+
+func (reader *fileReader) Read(p []byte) (n int, err error) {
+	// Read the next block worth of the file once everything read before was returned
+	if len(reader.buffer) == 0 {
+		if reader.offset >= reader.size {
+			return 0, ErrEndOfFile
+		}
+		reader.buffer, err = ReadFileRange(reader.userdata.datastore, reader.tree, reader.offset, minInt(reader.offset+BlockSize, reader.size))
+		if err != nil {
+			// The file may have changed since the meta was loaded, read the current version instead
+			err = RetryOnConflict(reader.userdata, reader.reload)
+			if err != nil {
+				return 0, err
+			}
+			if len(reader.buffer) == 0 {
+				return 0, ErrEndOfFile
+			}
+		}
+		reader.offset += len(reader.buffer)
+	}
+	n = copy(p, reader.buffer)
+	reader.buffer = reader.buffer[n:]
+	return n, nil
+}
+
+// loads the meta again and reads the next block worth of the current version, as one attempt of Read
+func (reader *fileReader) reload(userdata *User) (err error) {
+	err = reader.load(userdata)
+	if err != nil {
+		return err
+	}
+	reader.buffer = nil
+	if reader.offset >= reader.size {
+		return nil
+	}
+	reader.buffer, err = ReadFileRange(userdata.datastore, reader.tree, reader.offset, minInt(reader.offset+BlockSize, reader.size))
+	return err
+}
+
+func (reader *fileReader) Close() error {
+	reader.buffer = nil
+	reader.offset = reader.size
+	return nil
+}
+
+func (writer *fileWriter) Write(p []byte) (n int, err error) {
+	if writer.closed {
+		return 0, errors.New("writer is closed")
+	}
+
+	// Store every full block, and move what is left to the front of the buffer once at the end
+	writer.buffer = append(writer.buffer, p...)
+	flushed := 0
+	defer func() {
+		writer.buffer = append(writer.buffer[:0], writer.buffer[flushed:]...)
+	}()
+	for len(writer.buffer)-flushed >= BlockSize {
+		length, err := writer.flush(writer.buffer[flushed:])
+		if err != nil {
+			return 0, err
+		}
+		flushed += length
+	}
+	return len(p), nil
+}
+
+// stores the first block of data, which for chunked writers ends where the first chunk does, and
+// returns its length
+func (writer *fileWriter) flush(data []byte) (length int, err error) {
+	length = minInt(len(data), BlockSize)
+	if !writer.chunked {
+		return length, writer.flushBlock(data[:length])
+	}
+	chunks, err := SplitChunks(writer.chunkTableKey, data[:length])
+	if err != nil {
+		return 0, err
+	}
+	return len(chunks[0]), writer.flushChunk(chunks[0])
+}
+
+// seals block and stores it
+func (writer *fileWriter) flushBlock(block []byte) (err error) {
+	records := make(map[userlib.UUID][]byte)
+	entries, err := AddBlocks(records, block, writer.compressed, writer.fileEncryptKey, writer.fileHMACKey)
+	if err != nil {
+		return err
+	}
+	err = writer.userdata.datastore.SetBatch(records)
+	if err != nil {
+		return err
+	}
+	writer.entries = append(writer.entries, entries...)
+	return nil
+}
+
+// stores chunk unless the owner already has it. A stored chunk is not counted in the chunk table
+// until Close, so it is only written where no chunk the table counts is.
+func (writer *fileWriter) flushChunk(chunk []byte) (err error) {
+	chunkUUID, chunkKey, err := ChunkIdentity(writer.chunkTableKey, chunk)
+	if err != nil {
+		return err
+	}
+	chunkEncryptKey, chunkHMACKey, err := GetTwoHASHKDFKeys(chunkKey, ENCRYPT, MAC)
+	if err != nil {
+		return errors.New("failed to get keys for chunk")
+	}
+	entry := IndexEntry{UUID: chunkUUID, Length: len(chunk), Key: chunkKey}
+	err = RetryOnConflict(writer.userdata, func(attempt *User) (err error) {
+		chunkTableStruct, _, _, err := LoadChunkTable(attempt)
+		if err != nil {
+			return err
+		}
+		if ref, ok := chunkTableStruct.Chunks[chunkUUID]; ok {
+			entry.Hash = ref.Hash
+			return nil
+		}
+		var value []byte
+		value, entry.Hash, err = SealBlock(chunkUUID, chunk, writer.compressed, chunkEncryptKey, chunkHMACKey)
+		if err != nil {
+			return err
+		}
+		return attempt.datastore.Set(chunkUUID, value)
+	})
+	if err != nil {
+		return err
+	}
+	writer.entries = append(writer.entries, entry)
+	return nil
+}
+
+func (writer *fileWriter) Close() (err error) {
+	if writer.closed {
+		return errors.New("writer is closed")
+	}
+	writer.closed = true
+	err = writer.commit()
+	if err != nil {
+		// Nothing refers to the blocks stored so far
+		releaseErr := writer.release()
+		if releaseErr != nil {
+			return releaseErr
+		}
+		return err
+	}
+	return nil
+}
+
+// stores what is left as the last blocks and makes them part of the file, as Close
+func (writer *fileWriter) commit() (err error) {
+	for len(writer.buffer) > 0 {
+		length, err := writer.flush(writer.buffer)
+		if err != nil {
+			return err
+		}
+		writer.buffer = writer.buffer[length:]
+	}
+
+	if writer.chunked {
+		return RetryOnConflict(writer.userdata, writer.commitChunks)
+	}
+	if writer.mode == WriteTruncate {
+		// Index the blocks and make them the current version
+		records := make(map[userlib.UUID][]byte)
+		tree, err := BuildFileTree(records, writer.fileSourceKey, writer.compressed, writer.entries)
+		if err != nil {
+			return err
+		}
+		for nodeUUID := range records {
+			writer.indexNodes = append(writer.indexNodes, nodeUUID)
+		}
+		err = writer.userdata.datastore.SetBatch(records)
+		if err != nil {
+			return err
+		}
+		return RetryOnConflict(writer.userdata, func(attempt *User) error {
+			return StoreFileTree(attempt, writer.filename, tree)
+		})
+	}
+	return RetryOnConflict(writer.userdata, writer.commitAppend)
+}
+
+// deletes the blocks and index nodes the writer stored once Close failed to make them part of
+// the file. Chunks are only deleted while the owner's chunk table does not count them.
+func (writer *fileWriter) release() (err error) {
+	doomed := append([]userlib.UUID{}, writer.indexNodes...)
+	var chunks []userlib.UUID
+	for _, entry := range writer.entries {
+		if entry.Key != nil {
+			chunks = append(chunks, entry.UUID)
+		} else {
+			doomed = append(doomed, entry.UUID)
+		}
+	}
+	err = writer.userdata.datastore.DeleteBatch(doomed)
+	if err != nil || len(chunks) == 0 {
+		return err
+	}
+	return RetryOnConflict(writer.userdata, func(attempt *User) error {
+		chunkTableStruct, _, _, err := LoadChunkTable(attempt)
+		if err != nil {
+			return err
+		}
+		var uncounted []userlib.UUID
+		for _, chunkUUID := range chunks {
+			if _, ok := chunkTableStruct.Chunks[chunkUUID]; !ok {
+				uncounted = append(uncounted, chunkUUID)
+			}
+		}
+		return attempt.datastore.DeleteBatch(uncounted)
+	})
+}
+
+// adds the blocks of an append writer to the end of the current tree, as one attempt of Close
+func (writer *fileWriter) commitAppend(userdata *User) (err error) {
+	// Reload the meta, the file may have been appended to since the writer was opened
+	_, accessStruct, _, _, err := LoadAccess(userdata, writer.filename)
+	if err != nil {
+		return err
+	}
+	metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant, err := LoadMeta(userdata, accessStruct)
+	if err != nil {
+		return err
+	}
+	if !CanWrite(grant) {
+		return ErrReadOnly
+	}
+
+	// Blocks sealed for a tree that was since replaced, compacted or re-keyed cannot join the current one
+	if !userlib.HMACEqual(metaStruct.FileSourcekey, writer.fileSourceKey) {
+		return errors.New("file was replaced while it was being written")
+	}
+
+	// Add the blocks to the end of the index and sign the new root into the meta
+	records := make(map[userlib.UUID][]byte)
+	metaStruct.FileTree, err = AppendIndexEntries(userdata.datastore, records, metaStruct.FileTree, writer.entries)
+	if err != nil {
+		return err
+	}
+	err = userdata.datastore.SetBatch(records)
+	if err != nil {
+		return err
+	}
+	return StoreAppendedMeta(userdata, accessStruct, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
+}
+
+// counts the chunks of a chunked writer in the owner's chunk table and makes them the current
+// version, as one attempt of Close
+func (writer *fileWriter) commitChunks(userdata *User) (err error) {
+	// The file has to still be deduplicated under the chunk key the chunks were cut with
+	chunked, _, err := CheckCanStore(userdata, writer.filename)
+	if err != nil {
+		return err
+	}
+	chunkTableStruct, chunkTableEncryptKey, chunkTableHMACKey, err := LoadChunkTable(userdata)
+	if err != nil {
+		return err
+	}
+	if !chunked || !userlib.HMACEqual(chunkTableStruct.Key, writer.chunkTableKey) {
+		return errors.New("file was replaced while it was being written")
+	}
+
+	// Count a reference to every chunk. A chunk the table does not count has to still be the one the writer stored.
+	entries := append([]IndexEntry{}, writer.entries...)
+	for i, entry := range entries {
+		ref, ok := chunkTableStruct.Chunks[entry.UUID]
+		if !ok {
+			value, ok := userdata.datastore.Get(entry.UUID)
+			if !ok {
+				return errors.New("file was replaced while it was being written")
+			}
+			_, msg, _, _, _, err := UnpackEnvelope(value)
+			if err != nil || !userlib.HMACEqual(userlib.Hash(msg), entry.Hash) {
+				return errors.New("file was replaced while it was being written")
+			}
+			ref.Hash = entry.Hash
+		}
+		entries[i].Hash = ref.Hash
+		ref.Refs++
+		chunkTableStruct.Chunks[entry.UUID] = ref
+	}
+	err = EncryptMacAndStore(userdata.datastore, userdata.ChunkTable, RecordChunkTable, chunkTableStruct, chunkTableEncryptKey, chunkTableHMACKey)
+	if err != nil {
+		return err
+	}
+
+	// Index the chunks and make them the current version
+	records := make(map[userlib.UUID][]byte)
+	tree, err := BuildFileTree(records, writer.fileSourceKey, writer.compressed, entries)
+	if err != nil {
+		return err
+	}
+	err = userdata.datastore.SetBatch(records)
+	if err != nil {
+		return err
+	}
+	return StoreFileTree(userdata, writer.filename, tree)
+}
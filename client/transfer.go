@@ -0,0 +1,606 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// An owner hands a file to another user with TransferOwnership. That seals everything the owner
+// access struct holds in an offer to the new owner, who takes it with AcceptOwnership, under a
+// filename of their choice or the one they already have the file under. Until then nothing
+// changes and the old owner stays the owner; transferring again replaces the offer and revoking
+// withdraws it, since revoking moves the file to keys the offer does not have.
+//
+// Accepting moves the invitation list to a UUID and key only the new owner knows, and puts the
+// old owner under the new owner in the share tree as a writer, at a node the old owner picked
+// and signed as accepted in the offer. The old owner's access struct cannot be written by the new owner, so the old
+// owner turns it into a sharee's the next time they load it and find that node, see LoadAccess.
+// The new owner can then remove the old owner altogether with RevokeAccess. Every other sharee
+// keeps their node, and with it their access; the users the old owner invited stay on the
+// invitation list, which records the old owner among its earlier Owners, so revoking the old
+// owner leaves them be. If the new owner was a sharee before, their node is dropped and the
+// users they invited move up to the invitation list.
+//
+// Deduplication is turned off for the file: its chunks stay counted in the old owner's chunk
+// table, which the new owner cannot reach, so they are never released from under the file.
+//
+// Sharees have to know who owns the file to trust the forwards an owner leaves them when
+// revoking, see forward.go. The old owner signs a handover naming the new owner and the number
+// of the transfer into the offer. Accepting keeps the handover on the invitation list and stores
+// a copy at a UUID derived from the file and that number, and once that committed the new owner
+// claims the number for the file in the keystore, which nobody can overwrite. The keystore is
+// not part of a transaction, so claiming any earlier could leave a claim behind for an accept
+// that never went through. Should the new owner stop before claiming, LoadAccess claims the
+// number the next time they load the file. VerifyOwner walks the handovers from the creator of
+// the file and only accepts them if no later transfer was both stored and claimed, so an earlier
+// owner cannot pass off an older list of handovers as the current one.
+
+// Handover is signed by an owner to hand the file to the next one.
+type Handover struct {
+	Owner string
+	Sig   []byte
+}
+
+// HandoverRecord is what the owner signs in a handover, Epoch is the number of the transfer.
+type HandoverRecord struct {
+	Epoch int
+	Owner string
+}
+
+// PendingTransfer is what the owner access struct remembers of a transfer it offered.
+type PendingTransfer struct {
+	Ptr           userlib.UUID // the offer
+	NodeUUID      userlib.UUID // the node the new owner puts the old owner at once they accept
+	NodeSourcekey []byte
+}
+
+// TransferOffer is sealed for the new owner by TransferOwnership.
+type TransferOffer struct {
+	Sender         string
+	MetaUUID       userlib.UUID
+	MetaSourcekey  []byte
+	Grant          FileGrant
+	InvitationList userlib.UUID
+	ListKey        []byte
+	NodeUUID       userlib.UUID
+	NodeSourcekey  []byte
+	NodeAcceptSig  []byte   // the sender's acceptance of that node, see sharing.go
+	Handover       Handover // the sender's handover of the file to the new owner
+}
+
+func (userdata *User) TransferOwnership(filename string, newOwner string) (transferPtr uuid.UUID, err error) {
+	/*
+		Offers the ownership of filename to newOwner, who takes it with AcceptOwnership and the
+		returned pointer. The caller stays the owner until then, and becomes a writer below the
+		new owner afterwards.
+	*/
+	err = RetryOnConflict(userdata, func(attempt *User) (err error) {
+		transferPtr, err = attempt.transferOwnership(filename, newOwner)
+		return err
+	})
+	return transferPtr, err
+}
+
+func (userdata *User) transferOwnership(filename string, newOwner string) (transferPtr uuid.UUID, err error) {
+	// check the new owner exists and is someone else
+	_, ok := userdata.keystore.Get(newOwner + " public key")
+	if !ok {
+		return uuid.Nil, errors.New("new owner does not exist in the system")
+	}
+	if newOwner == userdata.Username {
+		return uuid.Nil, errors.New("user already owns the file")
+	}
+
+	// Get the access struct and check the user owns the file
+	accessUUID, accessStruct, accessEncryptKey, accessHMACKey, err := LoadAccess(userdata, filename)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if !accessStruct.IsOwner {
+		return uuid.Nil, errors.New("only the owner can transfer ownership")
+	}
+
+	// Get the handovers of the file so far
+	invitationListStruct, _, _, err := LoadInvitationList(userdata.datastore, accessStruct)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	// A new offer replaces one that was not accepted yet
+	if accessStruct.Transfer.Ptr != uuid.Nil {
+		err = userdata.datastore.Delete(accessStruct.Transfer.Ptr)
+		if err != nil {
+			return uuid.Nil, err
+		}
+	}
+
+	// Pick the node the user moves to, and seal the offer for the new owner
+	nodeSourceKey, err := GetRandomKey(userdata)
+	if err != nil {
+		return uuid.Nil, errors.New("failed to generate source key")
+	}
+	accessStruct.Transfer = PendingTransfer{Ptr: uuid.New(), NodeUUID: uuid.New(), NodeSourcekey: nodeSourceKey}
+	nodeAcceptSig, err := SignAcceptance(userdata, accessStruct.Transfer.NodeUUID, Invitation{Sharer: newOwner, Recipient: userdata.Username})
+	if err != nil {
+		return uuid.Nil, err
+	}
+	handover, err := SignHandover(userdata, accessStruct.MetaUUID, len(invitationListStruct.Handovers)+1, newOwner)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	offer := TransferOffer{
+		Sender:         userdata.Username,
+		MetaUUID:       accessStruct.MetaUUID,
+		MetaSourcekey:  accessStruct.MetaSourcekey,
+		Grant:          accessStruct.Grant,
+		InvitationList: accessStruct.InvitationList,
+		ListKey:        accessStruct.ListKey,
+		NodeUUID:       accessStruct.Transfer.NodeUUID,
+		NodeSourcekey:  nodeSourceKey,
+		NodeAcceptSig:  nodeAcceptSig,
+		Handover:       handover,
+	}
+	offerValue, err := SealForUser(userdata, newOwner, RecordTransferOffer, accessStruct.Transfer.Ptr, offer)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	err = userdata.datastore.Set(accessStruct.Transfer.Ptr, offerValue)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	// remember the offer in the owner struct
+	err = EncryptMacAndStore(userdata.datastore, accessUUID, RecordAccess, accessStruct, accessEncryptKey, accessHMACKey)
+	if err != nil {
+		return uuid.Nil, errors.New("failed to store owner struct")
+	}
+	return accessStruct.Transfer.Ptr, nil
+}
+
+func (userdata *User) AcceptOwnership(senderUsername string, transferPtr uuid.UUID, filename string) error {
+	/*
+		Takes the ownership of a file senderUsername offered with TransferOwnership, and stores it as
+		filename. A user who already has the file has to accept it under the same filename.
+	*/
+	var file userlib.UUID
+	var epoch int
+	err := RetryOnConflict(userdata, func(attempt *User) (err error) {
+		file, epoch, err = attempt.acceptOwnership(senderUsername, transferPtr, filename)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only claim the transfer once the file is the user's
+	return ClaimOwnership(userdata, file, epoch)
+}
+
+func (userdata *User) acceptOwnership(senderUsername string, transferPtr uuid.UUID, filename string) (file userlib.UUID, epoch int, err error) {
+	// Get the offer, decrypt it and check the sender signed it
+	offerValue, ok := userdata.datastore.Get(transferPtr)
+	if !ok {
+		return uuid.Nil, 0, errors.New("no ownership transfer, it was accepted or withdrawn")
+	}
+	var offer TransferOffer
+	signed, sig, err := OpenSealed(userdata, RecordTransferOffer, transferPtr, offerValue, &offer)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	if offer.Sender != senderUsername {
+		return uuid.Nil, 0, errors.New("ownership transfer was not sent by sender")
+	}
+	err = CheckSignature(userdata.keystore, signed, sig, senderUsername)
+	if err != nil {
+		return uuid.Nil, 0, errors.New("failed to verify ownership transfer signature")
+	}
+
+	// The invitation list and the meta have to open with the keys in the offer
+	ownerStruct := Access{
+		MetaUUID:       offer.MetaUUID,
+		MetaSourcekey:  offer.MetaSourcekey,
+		InvitationList: offer.InvitationList,
+		ListKey:        offer.ListKey,
+		IsOwner:        true,
+		Grant:          offer.Grant,
+	}
+	invitationListStruct, _, _, err := LoadInvitationList(userdata.datastore, ownerStruct)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant, err := LoadMeta(userdata, ownerStruct)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	shareTree, err := GetShareTree(userdata.datastore, invitationListStruct)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+
+	// The sender has to be the current owner and hand the file to the user
+	creator := FileCreator(invitationListStruct, senderUsername)
+	owner, err := WalkHandovers(userdata.keystore, offer.MetaUUID, creator, invitationListStruct.Handovers)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	epoch = len(invitationListStruct.Handovers) + 1
+	if owner != senderUsername || offer.Handover.Owner != userdata.Username {
+		return uuid.Nil, 0, errors.New("ownership transfer was not sent by the owner")
+	}
+	statement, err := HandoverStatement(offer.MetaUUID, epoch, userdata.Username)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	err = CheckSignature(userdata.keystore, statement, offer.Handover.Sig, senderUsername)
+	if err != nil {
+		return uuid.Nil, 0, errors.New("failed to verify ownership transfer signature")
+	}
+
+	// A file already at filename has to be this file, shared with the user
+	accessUUID, err := GetAccessUUID(*userdata, filename)
+	if err != nil {
+		return uuid.Nil, 0, errors.New("could not get access uuid")
+	}
+	var existing Access
+	if _, ok := userdata.datastore.Get(accessUUID); ok {
+		_, existing, _, _, err = LoadAccess(userdata, filename)
+		if err != nil {
+			return uuid.Nil, 0, err
+		}
+		if existing.IsOwner {
+			return uuid.Nil, 0, errors.New("recipient already has a file with the chosen filename")
+		}
+	}
+	nodes := make(map[userlib.UUID]ShareNode)
+	var ownNodes []ShareNode
+	for _, node := range shareTree {
+		nodes[node.InvitationUUID] = node
+		if node.Invitation.Recipient == userdata.Username {
+			ownNodes = append(ownNodes, node)
+		}
+	}
+	if existing.InvitationUUID != uuid.Nil {
+		if _, ok := nodes[existing.InvitationUUID]; !ok {
+			return uuid.Nil, 0, errors.New("recipient already has a file with the chosen filename")
+		}
+	}
+	for _, node := range ownNodes {
+		if node.Invitation.Accepted && node.InvitationUUID != existing.InvitationUUID {
+			return uuid.Nil, 0, errors.New("the file has to be accepted under the filename the recipient already has it as")
+		}
+	}
+
+	// Drop the user's own nodes, the users they invited move up to the invitation list
+	for _, node := range ownNodes {
+		if node.Parent == uuid.Nil {
+			delete(invitationListStruct.Invitations, node.InvitationUUID)
+		} else {
+			parent := nodes[node.Parent]
+			parentStruct, parentEncryptKey, parentHMACKey, err := LoadInvitation(userdata.datastore, parent.InvitationUUID, parent.Sourcekey)
+			if err != nil {
+				return uuid.Nil, 0, err
+			}
+			delete(parentStruct.Children, node.InvitationUUID)
+			err = EncryptMacAndStore(userdata.datastore, parent.InvitationUUID, RecordInvitation, parentStruct, parentEncryptKey, parentHMACKey)
+			if err != nil {
+				return uuid.Nil, 0, err
+			}
+		}
+		for childUUID, childSourceKey := range node.Invitation.Children {
+			invitationListStruct.Invitations[childUUID] = childSourceKey
+		}
+		doomed := []userlib.UUID{node.InvitationUUID}
+		if node.Invitation.Pointer != uuid.Nil && !node.Invitation.Consumed {
+			doomed = append(doomed, node.Invitation.Pointer)
+		}
+		err = userdata.datastore.DeleteBatch(doomed)
+		if err != nil {
+			return uuid.Nil, 0, err
+		}
+	}
+
+	// Put the old owner below the user as a writer, at the node they picked
+	oldOwnerStruct := Invitation{
+		MetaUUID:      offer.MetaUUID,
+		MetaSourcekey: offer.MetaSourcekey,
+		Creator:       creator,
+		Sharer:        userdata.Username,
+		Recipient:     senderUsername,
+		Accepted:      true,
+		Consumed:      true,
+		Grant:         offer.Grant,
+		AcceptSig:     offer.NodeAcceptSig,
+	}
+	err = SignGrant(userdata, offer.NodeUUID, &oldOwnerStruct)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	err = StoreInvitation(userdata.datastore, offer.NodeUUID, offer.NodeSourcekey, oldOwnerStruct)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	invitationListStruct.Invitations[offer.NodeUUID] = offer.NodeSourcekey
+	invitationListStruct.Owners = append(invitationListStruct.Owners, senderUsername)
+
+	// Keep the handover with the invitation list and where sharees find it, see VerifyOwner
+	claimed, ok := userdata.keystore.Get(GetOwnerKeystoreKey(offer.MetaUUID, epoch))
+	verifyKey, known := userdata.keystore.Get(userdata.Username + " signature key")
+	if !known {
+		return uuid.Nil, 0, errors.New("could not get sign key")
+	}
+	if ok && !SameKey(claimed, verifyKey) {
+		return uuid.Nil, 0, errors.New("the file was already transferred to someone else")
+	}
+	invitationListStruct.Handovers = append(invitationListStruct.Handovers, offer.Handover)
+	err = StoreHandover(userdata.datastore, offer.MetaUUID, epoch, offer.Handover)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+
+	// Forwards the old owner left that were not followed yet have to be signed by the new owner
+	sourceKeys := make(map[userlib.UUID][]byte)
+	for _, node := range shareTree {
+		if node.Invitation.Recipient != userdata.Username && !node.Invitation.Revoked {
+			sourceKeys[node.InvitationUUID] = node.Sourcekey
+		}
+	}
+	forwards, forwardValues, err := ResealForwards(userdata, invitationListStruct.Forwards, shareTree, sourceKeys, invitationListStruct.Handovers)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	err = userdata.datastore.SetBatch(forwardValues)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	invitationListStruct.Forwards = forwards
+
+	// Move the invitation list to a UUID and key the old owner does not know
+	ownerStruct.InvitationList = uuid.New()
+	ownerStruct.ListKey, err = GetRandomKey(userdata)
+	if err != nil {
+		return uuid.Nil, 0, errors.New("failed to generate invitation list key")
+	}
+	invitationListEncryptKey, invitationListHMACKey, err := GetTwoHASHKDFKeys(ownerStruct.ListKey, ENCRYPT, MAC)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	err = EncryptMacAndStore(userdata.datastore, ownerStruct.InvitationList, RecordInvitationList, invitationListStruct, invitationListEncryptKey, invitationListHMACKey)
+	if err != nil {
+		return uuid.Nil, 0, errors.New("failed to store invitation list")
+	}
+	err = userdata.datastore.DeleteBatch([]userlib.UUID{offer.InvitationList, transferPtr})
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+
+	// The chunks of a deduplicated file stay with the old owner's chunk table
+	if metaStruct.Deduplicated {
+		metaStruct.Deduplicated = false
+		err = StoreMeta(userdata, metaUUID, metaStruct, metaEncryptKey, metaHMACKey, grant)
+		if err != nil {
+			return uuid.Nil, 0, err
+		}
+	}
+
+	// Store the owner struct at filename and record the file in the user's file index
+	ownerStruct.Epoch = epoch
+	accessSourceKey, err := GetAccessKey(userdata.sourceKey, filename)
+	if err != nil {
+		return uuid.Nil, 0, errors.New("access source key cannot be generated")
+	}
+	accessEncryptKey, accessHMACKey, err := GetTwoHASHKDFKeys(accessSourceKey, ENCRYPT, MAC)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	err = EncryptMacAndStore(userdata.datastore, accessUUID, RecordAccess, ownerStruct, accessEncryptKey, accessHMACKey)
+	if err != nil {
+		return uuid.Nil, 0, errors.New("failed to store owner struct")
+	}
+	err = AddToFileIndex(userdata, filename, true)
+	if err != nil {
+		return uuid.Nil, 0, err
+	}
+	return offer.MetaUUID, epoch, nil
+}
+
+// turns the owner struct of a transferred file into a sharee's once the new owner put the old owner
+// at the node of the transfer, and returns the struct to use
+func CompleteTransfer(userdata *User, filename string, accessUUID userlib.UUID, accessStruct Access, accessEncryptKey, accessHMACKey []byte) (updated Access, err error) {
+	// The new owner may have revoked someone since, which moves the node to a new key
+	nodeSourceKey, followed, err := FollowForwards(userdata, accessStruct.Transfer.NodeUUID, accessStruct.Transfer.NodeSourcekey)
+	if err == ErrFileDeleted {
+		return accessStruct, nil
+	}
+	if err != nil {
+		return Access{}, err
+	}
+	if len(followed) == 0 {
+		_, _, _, err = LoadInvitation(userdata.datastore, accessStruct.Transfer.NodeUUID, nodeSourceKey)
+		if err == ErrFileDeleted {
+			return accessStruct, nil
+		}
+		if err != nil {
+			return Access{}, err
+		}
+	}
+
+	updated = Access{
+		InvitationUUID:      accessStruct.Transfer.NodeUUID,
+		InvitationSourcekey: nodeSourceKey,
+	}
+	err = EncryptMacAndStore(userdata.datastore, accessUUID, RecordAccess, updated, accessEncryptKey, accessHMACKey)
+	if err != nil {
+		return Access{}, errors.New("failed to store access struct")
+	}
+	err = userdata.datastore.DeleteBatch(followed)
+	if err != nil {
+		return Access{}, err
+	}
+	return updated, AddToFileIndex(userdata, filename, false)
+}
+
+// returns who created the file of the invitation list, the user asking when nobody owned it before them
+func FileCreator(invitationListStruct InvitationList, username string) (creator string) {
+	if len(invitationListStruct.Owners) > 0 {
+		return invitationListStruct.Owners[0]
+	}
+	return username
+}
+
+// returns the bytes an owner signs to hand the file with meta at file to owner in transfer number epoch
+func HandoverStatement(file userlib.UUID, epoch int, owner string) (statement []byte, err error) {
+	handoverBytes, err := json.Marshal(HandoverRecord{Epoch: epoch, Owner: owner})
+	if err != nil {
+		return nil, errors.New("failed to marshal handover")
+	}
+	return append(RecordAD(RecordTransferOffer, file), handoverBytes...), nil
+}
+
+// signs the handover of the file with meta at file to owner as transfer number epoch
+func SignHandover(userdata *User, file userlib.UUID, epoch int, owner string) (handover Handover, err error) {
+	statement, err := HandoverStatement(file, epoch, owner)
+	if err != nil {
+		return Handover{}, err
+	}
+	sig, err := userlib.DSSign(userdata.Sigkey, statement)
+	if err != nil {
+		return Handover{}, errors.New("failed to sign handover")
+	}
+	return Handover{Owner: owner, Sig: sig}, nil
+}
+
+// returns the keystore entry that records who took the file with meta at file in transfer number epoch
+func GetOwnerKeystoreKey(file userlib.UUID, epoch int) (key string) {
+	return file.String() + " owner " + strconv.Itoa(epoch)
+}
+
+// records the user as the owner who took the file in transfer number epoch, which is only
+// possible once. Claiming the same transfer again, when accepting is retried, succeeds.
+func ClaimOwnership(userdata *User, file userlib.UUID, epoch int) (err error) {
+	verifyKey, ok := userdata.keystore.Get(userdata.Username + " signature key")
+	if !ok {
+		return errors.New("could not get sign key")
+	}
+	key := GetOwnerKeystoreKey(file, epoch)
+	claimed, ok := userdata.keystore.Get(key)
+	if ok {
+		if !SameKey(claimed, verifyKey) {
+			return errors.New("the file was already transferred to someone else")
+		}
+		return nil
+	}
+	err = userdata.keystore.Set(key, verifyKey)
+	if err != nil {
+		return errors.New("failed to claim ownership of the file")
+	}
+	return nil
+}
+
+// walks the handovers of the file with meta at file from its creator and returns its current owner
+func VerifyOwner(keystore Keystore, datastore Datastore, file userlib.UUID, creator string, handovers []Handover) (owner string, err error) {
+	owner, err = WalkHandovers(keystore, file, creator, handovers)
+	if err != nil {
+		return "", err
+	}
+
+	// Nobody may have taken the file since. A claim without the handover stored is left from an
+	// accept that did not go through, and does not count.
+	epoch := len(handovers) + 1
+	claimed, ok := keystore.Get(GetOwnerKeystoreKey(file, epoch))
+	if !ok {
+		return owner, nil
+	}
+	handover, ok, err := LoadHandover(datastore, file, epoch)
+	if err != nil || !ok {
+		return owner, nil
+	}
+	statement, err := HandoverStatement(file, epoch, handover.Owner)
+	if err != nil {
+		return "", err
+	}
+	verifyKey, known := keystore.Get(handover.Owner + " signature key")
+	if known && SameKey(claimed, verifyKey) && CheckSignature(keystore, statement, handover.Sig, owner) == nil {
+		return "", errors.New("integrity check failed: ownership handovers are out of date")
+	}
+	return owner, nil
+}
+
+// returns the UUID the handover of the file with meta at file in transfer number epoch is kept at
+func GetHandoverUUID(file userlib.UUID, epoch int) (handoverUUID userlib.UUID, err error) {
+	handoverHash := userlib.Hash([]byte(GetOwnerKeystoreKey(file, epoch)))
+	handoverUUID, err = uuid.FromBytes(handoverHash[:LENGTH])
+	if err != nil {
+		return uuid.Nil, errors.New("failed to get handover UUID")
+	}
+	return handoverUUID, nil
+}
+
+// stores a copy of the handover of transfer number epoch, it carries its own signature
+func StoreHandover(datastore Datastore, file userlib.UUID, epoch int, handover Handover) (err error) {
+	handoverUUID, err := GetHandoverUUID(file, epoch)
+	if err != nil {
+		return err
+	}
+	handoverBytes, err := json.Marshal(handover)
+	if err != nil {
+		return errors.New("failed to marshal handover")
+	}
+	return datastore.Set(handoverUUID, PackEnvelope(RecordHandover, handoverBytes, nil, nil))
+}
+
+// loads the copy of the handover of transfer number epoch, ok is false if none is stored. The
+// caller has to check its signature.
+func LoadHandover(datastore Datastore, file userlib.UUID, epoch int) (handover Handover, ok bool, err error) {
+	handoverUUID, err := GetHandoverUUID(file, epoch)
+	if err != nil {
+		return Handover{}, false, err
+	}
+	value, ok := datastore.Get(handoverUUID)
+	if !ok {
+		return Handover{}, false, nil
+	}
+	recordType, msg, _, _, legacy, err := UnpackEnvelope(value)
+	if err != nil || legacy || recordType != RecordHandover {
+		return Handover{}, false, errors.New("integrity check failed: handover has been tampered with")
+	}
+	err = json.Unmarshal(msg, &handover)
+	if err != nil {
+		return Handover{}, false, errors.New("integrity check failed: handover has been tampered with")
+	}
+	return handover, true, nil
+}
+
+// checks every handover of the file with meta at file from its creator on, and returns who the last one
+// names. Unlike VerifyOwner it does not check that the file was not transferred after the last one.
+func WalkHandovers(keystore Keystore, file userlib.UUID, creator string, handovers []Handover) (owner string, err error) {
+	owner = creator
+	for i, handover := range handovers {
+		epoch := i + 1
+
+		// The owner so far has to have signed the handover, and the next owner to have claimed it
+		statement, err := HandoverStatement(file, epoch, handover.Owner)
+		if err != nil {
+			return "", err
+		}
+		err = CheckSignature(keystore, statement, handover.Sig, owner)
+		if err != nil {
+			return "", errors.New("integrity check failed: ownership handover was not signed by the owner")
+		}
+		claimed, ok := keystore.Get(GetOwnerKeystoreKey(file, epoch))
+		verifyKey, known := keystore.Get(handover.Owner + " signature key")
+		if !ok || !known || !SameKey(claimed, verifyKey) {
+			return "", errors.New("integrity check failed: ownership handover was not claimed by the owner")
+		}
+		owner = handover.Owner
+	}
+	return owner, nil
+}
+
+// reports whether two keystore entries hold the same public key
+func SameKey(a, b userlib.PublicKeyType) bool {
+	return a.KeyType == b.KeyType && a.PubKey.E == b.PubKey.E && a.PubKey.N != nil && b.PubKey.N != nil && a.PubKey.N.Cmp(b.PubKey.N) == 0
+}
@@ -7,6 +7,7 @@ import (
 	// Some imports use an underscore to prevent the compiler from complaining
 	// about unused imports.
 	_ "encoding/hex"
+	"errors"
 	_ "errors"
 	_ "strconv"
 	_ "strings"
@@ -35,6 +36,277 @@ func contains(slice []userlib.UUID, value userlib.UUID) bool {
 	return false
 }
 
+// Durations in nanoseconds, which convert to the time.Duration the client takes.
+const (
+	second = 1000 * 1000 * 1000
+	minute = 60 * second
+	hour   = 60 * minute
+)
+
+// readAll reads from reader until it fails, and returns everything read. Running out of data
+// ends the read without an error.
+func readAll(reader interface{ Read([]byte) (int, error) }) (data []byte, err error) {
+	buf := make([]byte, 512)
+	for {
+		n, err := reader.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == client.ErrEndOfFile {
+			return data, nil
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+}
+
+// mapDatastore is a minimal client.Datastore used to check that the client
+// only touches the backend it was constructed with. Setting writesLeft simulates
+// a crash: every write after the first writesLeft ones fails. Setting beforeWrite
+// runs it once, just before the next write, as another session would.
+type mapDatastore struct {
+	entries     map[userlib.UUID][]byte
+	writesLeft  int
+	sequence    uint64
+	beforeWrite func()
+}
+
+func newMapDatastore() *mapDatastore {
+	return &mapDatastore{entries: make(map[userlib.UUID][]byte), writesLeft: -1}
+}
+
+func (store *mapDatastore) interleave() {
+	if hook := store.beforeWrite; hook != nil {
+		store.beforeWrite = nil
+		hook()
+	}
+}
+
+func (store *mapDatastore) write() error {
+	if store.writesLeft == 0 {
+		return errors.New("simulated crash")
+	}
+	if store.writesLeft > 0 {
+		store.writesLeft--
+	}
+	store.sequence++
+	return nil
+}
+
+func (store *mapDatastore) Get(key userlib.UUID) (value []byte, ok bool) {
+	value, ok = store.entries[key]
+	return
+}
+
+func (store *mapDatastore) Set(key userlib.UUID, value []byte) error {
+	store.interleave()
+	if err := store.write(); err != nil {
+		return err
+	}
+	store.entries[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (store *mapDatastore) Delete(key userlib.UUID) error {
+	store.interleave()
+	if err := store.write(); err != nil {
+		return err
+	}
+	delete(store.entries, key)
+	return nil
+}
+
+func (store *mapDatastore) GetBatch(keys []userlib.UUID) map[userlib.UUID][]byte {
+	values := make(map[userlib.UUID][]byte)
+	for _, key := range keys {
+		if value, ok := store.entries[key]; ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func (store *mapDatastore) SetBatch(entries map[userlib.UUID][]byte) error {
+	store.interleave()
+	if err := store.write(); err != nil {
+		return err
+	}
+	for key, value := range entries {
+		store.entries[key] = append([]byte{}, value...)
+	}
+	return nil
+}
+
+func (store *mapDatastore) DeleteBatch(keys []userlib.UUID) error {
+	store.interleave()
+	if err := store.write(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		delete(store.entries, key)
+	}
+	return nil
+}
+
+func (store *mapDatastore) Sequence() uint64 {
+	return store.sequence
+}
+
+func (store *mapDatastore) CompareAndSetBatch(sequence uint64, entries map[userlib.UUID][]byte) (bool, error) {
+	store.interleave()
+	if store.sequence != sequence {
+		return false, nil
+	}
+	if len(entries) == 0 {
+		return true, nil
+	}
+	if err := store.write(); err != nil {
+		return false, err
+	}
+	for key, value := range entries {
+		if value == nil {
+			delete(store.entries, key)
+		} else {
+			store.entries[key] = append([]byte{}, value...)
+		}
+	}
+	return true, nil
+}
+
+// testBackend is a datastore the main suite runs against. reset is called before every spec and
+// points InitUser and GetUser at a fresh datastore of the backend.
+type testBackend struct {
+	name  string
+	reset func()
+}
+
+// the userlib datastore functions, as the specs of the userlib backend find them
+var userlibGet, userlibSet, userlibDelete = userlib.DatastoreGet, userlib.DatastoreSet, userlib.DatastoreDelete
+
+// userlibBackend is the userlib map InitUser and GetUser use by default.
+var userlibBackend = testBackend{name: "userlib", reset: func() {
+	client.DefaultDatastore = client.UserlibDatastore{}
+}}
+
+// fileBackend is a FileDatastore in a fresh log for every spec. Specs inspect and tamper with
+// the datastore through userlib, so while it is in use everything written to the log is
+// mirrored into the userlib map, and the userlib functions that read and write single records
+// read and write the log instead.
+var fileBackend = testBackend{name: "FileDatastore", reset: func() {
+	file, err := client.OpenFileDatastore(GinkgoT().TempDir() + "/datastore.log")
+	Expect(err).To(BeNil())
+	store := &mirroredDatastore{file: file, lock: make(chan struct{}, 1)}
+	client.DefaultDatastore = store
+	userlib.DatastoreGet = store.Get
+	userlib.DatastoreSet = func(key userlib.UUID, value []byte) { store.Set(key, value) }
+	userlib.DatastoreDelete = func(key userlib.UUID) { store.Delete(key) }
+	DeferCleanup(func() {
+		userlib.DatastoreGet, userlib.DatastoreSet, userlib.DatastoreDelete = userlibGet, userlibSet, userlibDelete
+		client.DefaultDatastore = client.UserlibDatastore{}
+		Expect(file.Close()).To(BeNil())
+	})
+}}
+
+// mirroredDatastore is a FileDatastore whose every write is mirrored into the userlib map, and
+// whose reads count towards the userlib bandwidth like reads of the map do.
+type mirroredDatastore struct {
+	file *client.FileDatastore
+	lock chan struct{} // held while the log and the map are out of step
+}
+
+func (store *mirroredDatastore) acquire() { store.lock <- struct{}{} }
+func (store *mirroredDatastore) release() { <-store.lock }
+
+func (store *mirroredDatastore) Get(key userlib.UUID) (value []byte, ok bool) {
+	store.acquire()
+	defer store.release()
+	value, ok = store.file.Get(key)
+	if ok {
+		userlibGet(key)
+	}
+	return value, ok
+}
+
+func (store *mirroredDatastore) Set(key userlib.UUID, value []byte) error {
+	store.acquire()
+	defer store.release()
+	if err := store.file.Set(key, value); err != nil {
+		return err
+	}
+	userlibSet(key, value)
+	return nil
+}
+
+func (store *mirroredDatastore) Delete(key userlib.UUID) error {
+	store.acquire()
+	defer store.release()
+	if err := store.file.Delete(key); err != nil {
+		return err
+	}
+	userlibDelete(key)
+	return nil
+}
+
+func (store *mirroredDatastore) GetBatch(keys []userlib.UUID) map[userlib.UUID][]byte {
+	store.acquire()
+	defer store.release()
+	values := store.file.GetBatch(keys)
+	for key := range values {
+		userlibGet(key)
+	}
+	return values
+}
+
+func (store *mirroredDatastore) SetBatch(entries map[userlib.UUID][]byte) error {
+	store.acquire()
+	defer store.release()
+	if err := store.file.SetBatch(entries); err != nil {
+		return err
+	}
+	for key, value := range entries {
+		userlibSet(key, value)
+	}
+	return nil
+}
+
+func (store *mirroredDatastore) DeleteBatch(keys []userlib.UUID) error {
+	store.acquire()
+	defer store.release()
+	if err := store.file.DeleteBatch(keys); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		userlibDelete(key)
+	}
+	return nil
+}
+
+func (store *mirroredDatastore) Sequence() uint64 {
+	return store.file.Sequence()
+}
+
+func (store *mirroredDatastore) CompareAndSetBatch(sequence uint64, entries map[userlib.UUID][]byte) (bool, error) {
+	store.acquire()
+	defer store.release()
+	swapped, err := store.file.CompareAndSetBatch(sequence, entries)
+	if !swapped || err != nil {
+		return swapped, err
+	}
+	for key, value := range entries {
+		if value == nil {
+			userlibDelete(key)
+		} else {
+			userlibSet(key, value)
+		}
+	}
+	return true, nil
+}
+
+func (store *mirroredDatastore) Purge() error {
+	store.acquire()
+	defer store.release()
+	return store.file.Purge()
+}
+
 func TestSetupAndExecution(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Client Tests")
@@ -56,15 +328,24 @@ const contentThree = "cryptocurrency!"
 // ================================================
 
 var _ = Describe("Client Tests", func() {
+	describeClientTests(userlibBackend)
+})
+
+var _ = Describe("Client Tests on "+fileBackend.name, func() {
+	describeClientTests(fileBackend)
+})
+
+// describeClientTests adds the specs of the main suite, run against backend
+func describeClientTests(backend testBackend) {
 
 	// A few user declarations that may be used for testing. Remember to initialize these before you
 	// attempt to use them!
 	var alice *client.User
 	var bob *client.User
 	var charles *client.User
-	// var doris *client.User
-	// var eve *client.User
-	// var frank *client.User
+	var doris *client.User
+	var eve *client.User
+	var frank *client.User
 	// var grace *client.User
 	// var horace *client.User
 	// var ira *client.User
@@ -81,9 +362,9 @@ var _ = Describe("Client Tests", func() {
 	aliceFile := "aliceFile.txt"
 	bobFile := "bobFile.txt"
 	charlesFile := "charlesFile.txt"
-	// dorisFile := "dorisFile.txt"
-	// eveFile := "eveFile.txt"
-	// frankFile := "frankFile.txt"
+	dorisFile := "dorisFile.txt"
+	eveFile := "eveFile.txt"
+	frankFile := "frankFile.txt"
 	// graceFile := "graceFile.txt"
 	// horaceFile := "horaceFile.txt"
 	// iraFile := "iraFile.txt"
@@ -94,6 +375,7 @@ var _ = Describe("Client Tests", func() {
 		// We also initialize
 		userlib.DatastoreClear()
 		userlib.KeystoreClear()
+		backend.reset()
 	})
 
 	// Todo: - integrity check for invitations, append to file
@@ -432,6 +714,41 @@ var _ = Describe("Client Tests", func() {
 			Expect(data).To(Equal([]byte(contentTwo)))
 		})
 
+		Specify("StoreFile Test: Overwriting a file reclaims the old appended blocks", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Storing file data: %s, keeping no old versions", contentOne)
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.SetVersionRetention(aliceFile, 1)
+			Expect(err).To(BeNil())
+			entriesAfterStore := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("Appending to the file repeatedly.")
+			for i := 0; i < 10; i++ {
+				err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+			}
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(entriesAfterStore + 10))
+
+			userlib.DebugMsg("Overwriting file data: %s", contentThree)
+			err = alice.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(entriesAfterStore))
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+
+			err = alice.AppendToFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree + contentOne)))
+		})
+
 		Specify("StoreFile Test: Attempt to store file with empty filename", func() {
 			userlib.DebugMsg("Initializing user Alice.")
 			alice, err = client.InitUser("alice", defaultPassword)
@@ -808,6 +1125,58 @@ var _ = Describe("Client Tests", func() {
 			Expect(err).To(BeNil())
 		})
 
+		Specify("RevokeAccess: Testing the pre-revocation blocks are destroyed", func() {
+			userlib.DebugMsg("Initializing Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			var keysBefore []userlib.UUID
+			for key := range userlib.DatastoreGetMap() {
+				keysBefore = append(keysBefore, key)
+			}
+
+			userlib.DebugMsg("Alice storing a file made of three blocks.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			// access struct, meta, invitation list, index node and three blocks
+			var fileKeys []userlib.UUID
+			for key := range userlib.DatastoreGetMap() {
+				if !contains(keysBefore, key) {
+					fileKeys = append(fileKeys, key)
+				}
+			}
+			Expect(fileKeys).To(HaveLen(7))
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice revoking Bob.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Checking only the access struct and meta survive, the invitation list moved.")
+			remaining := 0
+			for _, key := range fileKeys {
+				if _, ok := userlib.DatastoreGet(key); ok {
+					remaining++
+				}
+			}
+			Expect(remaining).To(Equal(2))
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+		})
+
 		Specify("RevokeAccess: Testing caller does not have access to file", func() {
 			userlib.DebugMsg("Initializing Alice.")
 			alice, err = client.InitUser("alice", defaultPassword)
@@ -866,136 +1235,3196 @@ var _ = Describe("Client Tests", func() {
 
 	})
 
-	//THEIR TESTS
-	Describe("Basic Tests", func() {
-
-		Specify("Basic Test: Testing InitUser/GetUser on a single user.", func() {
-			userlib.DebugMsg("Initializing user Alice.")
-			alice, err = client.InitUser("alice", defaultPassword)
-			Expect(err).To(BeNil())
+	Describe("Storage Backend Tests", func() {
+		Specify("Storage Test: Users constructed with a custom Datastore only write to it", func() {
+			datastore := newMapDatastore()
+			keystore := client.UserlibKeystore{}
 
-			userlib.DebugMsg("Getting user Alice.")
-			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			userlib.DebugMsg("Initializing users Alice and Bob on a custom datastore.")
+			alice, err = client.InitUserWithStorage("alice", defaultPassword, datastore, keystore)
 			Expect(err).To(BeNil())
-		})
-
-		Specify("Basic Test: Testing Single User Store/Load/Append.", func() {
-			userlib.DebugMsg("Initializing user Alice.")
-			alice, err = client.InitUser("alice", defaultPassword)
+			bob, err = client.InitUserWithStorage("bob", defaultPassword, datastore, keystore)
 			Expect(err).To(BeNil())
 
-			userlib.DebugMsg("Storing file data: %s", contentOne)
+			userlib.DebugMsg("Alice storing, appending and sharing %s with Bob.", aliceFile)
 			err = alice.StoreFile(aliceFile, []byte(contentOne))
 			Expect(err).To(BeNil())
-
-			userlib.DebugMsg("Appending file data: %s", contentTwo)
 			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
 			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
 
-			userlib.DebugMsg("Appending file data: %s", contentThree)
-			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			data, err := bob.LoadFile(bobFile)
 			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
 
-			userlib.DebugMsg("Loading file...")
-			data, err := alice.LoadFile(aliceFile)
+			userlib.DebugMsg("Checking that nothing was written to the userlib datastore.")
+			Expect(userlib.DatastoreGetMap()).To(BeEmpty())
+			Expect(datastore.entries).ToNot(BeEmpty())
+
+			userlib.DebugMsg("Checking that Alice cannot be found through the default datastore.")
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(err).ToNot(BeNil())
+
+			aliceLaptop, err = client.GetUserWithStorage("alice", defaultPassword, datastore, keystore)
 			Expect(err).To(BeNil())
-			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			data, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
 		})
 
-		Specify("Basic Test: Testing Create/Accept Invite Functionality with multiple users and multiple instances.", func() {
-			userlib.DebugMsg("Initializing users Alice (aliceDesktop) and Bob.")
-			aliceDesktop, err = client.InitUser("alice", defaultPassword)
-			Expect(err).To(BeNil())
+		Specify("Storage Test: FileDatastore keeps users, files and shares across restarts", func() {
+			path := GinkgoT().TempDir() + "/datastore.log"
+			keystore := client.UserlibKeystore{}
 
-			bob, err = client.InitUser("bob", defaultPassword)
+			userlib.DebugMsg("Opening a FileDatastore at %s.", path)
+			datastore, err := client.OpenFileDatastore(path)
 			Expect(err).To(BeNil())
 
-			userlib.DebugMsg("Getting second instance of Alice - aliceLaptop")
-			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			alice, err = client.InitUserWithStorage("alice", defaultPassword, datastore, keystore)
 			Expect(err).To(BeNil())
-
-			userlib.DebugMsg("aliceDesktop storing file %s with content: %s", aliceFile, contentOne)
-			err = aliceDesktop.StoreFile(aliceFile, []byte(contentOne))
+			bob, err = client.InitUserWithStorage("bob", defaultPassword, datastore, keystore)
 			Expect(err).To(BeNil())
-
-			userlib.DebugMsg("aliceLaptop creating invite for Bob.")
-			invite, err := aliceLaptop.CreateInvitation(aliceFile, "bob")
+			charles, err = client.InitUserWithStorage("charles", defaultPassword, datastore, keystore)
 			Expect(err).To(BeNil())
 
-			userlib.DebugMsg("Bob accepting invite from Alice under filename %s.", bobFile)
+			userlib.DebugMsg("Alice shares %s with Bob and Charles, then revokes Charles.", aliceFile)
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
 			err = bob.AcceptInvitation("alice", invite, bobFile)
 			Expect(err).To(BeNil())
-
-			userlib.DebugMsg("Bob appending to file %s, content: %s", bobFile, contentTwo)
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
 			err = bob.AppendToFile(bobFile, []byte(contentTwo))
 			Expect(err).To(BeNil())
-
-			userlib.DebugMsg("aliceDesktop appending to file %s, content: %s", aliceFile, contentThree)
-			err = aliceDesktop.AppendToFile(aliceFile, []byte(contentThree))
+			err = alice.RevokeAccess(aliceFile, "charles")
 			Expect(err).To(BeNil())
 
-			userlib.DebugMsg("Checking that aliceDesktop sees expected file data.")
-			data, err := aliceDesktop.LoadFile(aliceFile)
+			userlib.DebugMsg("Closing and reopening the datastore.")
+			Expect(datastore.Close()).To(BeNil())
+			datastore, err = client.OpenFileDatastore(path)
 			Expect(err).To(BeNil())
-			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			defer datastore.Close()
 
-			userlib.DebugMsg("Checking that aliceLaptop sees expected file data.")
-			data, err = aliceLaptop.LoadFile(aliceFile)
+			aliceLaptop, err = client.GetUserWithStorage("alice", defaultPassword, datastore, keystore)
+			Expect(err).To(BeNil())
+			bob, err = client.GetUserWithStorage("bob", defaultPassword, datastore, keystore)
+			Expect(err).To(BeNil())
+			charles, err = client.GetUserWithStorage("charles", defaultPassword, datastore, keystore)
 			Expect(err).To(BeNil())
-			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
 
-			userlib.DebugMsg("Checking that Bob sees expected file data.")
-			data, err = bob.LoadFile(bobFile)
+			err = aliceLaptop.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
 			Expect(err).To(BeNil())
 			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
 
-			userlib.DebugMsg("Getting third instance of Alice - alicePhone.")
-			alicePhone, err = client.GetUser("alice", defaultPassword)
-			Expect(err).To(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
 
-			userlib.DebugMsg("Checking that alicePhone sees Alice's changes.")
-			data, err = alicePhone.LoadFile(aliceFile)
+			userlib.DebugMsg("Compacting the log keeps every live record readable.")
+			for i := 0; i < 5; i++ {
+				err = aliceLaptop.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+			}
+			Expect(datastore.Compact()).To(BeNil())
+			data, err = bob.LoadFile(bobFile)
 			Expect(err).To(BeNil())
-			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			Expect(data).To(Equal([]byte(contentOne)))
 		})
+	})
 
-		Specify("Basic Test: Testing Revoke Functionality", func() {
-			userlib.DebugMsg("Initializing users Alice, Bob, and Charlie.")
+	Describe("DeleteFile Tests", func() {
+		Specify("DeleteFile Test: Owner delete removes every record of the file", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
 			alice, err = client.InitUser("alice", defaultPassword)
 			Expect(err).To(BeNil())
-
 			bob, err = client.InitUser("bob", defaultPassword)
 			Expect(err).To(BeNil())
+			entriesBefore := len(userlib.DatastoreGetMap())
 
-			charles, err = client.InitUser("charles", defaultPassword)
+			userlib.DebugMsg("Alice storing, appending and sharing %s.", aliceFile)
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
 			Expect(err).To(BeNil())
 
-			userlib.DebugMsg("Alice storing file %s with content: %s", aliceFile, contentOne)
-			alice.StoreFile(aliceFile, []byte(contentOne))
+			userlib.DebugMsg("Alice deleting %s.", aliceFile)
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).To(BeNil())
 
-			userlib.DebugMsg("Alice creating invite for Bob for file %s, and Bob accepting invite under name %s.", aliceFile, bobFile)
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
 
-			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			userlib.DebugMsg("Checking nothing is left behind, the invitation to Bob included, but the head of his inbox.")
+			_, ok := userlib.DatastoreGet(invite)
+			Expect(ok).To(BeFalse())
+			pending, err := bob.ListPendingInvitations()
 			Expect(err).To(BeNil())
-			//
+			Expect(pending).To(BeEmpty())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(entriesBefore + 1))
 			err = bob.AcceptInvitation("alice", invite, bobFile)
-			Expect(err).To(BeNil())
+			Expect(err).ToNot(BeNil())
 
-			userlib.DebugMsg("Checking that Alice can still load the file.")
+			userlib.DebugMsg("Alice can reuse the filename.")
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
 			data, err := alice.LoadFile(aliceFile)
 			Expect(err).To(BeNil())
-			Expect(data).To(Equal([]byte(contentOne)))
+			Expect(data).To(Equal([]byte(contentTwo)))
+		})
 
-			userlib.DebugMsg("Checking that Bob can load the file.")
-			data, err = bob.LoadFile(bobFile)
+		Specify("DeleteFile Test: Owner delete cancels the invitations nobody accepted yet", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, Charles and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
 			Expect(err).To(BeNil())
-			Expect(data).To(Equal([]byte(contentOne)))
-
-			userlib.DebugMsg("Bob creating invite for Charles for file %s, and Charlie accepting invite under name %s.", bobFile, charlesFile)
-			invite, err = bob.CreateInvitation(bobFile, "charles")
+			bob, err = client.InitUser("bob", defaultPassword)
 			Expect(err).To(BeNil())
-
-			err = charles.AcceptInvitation("bob", invite, charlesFile)
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice invites Bob and Doris, Bob accepts and invites Charles.")
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			Expect(doris.StoreFile(dorisFile, []byte(contentTwo))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			charlesInvite, err := bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			dorisInvite, err := alice.CreateInvitation(aliceFile, "doris")
+			Expect(err).To(BeNil())
+			otherInvite, err := doris.CreateInvitation(dorisFile, "charles")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice deletes the file, both invitations are gone.")
+			Expect(alice.DeleteFile(aliceFile)).To(BeNil())
+			for _, invitationPtr := range []uuid.UUID{charlesInvite, dorisInvite} {
+				_, ok := userlib.DatastoreGet(invitationPtr)
+				Expect(ok).To(BeFalse())
+			}
+			Expect(charles.AcceptInvitation("bob", charlesInvite, charlesFile)).ToNot(BeNil())
+			Expect(doris.AcceptInvitation("alice", dorisInvite, aliceFile)).ToNot(BeNil())
+
+			userlib.DebugMsg("They drop out of the inboxes, invitations to other files are left alone.")
+			pending, err := charles.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			Expect(pending[0].InvitationPtr).To(Equal(otherInvite))
+			pending, err = doris.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(BeEmpty())
+		})
+
+		Specify("DeleteFile Test: Sharees see a file deleted error after the owner deletes", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("bob", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice deleting %s.", aliceFile)
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).To(BeNil())
+
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).To(MatchError(client.ErrFileDeleted))
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(MatchError(client.ErrFileDeleted))
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).To(MatchError(client.ErrFileDeleted))
+
+			userlib.DebugMsg("Bob can still clear the dangling entry from his namespace.")
+			err = bob.DeleteFile(bobFile)
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			Expect(err).ToNot(MatchError(client.ErrFileDeleted))
+		})
+
+		Specify("DeleteFile Test: Sharee delete only removes their own access", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob deleting %s.", bobFile)
+			err = bob.DeleteFile(bobFile)
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Deleting a file that does not exist returns an error.")
+			err = bob.DeleteFile(bobFile)
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("ChangePassword Tests", func() {
+		Specify("ChangePassword Test: Files stay reachable under the new password only", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice owns %s and has %s shared from Bob.", aliceFile, bobFile)
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := bob.CreateInvitation(bobFile, "alice")
+			Expect(err).To(BeNil())
+			err = alice.AcceptInvitation("bob", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, aliceFile)
+			Expect(err).To(BeNil())
+			entriesBefore := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("Changing Alice's password with the wrong old password fails.")
+			err = alice.ChangePassword("wrong", "newPassword")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Changing Alice's password.")
+			err = alice.ChangePassword(defaultPassword, "newPassword")
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(entriesBefore))
+
+			_, err = client.GetUser("alice", defaultPassword)
+			Expect(err).ToNot(BeNil())
+			aliceLaptop, err = client.GetUser("alice", "newPassword")
+			Expect(err).To(BeNil())
+
+			for _, session := range []*client.User{alice, aliceLaptop} {
+				data, err := session.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne)))
+				data, err = session.LoadFile(bobFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentTwo)))
+			}
+
+			userlib.DebugMsg("Sharing and revocation keep working after the change.")
+			err = aliceLaptop.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = aliceLaptop.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(aliceFile)
+			Expect(err).To(MatchError(client.ErrAccessRevoked))
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo + contentThree)))
+		})
+
+		Specify("ChangePassword Test: Invitations sent before the change are found again after it", func() {
+			userlib.DebugMsg("Alice shares with Bob, then changes her password.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			Expect(alice.ChangePassword(defaultPassword, "newPassword")).To(BeNil())
+
+			userlib.DebugMsg("Re-inviting Bob changes the node he has instead of adding another.")
+			invite, err = alice.CreateInvitationWithPermission(aliceFile, "bob", client.PermissionRead)
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, charlesFile)).To(BeNil())
+			entries, err := alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Username).To(Equal("bob"))
+			Expect(entries[0].Permission).To(Equal(client.PermissionRead))
+			Expect(bob.AppendToFile(bobFile, []byte(contentTwo))).To(MatchError(client.ErrReadOnly))
+
+			userlib.DebugMsg("Revoking Bob still reaches his only node.")
+			Expect(alice.RevokeAccess(aliceFile, "bob")).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			entries, err = alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+		})
+
+		Specify("ChangePassword Test: A file another session stores during the change is moved too", func() {
+			keystore := client.UserlibKeystore{}
+			datastore := newMapDatastore()
+			alice, err = client.InitUserWithStorage("alice", defaultPassword, datastore, keystore)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			aliceLaptop, err = client.GetUserWithStorage("alice", defaultPassword, datastore, keystore)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("aliceLaptop stores %s while alice changes the password.", bobFile)
+			datastore.beforeWrite = func() {
+				Expect(aliceLaptop.StoreFile(bobFile, []byte(contentTwo))).To(BeNil())
+			}
+			Expect(alice.ChangePassword(defaultPassword, "newPassword")).To(BeNil())
+			Expect(datastore.beforeWrite).To(BeNil())
+
+			userlib.DebugMsg("Both files are there under the new password.")
+			aliceLaptop, err = client.GetUserWithStorage("alice", "newPassword", datastore, keystore)
+			Expect(err).To(BeNil())
+			for filename, content := range map[string]string{aliceFile: contentOne, bobFile: contentTwo} {
+				data, err := aliceLaptop.LoadFile(filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(content)))
+			}
+			_, err = client.GetUserWithStorage("alice", defaultPassword, datastore, keystore)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("ChangePassword Test: A crash leaves the account usable under one of the passwords", func() {
+			keystore := client.UserlibKeystore{}
+			for writes := 0; writes <= 3; writes++ {
+				datastore := newMapDatastore()
+				userlib.KeystoreClear()
+
+				alice, err = client.InitUserWithStorage("alice", defaultPassword, datastore, keystore)
+				Expect(err).To(BeNil())
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				err = alice.StoreFile(bobFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+
+				userlib.DebugMsg("Crashing ChangePassword after %d writes.", writes)
+				datastore.writesLeft = writes
+				_ = alice.ChangePassword(defaultPassword, "newPassword")
+				datastore.writesLeft = -1
+
+				aliceLaptop, err = client.GetUserWithStorage("alice", defaultPassword, datastore, keystore)
+				if err != nil {
+					aliceLaptop, err = client.GetUserWithStorage("alice", "newPassword", datastore, keystore)
+				}
+				Expect(err).To(BeNil())
+				data, err := aliceLaptop.LoadFile(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne)))
+				data, err = aliceLaptop.LoadFile(bobFile)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentTwo)))
+			}
+		})
+	})
+
+	Describe("ListFiles Tests", func() {
+		Specify("ListFiles Test: Owned and shared files are listed across sessions", func() {
+			userlib.DebugMsg("Initializing users Alice (aliceDesktop) and Bob.")
+			aliceDesktop, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			files, err := bob.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(BeEmpty())
+
+			userlib.DebugMsg("aliceDesktop storing %s and %s.", aliceFile, charlesFile)
+			err = aliceDesktop.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = aliceDesktop.StoreFile(charlesFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = aliceDesktop.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob storing %s and accepting %s.", bobFile, aliceFile)
+			err = bob.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := aliceDesktop.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, "fromAlice.txt")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Checking aliceLaptop sees the files created on aliceDesktop.")
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			files, err = aliceLaptop.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]client.FileInfo{
+				{Filename: aliceFile, IsOwner: true},
+				{Filename: charlesFile, IsOwner: true},
+			}))
+
+			files, err = bob.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]client.FileInfo{
+				{Filename: bobFile, IsOwner: true},
+				{Filename: "fromAlice.txt", IsOwner: false},
+			}))
+
+			userlib.DebugMsg("Deleting files removes them from the listing.")
+			err = bob.DeleteFile("fromAlice.txt")
+			Expect(err).To(BeNil())
+			err = aliceLaptop.DeleteFile(charlesFile)
+			Expect(err).To(BeNil())
+
+			files, err = bob.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]client.FileInfo{{Filename: bobFile, IsOwner: true}}))
+			files, err = aliceDesktop.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]client.FileInfo{{Filename: aliceFile, IsOwner: true}}))
+		})
+	})
+
+	Describe("Share Tree Tests", func() {
+		// alice -> bob -> charles -> doris
+		//       -> eve -> frank
+		buildShareTree := func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, Charles, Doris, Eve, and Frank.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			eve, err = client.InitUser("eve", defaultPassword)
+			Expect(err).To(BeNil())
+			frank, err = client.InitUser("frank", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			share := func(sender *client.User, senderName, senderFile string, recipient *client.User, recipientName, recipientFile string) {
+				userlib.DebugMsg("%s sharing %s with %s as %s.", senderName, senderFile, recipientName, recipientFile)
+				invite, err := sender.CreateInvitation(senderFile, recipientName)
+				Expect(err).To(BeNil())
+				err = recipient.AcceptInvitation(senderName, invite, recipientFile)
+				Expect(err).To(BeNil())
+			}
+			share(alice, "alice", aliceFile, bob, "bob", bobFile)
+			share(bob, "bob", bobFile, charles, "charles", charlesFile)
+			share(charles, "charles", charlesFile, doris, "doris", dorisFile)
+			share(alice, "alice", aliceFile, eve, "eve", eveFile)
+			share(eve, "eve", eveFile, frank, "frank", frankFile)
+		}
+
+		Specify("Share Tree Test: Revoking a direct child revokes their whole subtree only", func() {
+			buildShareTree()
+
+			userlib.DebugMsg("Alice revoking Bob.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Checking Bob, Charles, and Doris lost access.")
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).To(MatchError(client.ErrAccessRevoked))
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).To(MatchError(client.ErrAccessRevoked))
+			_, err = doris.LoadFile(dorisFile)
+			Expect(err).To(MatchError(client.ErrAccessRevoked))
+			err = doris.AppendToFile(dorisFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			_, err = charles.CreateInvitation(charlesFile, "alice")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Checking Eve and Frank kept access and see new changes.")
+			err = frank.AppendToFile(frankFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			for _, reader := range []struct {
+				user     *client.User
+				filename string
+			}{{alice, aliceFile}, {eve, eveFile}, {frank, frankFile}} {
+				data, err := reader.user.LoadFile(reader.filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			}
+		})
+
+		Specify("Share Tree Test: The owner can revoke a user invited by a sharee", func() {
+			buildShareTree()
+
+			userlib.DebugMsg("Alice revoking Charles, who was invited by Bob.")
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).To(MatchError(client.ErrAccessRevoked))
+			_, err = doris.LoadFile(dorisFile)
+			Expect(err).To(MatchError(client.ErrAccessRevoked))
+
+			userlib.DebugMsg("Checking Bob, Eve, and Frank kept access.")
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			for _, reader := range []struct {
+				user     *client.User
+				filename string
+			}{{alice, aliceFile}, {bob, bobFile}, {eve, eveFile}, {frank, frankFile}} {
+				data, err := reader.user.LoadFile(reader.filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			}
+
+			userlib.DebugMsg("Bob re-inviting Charles grants a fresh node.")
+			invite, err := bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("bob", invite, "charlesNewFile.txt")
+			Expect(err).To(BeNil())
+			data, err := charles.LoadFile("charlesNewFile.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Revoking Bob now also takes Charles' new node.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = charles.LoadFile("charlesNewFile.txt")
+			Expect(err).To(MatchError(client.ErrAccessRevoked))
+			_, err = frank.LoadFile(frankFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Share Tree Test: Invitations created by a sharee before acceptance are revoked with them", func() {
+			buildShareTree()
+
+			userlib.DebugMsg("Doris inviting Frank, who has not accepted yet.")
+			invite, err := doris.CreateInvitation(dorisFile, "frank")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice revoking Charles before Frank accepts Doris' invitation.")
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+
+			err = frank.AcceptInvitation("doris", invite, "frankFromDoris.txt")
+			Expect(err).To(MatchError(client.ErrAccessRevoked))
+			_, err = frank.LoadFile(frankFile)
+			Expect(err).To(BeNil())
+		})
+	})
+
+	Describe("Permission Tests", func() {
+		Specify("Permission Test: Readers can load but not change the file", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice sharing read only with Bob and read-write with Charles.")
+			invite, err := alice.CreateInvitationWithPermission(aliceFile, "bob", client.PermissionRead)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitationWithPermission(aliceFile, "charles", client.PermissionReadWrite)
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Checking the granted permissions.")
+			permission, err := alice.GetPermission(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(permission).To(Equal(client.PermissionReadWrite))
+			permission, err = bob.GetPermission(bobFile)
+			Expect(err).To(BeNil())
+			Expect(permission).To(Equal(client.PermissionRead))
+			permission, err = charles.GetPermission(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(permission).To(Equal(client.PermissionReadWrite))
+
+			userlib.DebugMsg("Checking Bob cannot store or append.")
+			err = bob.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(MatchError(client.ErrReadOnly))
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(MatchError(client.ErrReadOnly))
+
+			userlib.DebugMsg("Checking Charles can append and Bob sees the change.")
+			err = charles.AppendToFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Permission Test: Readers can only pass on read access", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitationWithPermission(aliceFile, "bob", client.PermissionRead)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob cannot hand out write access.")
+			_, err = bob.CreateInvitationWithPermission(bobFile, "charles", client.PermissionReadWrite)
+			Expect(err).To(MatchError(client.ErrReadOnly))
+
+			userlib.DebugMsg("A plain invitation from Bob passes on read access.")
+			invite, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("bob", invite, charlesFile)
+			Expect(err).To(BeNil())
+			permission, err := charles.GetPermission(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(permission).To(Equal(client.PermissionRead))
+			err = charles.AppendToFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(MatchError(client.ErrReadOnly))
+
+			userlib.DebugMsg("Alice upgrading Bob to read-write.")
+			invite, err = alice.CreateInvitationWithPermission(aliceFile, "bob", client.PermissionReadWrite)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Permission Test: Revoked writers can no longer sign the file", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			for _, recipient := range []struct {
+				user *client.User
+				name string
+				file string
+			}{{bob, "bob", bobFile}, {charles, "charles", charlesFile}} {
+				invite, err := alice.CreateInvitationWithPermission(aliceFile, recipient.name, client.PermissionReadWrite)
+				Expect(err).To(BeNil())
+				err = recipient.user.AcceptInvitation("alice", invite, recipient.file)
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Alice revoking Bob, Charles keeps writing under the new keys.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			err = charles.AppendToFile(charlesFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentThree)))
+		})
+	})
+
+	Describe("Version History Tests", func() {
+		Specify("Version Test: Every StoreFile keeps the previous content as a version", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice storing three versions, appending to the first.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			invite, err := alice.CreateInvitationWithPermission(aliceFile, "bob", client.PermissionRead)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Checking Alice and Bob see every version.")
+			for _, reader := range []struct {
+				user *client.User
+				file string
+			}{{alice, aliceFile}, {bob, bobFile}} {
+				versions, err := reader.user.ListVersions(reader.file)
+				Expect(err).To(BeNil())
+				Expect(versions).To(Equal([]int{1, 2, 3}))
+				data, err := reader.user.LoadFileVersion(reader.file, 1)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+				data, err = reader.user.LoadFileVersion(reader.file, 2)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentTwo)))
+				data, err = reader.user.LoadFileVersion(reader.file, 3)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentThree)))
+				_, err = reader.user.LoadFileVersion(reader.file, 4)
+				Expect(err).To(MatchError(client.ErrVersionNotFound))
+			}
+
+			userlib.DebugMsg("Bob cannot change the retention of a file shared read only.")
+			err = bob.SetVersionRetention(bobFile, 1)
+			Expect(err).To(MatchError(client.ErrReadOnly))
+		})
+
+		Specify("Version Test: Versions beyond retention are dropped and reclaimed", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Keeping only the last two versions.")
+			err = alice.SetVersionRetention(aliceFile, 0)
+			Expect(err).ToNot(BeNil())
+			err = alice.SetVersionRetention(aliceFile, 2)
+			Expect(err).To(BeNil())
+			versions, err := alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(Equal([]int{2, 3}))
+			_, err = alice.LoadFileVersion(aliceFile, 1)
+			Expect(err).To(MatchError(client.ErrVersionNotFound))
+
+			userlib.DebugMsg("Storing more versions does not grow the datastore.")
+			entries := len(userlib.DatastoreGetMap())
+			for i := 0; i < 5; i++ {
+				err = alice.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+			}
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(entries))
+			versions, err = alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(Equal([]int{7, 8}))
+		})
+
+		Specify("Version Test: Old versions follow revocation", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			for _, recipient := range []struct {
+				user *client.User
+				name string
+				file string
+			}{{bob, "bob", bobFile}, {charles, "charles", charlesFile}} {
+				invite, err := alice.CreateInvitation(aliceFile, recipient.name)
+				Expect(err).To(BeNil())
+				err = recipient.user.AcceptInvitation("alice", invite, recipient.file)
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Alice revoking Bob.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.ListVersions(bobFile)
+			Expect(err).ToNot(BeNil())
+			_, err = bob.LoadFileVersion(bobFile, 1)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Checking Charles still sees the old version.")
+			data, err := charles.LoadFileVersion(charlesFile, 1)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			data, err = charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+		})
+	})
+
+	Describe("Random Access Tests", func() {
+		patterned := func(length int) []byte {
+			data := make([]byte, length)
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+			return data
+		}
+
+		Specify("Random Access Test: ReadAt and WriteAt across block boundaries", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice storing a file of a few blocks.")
+			expected := patterned(3*client.BlockSize + 100)
+			err = alice.StoreFile(aliceFile, expected)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Reading ranges inside, across, and at the end of blocks.")
+			for _, r := range [][2]int{{0, 10}, {client.BlockSize - 5, 10}, {client.BlockSize, client.BlockSize}, {len(expected) - 50, 50}, {len(expected) - 10, 100}, {len(expected), 10}} {
+				data, err := alice.ReadAt(aliceFile, r[0], r[1])
+				Expect(err).To(BeNil())
+				end := r[0] + r[1]
+				if end > len(expected) {
+					end = len(expected)
+				}
+				Expect(data).To(Equal(expected[r[0]:end]))
+			}
+			_, err = alice.ReadAt(aliceFile, len(expected)+1, 1)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Writing a range across a block boundary and past the end.")
+			patch := []byte("written across two blocks")
+			err = alice.WriteAt(aliceFile, 2*client.BlockSize-10, patch)
+			Expect(err).To(BeNil())
+			copy(expected[2*client.BlockSize-10:], patch)
+			err = alice.WriteAt(aliceFile, len(expected)-3, []byte(contentOne))
+			Expect(err).To(BeNil())
+			expected = append(expected[:len(expected)-3], []byte(contentOne)...)
+			err = alice.WriteAt(aliceFile, len(expected)+1, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+			data, err = alice.ReadAt(aliceFile, 2*client.BlockSize-20, 40)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected[2*client.BlockSize-20 : 2*client.BlockSize+20]))
+
+			userlib.DebugMsg("Bob can read ranges of a file shared read only but not write them.")
+			invite, err := alice.CreateInvitationWithPermission(aliceFile, "bob", client.PermissionRead)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err = bob.ReadAt(bobFile, client.BlockSize, 100)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected[client.BlockSize : client.BlockSize+100]))
+			err = bob.WriteAt(bobFile, 0, []byte(contentTwo))
+			Expect(err).To(MatchError(client.ErrReadOnly))
+		})
+
+		Specify("Random Access Test: Bandwidth scales with the requested range", func() {
+			measureBandwidth := func(probe func()) (bandwidth int) {
+				before := userlib.DatastoreGetBandwidth()
+				probe()
+				after := userlib.DatastoreGetBandwidth()
+				return after - before
+			}
+
+			userlib.DebugMsg("Initializing user Alice and storing a large file.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			expected := patterned(40 * client.BlockSize)
+			err = alice.StoreFile(aliceFile, expected)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Reading and writing 4 KB in the middle of the file.")
+			offset := 25*client.BlockSize + 100
+			readBandwidth := measureBandwidth(func() {
+				data, err := alice.ReadAt(aliceFile, offset, 4096)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal(expected[offset : offset+4096]))
+			})
+			// a block or two and the index nodes above them, nowhere near the whole file
+			Expect(readBandwidth).To(BeNumerically("<", len(expected)/8))
+			writeBandwidth := measureBandwidth(func() {
+				err = alice.WriteAt(aliceFile, offset, make([]byte, 4096))
+				Expect(err).To(BeNil())
+			})
+			Expect(writeBandwidth).To(BeNumerically("<", len(expected)/8))
+		})
+
+		Specify("Random Access Test: Files appended to past one index node stay readable", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			expected := []byte(contentOne)
+
+			userlib.DebugMsg("Appending enough blocks to grow the index tree.")
+			for i := 0; i < 3*client.IndexFanout; i++ {
+				err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				expected = append(expected, []byte(contentTwo)...)
+			}
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+
+			err = alice.WriteAt(aliceFile, 40*len(contentTwo), []byte(contentThree))
+			Expect(err).To(BeNil())
+			copy(expected[40*len(contentTwo):], contentThree)
+			data, err = alice.ReadAt(aliceFile, 40*len(contentTwo)-5, len(contentThree)+10)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected[40*len(contentTwo)-5 : 40*len(contentTwo)+len(contentThree)+5]))
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+		})
+	})
+
+	Describe("Streaming Tests", func() {
+		patterned := func(length int) []byte {
+			data := make([]byte, length)
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+			return data
+		}
+
+		Specify("Streaming Test: content written and read in pieces round trips", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Creating a file through a writer.")
+			writer, err := alice.OpenWriter(aliceFile, client.WriteTruncate)
+			Expect(err).To(BeNil())
+			_, err = writer.Write([]byte(contentOne))
+			Expect(err).To(BeNil())
+			Expect(writer.Close()).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Replacing it with a few blocks written in uneven pieces.")
+			expected := patterned(2*client.BlockSize + client.BlockSize/2)
+			writer, err = alice.OpenWriter(aliceFile, client.WriteTruncate)
+			Expect(err).To(BeNil())
+			for _, piece := range [][]byte{expected[:1000], expected[1000 : client.BlockSize+7], expected[client.BlockSize+7:]} {
+				n, err := writer.Write(piece)
+				Expect(err).To(BeNil())
+				Expect(n).To(Equal(len(piece)))
+			}
+
+			userlib.DebugMsg("Nothing changes until the writer is closed.")
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			Expect(writer.Close()).To(BeNil())
+			_, err = writer.Write([]byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+			versions, err := alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(Equal([]int{1, 2}))
+
+			userlib.DebugMsg("Reading it back through a reader.")
+			reader, err := alice.OpenReader(aliceFile)
+			Expect(err).To(BeNil())
+			data, err = readAll(reader)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+			_, err = reader.Read(make([]byte, 10))
+			Expect(err).To(Equal(client.ErrEndOfFile))
+			Expect(reader.Close()).To(BeNil())
+
+			userlib.DebugMsg("A reader keeps the version it opened when the file is replaced.")
+			reader, err = alice.OpenReader(aliceFile)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = readAll(reader)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+		})
+
+		Specify("Streaming Test: a reader carries on through appends and overwrites from other sessions", func() {
+			userlib.DebugMsg("Alice shares a file of three blocks with Bob and starts reading it.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			content := userlib.RandomBytes(3 * client.BlockSize)
+			Expect(alice.StoreFile(aliceFile, content)).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			reader, err := alice.OpenReader(aliceFile)
+			Expect(err).To(BeNil())
+			first := make([]byte, client.BlockSize)
+			n, err := reader.Read(first)
+			Expect(err).To(BeNil())
+			Expect(first[:n]).To(Equal(content[:n]))
+
+			userlib.DebugMsg("Bob appends and overwrites the last block while the reader is open.")
+			Expect(bob.AppendToFile(bobFile, []byte(contentTwo))).To(BeNil())
+			Expect(bob.WriteAt(bobFile, 2*client.BlockSize+10, []byte(contentThree))).To(BeNil())
+			current, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The reader returns the rest of the current file.")
+			rest, err := readAll(reader)
+			Expect(err).To(BeNil())
+			Expect(rest).To(Equal(current[n:]))
+			Expect(reader.Close()).To(BeNil())
+
+			userlib.DebugMsg("A reader still reports each record of an overwrite that was rolled back.")
+			before := make(map[uuid.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = append([]byte{}, value...)
+			}
+			Expect(bob.WriteAt(bobFile, 10, []byte(contentOne))).To(BeNil())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			var changed int
+			for key, value := range userlib.DatastoreGetMap() {
+				old, ok := before[key]
+				if !ok || string(old) == string(value) {
+					continue
+				}
+				changed++
+				userlib.DatastoreSet(key, old)
+				reader, err = alice.OpenReader(aliceFile)
+				if err == nil {
+					_, err = readAll(reader)
+				}
+				Expect(err).To(MatchError(client.ErrRollback))
+				userlib.DatastoreSet(key, value)
+			}
+			Expect(changed).To(BeNumerically(">=", 3))
+		})
+
+		Specify("Streaming Test: append writers respect permissions and concurrent changes", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitationWithPermission(aliceFile, "charles", client.PermissionRead)
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob streams an append while Alice appends to the file.")
+			streamed := patterned(client.BlockSize + 10)
+			writer, err := bob.OpenWriter(bobFile, client.WriteAppend)
+			Expect(err).To(BeNil())
+			_, err = writer.Write(streamed)
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			Expect(writer.Close()).To(BeNil())
+
+			expected := append([]byte(contentOne+contentTwo), streamed...)
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+
+			userlib.DebugMsg("Charles can stream the file out but not in.")
+			reader, err := charles.OpenReader(charlesFile)
+			Expect(err).To(BeNil())
+			data, err = readAll(reader)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+			_, err = charles.OpenWriter(charlesFile, client.WriteAppend)
+			Expect(err).To(MatchError(client.ErrReadOnly))
+			_, err = charles.OpenWriter(charlesFile, client.WriteTruncate)
+			Expect(err).To(MatchError(client.ErrReadOnly))
+
+			userlib.DebugMsg("An append writer fails if the file is replaced before it is closed, and leaves no blocks behind.")
+			writer, err = alice.OpenWriter(aliceFile, client.WriteAppend)
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			before := make(map[uuid.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			_, err = writer.Write(userlib.RandomBytes(2*client.BlockSize + 10))
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically(">", len(before)))
+			Expect(writer.Close()).ToNot(BeNil())
+			for key := range userlib.DatastoreGetMap() {
+				Expect(before[key]).To(BeTrue())
+			}
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+		})
+
+		Specify("Streaming Test: replacing a file through a writer keeps its deduplication and compression", func() {
+			userlib.DebugMsg("Initializing user Alice with a deduplicated file.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			base := userlib.RandomBytes(4 * client.BlockSize)
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			Expect(alice.SetDeduplication(aliceFile, true)).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, base)).To(BeNil())
+			write := func(filename string, content []byte) {
+				writer, err := alice.OpenWriter(filename, client.WriteTruncate)
+				Expect(err).To(BeNil())
+				for len(content) > 1000 {
+					_, err = writer.Write(content[:1000])
+					Expect(err).To(BeNil())
+					content = content[1000:]
+				}
+				_, err = writer.Write(content)
+				Expect(err).To(BeNil())
+				Expect(writer.Close()).To(BeNil())
+			}
+			storedBytes := func(store func()) (stored int) {
+				before := make(map[uuid.UUID]bool)
+				for key := range userlib.DatastoreGetMap() {
+					before[key] = true
+				}
+				store()
+				for key, value := range userlib.DatastoreGetMap() {
+					if !before[key] {
+						stored += len(value)
+					}
+				}
+				return stored
+			}
+
+			userlib.DebugMsg("Writing the same content to another deduplicated file stores none of it again.")
+			Expect(alice.StoreFile(bobFile, []byte(contentOne))).To(BeNil())
+			Expect(alice.SetDeduplication(bobFile, true)).To(BeNil())
+			Expect(storedBytes(func() { write(bobFile, base) })).To(BeNumerically("<", client.BlockSize/4))
+			data, err := alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(base))
+
+			userlib.DebugMsg("The chunks are counted for both files.")
+			Expect(alice.DeleteFile(aliceFile)).To(BeNil())
+			data, err = alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(base))
+
+			userlib.DebugMsg("Writing compressible content to a compressed file stores it compressed.")
+			compressible := make([]byte, 3*client.BlockSize)
+			for i := range compressible {
+				compressible[i] = contentThree[i%len(contentThree)]
+			}
+			Expect(alice.StoreFile(charlesFile, []byte(contentOne))).To(BeNil())
+			Expect(alice.SetCompression(charlesFile, true)).To(BeNil())
+			Expect(storedBytes(func() { write(charlesFile, compressible) })).To(BeNumerically("<", len(compressible)/2))
+			data, err = alice.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(compressible))
+		})
+	})
+
+	Describe("Compaction Tests", func() {
+		Specify("Compaction Test: CompactFile merges appended blocks and keeps sharees' access", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitationWithPermission(aliceFile, "charles", client.PermissionRead)
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob appends many small pieces, one block each.")
+			expected := []byte(contentOne)
+			for i := 0; i < 50; i++ {
+				err = bob.AppendToFile(bobFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				expected = append(expected, []byte(contentTwo)...)
+			}
+			recordsBefore := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("Compacting leaves a single block and keeps the content.")
+			err = charles.CompactFile(charlesFile)
+			Expect(err).To(MatchError(client.ErrReadOnly))
+			err = bob.CompactFile(bobFile)
+			Expect(err).To(BeNil())
+			// 51 blocks under two leaves and a root become one block under one leaf
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(recordsBefore - 52))
+			versions, err := alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(Equal([]int{1}))
+
+			userlib.DebugMsg("Everyone still reads the file, and appends go to the compacted tree.")
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			expected = append(expected, []byte(contentThree)...)
+			for _, load := range []func() ([]byte, error){
+				func() ([]byte, error) { return alice.LoadFile(aliceFile) },
+				func() ([]byte, error) { return bob.LoadFile(bobFile) },
+				func() ([]byte, error) { return charles.LoadFile(charlesFile) },
+			} {
+				data, err := load()
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal(expected))
+			}
+		})
+
+		Specify("Compaction Test: appends compact the file past the threshold", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.SetCompactThreshold(aliceFile, -1)
+			Expect(err).ToNot(BeNil())
+			err = alice.SetCompactThreshold(aliceFile, 10)
+			Expect(err).To(BeNil())
+			recordsBefore := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("Appending well past the threshold keeps the number of blocks bounded.")
+			expected := []byte(contentOne)
+			for i := 0; i < 35; i++ {
+				err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				expected = append(expected, []byte(contentTwo)...)
+				Expect(len(userlib.DatastoreGetMap()) - recordsBefore).To(BeNumerically("<=", 11))
+			}
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+		})
+	})
+
+	Describe("Deduplication Tests", func() {
+		Specify("Deduplication Test: chunks shared by an owner's files are stored once and reclaimed", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			baseline := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("Storing a deduplicated file of a few blocks.")
+			base := userlib.RandomBytes(6 * client.BlockSize)
+			err = alice.StoreFile(aliceFile, base)
+			Expect(err).To(BeNil())
+			err = alice.SetDeduplication(aliceFile, true)
+			Expect(err).To(BeNil())
+			afterFirst := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("A near identical file only adds the chunks around the edit.")
+			edited := append([]byte{}, base...)
+			copy(edited[3*client.BlockSize:], "edited in the middle")
+			err = alice.StoreFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.SetDeduplication(bobFile, true)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, edited)
+			Expect(err).To(BeNil())
+			err = alice.SetVersionRetention(bobFile, 1)
+			Expect(err).To(BeNil())
+			// the access, invitation list, meta and index of the file, and a few new chunks
+			Expect(len(userlib.DatastoreGetMap()) - afterFirst).To(BeNumerically("<", 12))
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(base))
+			data, err = alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(edited))
+
+			userlib.DebugMsg("Deleting one file keeps the chunks the other still uses.")
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(edited))
+			err = alice.DeleteFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(baseline))
+		})
+
+		Specify("Deduplication Test: equal content of different users shares nothing", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			content := userlib.RandomBytes(3 * client.BlockSize)
+
+			keysOf := func(store func()) map[uuid.UUID]bool {
+				before := make(map[uuid.UUID]bool)
+				for key := range userlib.DatastoreGetMap() {
+					before[key] = true
+				}
+				store()
+				added := make(map[uuid.UUID]bool)
+				for key := range userlib.DatastoreGetMap() {
+					if _, ok := before[key]; !ok {
+						added[key] = true
+					}
+				}
+				return added
+			}
+			aliceKeys := keysOf(func() {
+				Expect(alice.StoreFile(aliceFile, content)).To(BeNil())
+				Expect(alice.SetDeduplication(aliceFile, true)).To(BeNil())
+			})
+			bobKeys := keysOf(func() {
+				Expect(bob.StoreFile(bobFile, content)).To(BeNil())
+				Expect(bob.SetDeduplication(bobFile, true)).To(BeNil())
+			})
+			// boundaries are keyed per user too, so not even the number of chunks has to match
+			Expect(len(bobKeys)).To(BeNumerically(">", 3))
+			for key := range bobKeys {
+				Expect(aliceKeys[key]).To(BeFalse())
+			}
+		})
+
+		Specify("Deduplication Test: other writers never change chunks and their releases are not lost", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares a small deduplicated file with Bob.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.SetDeduplication(bobFile, true)
+			Expect(err).ToNot(BeNil())
+			err = alice.SetDeduplication(aliceFile, true)
+			Expect(err).To(BeNil())
+			baseline := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("Alice stores the same content in the shared file and another one.")
+			content := userlib.RandomBytes(3 * client.BlockSize)
+			err = alice.StoreFile(charlesFile, content)
+			Expect(err).To(BeNil())
+			err = alice.SetDeduplication(charlesFile, true)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob writing to a shared chunk leaves Alice's other file alone.")
+			err = bob.WriteAt(bobFile, client.BlockSize, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+			expected := append([]byte{}, content...)
+			copy(expected[client.BlockSize:], contentTwo)
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+
+			userlib.DebugMsg("Bob drops the first version, Alice deletes her other file and stores the first content again.")
+			err = bob.SetVersionRetention(bobFile, 1)
+			Expect(err).To(BeNil())
+			err = alice.DeleteFile(charlesFile)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			// every chunk Bob stopped using was released once Alice wrote the file
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(baseline))
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Deduplication Test: revoking a sharee moves the file off the chunks they knew", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice stores a deduplicated file and shares it with Bob and Charles.")
+			content := userlib.RandomBytes(3 * client.BlockSize)
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			Expect(alice.SetDeduplication(aliceFile, true)).To(BeNil())
+			before := make(map[uuid.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			Expect(alice.StoreFile(aliceFile, content)).To(BeNil())
+			var chunks []uuid.UUID
+			for key, value := range userlib.DatastoreGetMap() {
+				if !before[key] && len(value) > client.BlockSize/4 {
+					chunks = append(chunks, key)
+				}
+			}
+			Expect(len(chunks)).To(BeNumerically(">=", 3))
+			for _, user := range []struct {
+				user     *client.User
+				filename string
+			}{{bob, bobFile}, {charles, charlesFile}} {
+				invite, err := alice.CreateInvitation(aliceFile, user.user.Username)
+				Expect(err).To(BeNil())
+				Expect(user.user.AcceptInvitation("alice", invite, user.filename)).To(BeNil())
+			}
+
+			userlib.DebugMsg("Once Bob is revoked none of the chunks Bob could read are left.")
+			Expect(alice.RevokeAccess(aliceFile, "bob")).To(BeNil())
+			for _, chunk := range chunks {
+				_, ok := userlib.DatastoreGet(chunk)
+				Expect(ok).To(BeFalse())
+			}
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+
+			userlib.DebugMsg("Storing the content again does not bring the old chunks back.")
+			Expect(alice.StoreFile(aliceFile, content)).To(BeNil())
+			for _, chunk := range chunks {
+				_, ok := userlib.DatastoreGet(chunk)
+				Expect(ok).To(BeFalse())
+			}
+		})
+	})
+
+	Describe("Compression Tests", func() {
+		storedBytes := func(store func()) (total int) {
+			before := make(map[uuid.UUID]int)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = len(value)
+			}
+			store()
+			for key, value := range userlib.DatastoreGetMap() {
+				if length, ok := before[key]; !ok || length != len(value) {
+					total += len(value)
+				}
+			}
+			return total
+		}
+
+		Specify("Compression Test: compressed files round trip and take less space", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			var text []byte
+			for len(text) < 4*client.BlockSize {
+				text = append(text, []byte(contentOne+contentTwo+contentThree)...)
+			}
+			plainSize := storedBytes(func() {
+				Expect(alice.StoreFile(aliceFile, text)).To(BeNil())
+			})
+
+			userlib.DebugMsg("Turning compression on rewrites the file into far fewer bytes.")
+			invite, err := alice.CreateInvitationWithPermission(aliceFile, "bob", client.PermissionRead)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.SetCompression(bobFile, true)
+			Expect(err).To(MatchError(client.ErrReadOnly))
+			compressedSize := storedBytes(func() {
+				Expect(alice.SetCompression(aliceFile, true)).To(BeNil())
+			})
+			Expect(compressedSize).To(BeNumerically("<", plainSize/4))
+
+			userlib.DebugMsg("Every way of writing and reading the file still works.")
+			expected := append([]byte{}, text...)
+			err = alice.AppendToFile(aliceFile, text[:5000])
+			Expect(err).To(BeNil())
+			expected = append(expected, text[:5000]...)
+			err = alice.WriteAt(aliceFile, client.BlockSize-10, []byte(contentThree))
+			Expect(err).To(BeNil())
+			copy(expected[client.BlockSize-10:], contentThree)
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+			data, err = bob.ReadAt(bobFile, client.BlockSize-20, 100)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected[client.BlockSize-20 : client.BlockSize+80]))
+
+			userlib.DebugMsg("New versions are compressed, the plain first version still loads.")
+			err = alice.StoreFile(aliceFile, text[:client.BlockSize])
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFileVersion(aliceFile, 1)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(text[:client.BlockSize]))
+		})
+
+		Specify("Compression Test: incompressible content is not inflated", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			content := userlib.RandomBytes(2*client.BlockSize + 1000)
+			plainSize := storedBytes(func() {
+				Expect(alice.StoreFile(aliceFile, content)).To(BeNil())
+			})
+			compressedSize := storedBytes(func() {
+				Expect(alice.SetCompression(aliceFile, true)).To(BeNil())
+			})
+			// only the meta is rewritten on top of the same number of blocks
+			Expect(compressedSize).To(BeNumerically("<=", plainSize))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+		})
+	})
+
+	Describe("Envelope Tests", func() {
+		Specify("Envelope Test: a file takes little more than its own size to store and load", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			content := userlib.RandomBytes(4*client.BlockSize + 1000)
+			before := make(map[uuid.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+			var stored int
+			for key, value := range userlib.DatastoreGetMap() {
+				if !before[key] {
+					stored += len(value)
+				}
+			}
+			userlib.DebugMsg("Stored %d bytes for %d bytes of content.", stored, len(content))
+			Expect(stored).To(BeNumerically("<", len(content)+16*1024))
+
+			userlib.DebugMsg("Loading it reads about as much.")
+			bandwidth := userlib.DatastoreGetBandwidth()
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+			Expect(userlib.DatastoreGetBandwidth() - bandwidth).To(BeNumerically("<", len(content)+32*1024))
+		})
+	})
+
+	Describe("Record Binding Tests", func() {
+		Specify("Record Binding Test: swapping two invitations is detected", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice invites Bob to two files.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite1, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			invite2, err := alice.CreateInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Swapping the invitations, Bob can accept neither.")
+			value1, ok := userlib.DatastoreGet(invite1)
+			Expect(ok).To(BeTrue())
+			value2, ok := userlib.DatastoreGet(invite2)
+			Expect(ok).To(BeTrue())
+			userlib.DatastoreSet(invite1, value2)
+			userlib.DatastoreSet(invite2, value1)
+			err = bob.AcceptInvitation("alice", invite1, bobFile)
+			Expect(err).ToNot(BeNil())
+			err = bob.AcceptInvitation("alice", invite2, bobFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Putting them back, Bob accepts the file he was invited to.")
+			userlib.DatastoreSet(invite1, value1)
+			userlib.DatastoreSet(invite2, value2)
+			err = bob.AcceptInvitation("alice", invite1, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Record Binding Test: a record copied over another is detected wherever tampering is", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob, Alice shares a file of several blocks with Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			before := make(map[uuid.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			content := userlib.RandomBytes(2*client.BlockSize + 100)
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			content = append(content, []byte(contentOne)...)
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			records := make(map[uuid.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				if !before[key] {
+					records[key] = append([]byte{}, value...)
+				}
+			}
+			detected := func() bool {
+				aliceData, aliceErr := alice.LoadFile(aliceFile)
+				bobData, bobErr := bob.LoadFile(bobFile)
+				_, listErr := alice.ListFiles()
+				if aliceErr == nil {
+					Expect(aliceData).To(Equal(content))
+				}
+				if bobErr == nil {
+					Expect(bobData).To(Equal(content))
+				}
+				return aliceErr != nil || bobErr != nil || listErr != nil
+			}
+
+			userlib.DebugMsg("Finding the records whose tampering is detected.")
+			var checked []uuid.UUID
+			for key, value := range records {
+				userlib.DatastoreSet(key, maliciousByte)
+				if detected() {
+					checked = append(checked, key)
+				}
+				userlib.DatastoreSet(key, value)
+			}
+			Expect(len(checked)).To(BeNumerically(">", 5))
+
+			userlib.DebugMsg("Copying any other record over one of them is detected too.")
+			for _, target := range checked {
+				for source, value := range records {
+					if source == target {
+						continue
+					}
+					userlib.DatastoreSet(target, value)
+					Expect(detected()).To(BeTrue())
+				}
+				userlib.DatastoreSet(target, records[target])
+			}
+			Expect(detected()).To(BeFalse())
+		})
+	})
+
+	Describe("Rollback Tests", func() {
+		snapshot := func() (values map[uuid.UUID][]byte) {
+			values = make(map[uuid.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				values[key] = append([]byte{}, value...)
+			}
+			return values
+		}
+
+		Specify("Rollback Test: restoring the file as it was before an append is detected", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob, Alice shares a file with Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice appends and Bob reads the appended file.")
+			before := snapshot()
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Putting back every record the append changed.")
+			for key, value := range userlib.DatastoreGetMap() {
+				if old, ok := before[key]; ok && string(old) != string(value) {
+					userlib.DatastoreSet(key, old)
+				}
+			}
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).To(MatchError(client.ErrRollback))
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).To(MatchError(client.ErrRollback))
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(MatchError(client.ErrRollback))
+		})
+
+		Specify("Rollback Test: restoring any single record an overwrite changed is detected", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			content := userlib.RandomBytes(2*client.BlockSize + 100)
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Overwriting part of the first block in place.")
+			before := snapshot()
+			err = alice.WriteAt(aliceFile, 10, []byte(contentOne))
+			Expect(err).To(BeNil())
+			after := snapshot()
+			var changed []uuid.UUID
+			for key, value := range after {
+				if old, ok := before[key]; ok && string(old) != string(value) {
+					changed = append(changed, key)
+				}
+			}
+			Expect(len(changed)).To(BeNumerically(">=", 3))
+
+			userlib.DebugMsg("Each of the block, index and meta rolled back on its own is reported.")
+			for _, key := range changed {
+				userlib.DatastoreSet(key, before[key])
+				_, err = alice.LoadFile(aliceFile)
+				Expect(err).To(MatchError(client.ErrRollback))
+				userlib.DatastoreSet(key, after[key])
+			}
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			copy(content[10:], contentOne)
+			Expect(data).To(Equal(content))
+		})
+	})
+
+	Describe("Splice Tests", func() {
+		// returns the blocks a store wrote, the only records that hold a whole block of content
+		storedBlocks := func(store func()) (blocks []uuid.UUID) {
+			before := make(map[uuid.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			store()
+			for key, value := range userlib.DatastoreGetMap() {
+				if !before[key] && len(value) > client.BlockSize {
+					blocks = append(blocks, key)
+				}
+			}
+			return blocks
+		}
+
+		Specify("Splice Test: reordered, spliced and dropped blocks are all detected", func() {
+			userlib.DebugMsg("Initializing user Alice, who stores two files of three blocks.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			content := userlib.RandomBytes(3 * client.BlockSize)
+			blocks := storedBlocks(func() {
+				Expect(alice.StoreFile(aliceFile, content)).To(BeNil())
+			})
+			Expect(blocks).To(HaveLen(3))
+			otherBlocks := storedBlocks(func() {
+				Expect(alice.StoreFile(bobFile, userlib.RandomBytes(3*client.BlockSize))).To(BeNil())
+			})
+			Expect(otherBlocks).To(HaveLen(3))
+			values := make(map[uuid.UUID][]byte)
+			for _, block := range append(blocks, otherBlocks...) {
+				values[block], _ = userlib.DatastoreGet(block)
+			}
+
+			userlib.DebugMsg("Swapping two blocks of the file.")
+			userlib.DatastoreSet(blocks[0], values[blocks[1]])
+			userlib.DatastoreSet(blocks[1], values[blocks[0]])
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			userlib.DatastoreSet(blocks[0], values[blocks[0]])
+			userlib.DatastoreSet(blocks[1], values[blocks[1]])
+
+			userlib.DebugMsg("Splicing in a block of the other file.")
+			userlib.DatastoreSet(blocks[2], values[otherBlocks[2]])
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			userlib.DatastoreSet(blocks[2], values[blocks[2]])
+
+			userlib.DebugMsg("The untouched file still loads.")
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+
+			userlib.DebugMsg("Dropping a block is caught by every read that reaches it.")
+			for _, block := range blocks {
+				userlib.DatastoreDelete(block)
+				_, err = alice.LoadFile(aliceFile)
+				Expect(err).ToNot(BeNil())
+				userlib.DatastoreSet(block, values[block])
+			}
+
+			userlib.DebugMsg("Reads that do not reach the dropped block still work.")
+			for _, block := range blocks {
+				userlib.DatastoreDelete(block)
+				failed := 0
+				for i := 0; i < 3; i++ {
+					data, err = alice.ReadAt(aliceFile, i*client.BlockSize, 10)
+					if err != nil {
+						failed++
+						continue
+					}
+					Expect(data).To(Equal(content[i*client.BlockSize : i*client.BlockSize+10]))
+				}
+				Expect(failed).To(Equal(1))
+				userlib.DatastoreSet(block, values[block])
+			}
+		})
+	})
+
+	Describe("Concurrency Tests", func() {
+		// runs every op on a goroutine of its own and returns their errors once all have finished
+		runConcurrently := func(ops ...func() error) (errs []error) {
+			done := make(chan error, len(ops))
+			for _, op := range ops {
+				go func(op func() error) {
+					done <- op()
+				}(op)
+			}
+			for range ops {
+				errs = append(errs, <-done)
+			}
+			return errs
+		}
+
+		Specify("Concurrency Test: appends from several sessions at once all land", func() {
+			userlib.DebugMsg("Initializing Alice with two sessions and Bob with two, sharing one file.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte("start;"))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bobLaptop, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceDesktop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Every session appends ten times while another one keeps loading the file.")
+			const appends = 10
+			sessions := []*client.User{alice, aliceLaptop, bob, bobLaptop}
+			filenames := []string{aliceFile, aliceFile, bobFile, bobFile}
+			var ops []func() error
+			for s := range sessions {
+				ops = append(ops, func(s int) func() error {
+					return func() error {
+						for i := 0; i < appends; i++ {
+							err := sessions[s].AppendToFile(filenames[s], []byte{'0' + byte(s), '.', '0' + byte(i), ';'})
+							if err != nil {
+								return err
+							}
+						}
+						return nil
+					}
+				}(s))
+			}
+			ops = append(ops, func() error {
+				for i := 0; i < appends; i++ {
+					data, err := aliceDesktop.LoadFile(aliceFile)
+					if err != nil {
+						return err
+					}
+					if string(data[:len("start;")]) != "start;" {
+						return errors.New("file lost its start")
+					}
+				}
+				return nil
+			})
+			for _, err := range runConcurrently(ops...) {
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Every append is there once, and those of each session in the order it made them.")
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(len(data)).To(Equal(len("start;") + 4*appends*len(sessions)))
+			next := make([]int, len(sessions))
+			for i := len("start;"); i < len(data); i += 4 {
+				s, n := int(data[i]-'0'), int(data[i+2]-'0')
+				Expect(s).To(BeNumerically("<", len(sessions)))
+				Expect(n).To(Equal(next[s]))
+				next[s]++
+			}
+			for s := range sessions {
+				Expect(next[s]).To(Equal(appends))
+			}
+		})
+
+		Specify("Concurrency Test: sessions creating the same file at once each store a version", func() {
+			userlib.DebugMsg("Three sessions of Alice store the same new file at once.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceDesktop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			contents := []string{contentOne, contentTwo, contentThree}
+			var ops []func() error
+			for s, session := range []*client.User{alice, aliceLaptop, aliceDesktop} {
+				ops = append(ops, func(session *client.User, content string) func() error {
+					return func() error {
+						return session.StoreFile(aliceFile, []byte(content))
+					}
+				}(session, contents[s]))
+			}
+			for _, err := range runConcurrently(ops...) {
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("There is one file, holding one of the contents, with a version for every store.")
+			files, err := alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(HaveLen(1))
+			versions, err := alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(HaveLen(3))
+			data, err := aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(contents).To(ContainElement(string(data)))
+		})
+
+		Specify("Concurrency Test: invitations and revocations from several sessions at once", func() {
+			userlib.DebugMsg("Initializing Alice with three sessions, and Bob, Charles and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceDesktop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Each session invites one of them at once, and they accept.")
+			share := func(session, recipient *client.User, filename string) func() error {
+				return func() error {
+					invite, err := session.CreateInvitation(aliceFile, recipient.Username)
+					if err != nil {
+						return err
+					}
+					return recipient.AcceptInvitation("alice", invite, filename)
+				}
+			}
+			for _, err := range runConcurrently(share(alice, bob, bobFile), share(aliceLaptop, charles, charlesFile), share(aliceDesktop, doris, dorisFile)) {
+				Expect(err).To(BeNil())
+			}
+			for _, recipient := range []struct {
+				user     *client.User
+				filename string
+			}{{bob, bobFile}, {charles, charlesFile}, {doris, dorisFile}} {
+				data, err := recipient.user.LoadFile(recipient.filename)
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte(contentOne)))
+			}
+
+			userlib.DebugMsg("Two sessions revoke Bob and Charles at once while Doris appends.")
+			errs := runConcurrently(
+				func() error { return alice.RevokeAccess(aliceFile, "bob") },
+				func() error { return aliceLaptop.RevokeAccess(aliceFile, "charles") },
+				func() error { return doris.AppendToFile(dorisFile, []byte(contentTwo)) },
+			)
+			for _, err := range errs {
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Bob and Charles lost access, Doris and Alice see her append.")
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+			data, err := doris.LoadFile(dorisFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			data, err = aliceDesktop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Concurrency Test: appends land while other sessions compact the file and change its settings", func() {
+			userlib.DebugMsg("Initializing Alice with two sessions and Bob, sharing one file.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte("start;"))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob appends ten times while Alice compacts the file and her laptop changes its settings.")
+			const appends = 10
+			errs := runConcurrently(
+				func() error {
+					for i := 0; i < appends; i++ {
+						err := bob.AppendToFile(bobFile, []byte{'b', '.', '0' + byte(i), ';'})
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+				func() error {
+					for i := 0; i < appends; i++ {
+						err := alice.CompactFile(aliceFile)
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+				func() error {
+					for i := 0; i < appends; i++ {
+						err := aliceLaptop.SetCompression(aliceFile, i%2 == 0)
+						if err != nil {
+							return err
+						}
+						err = aliceLaptop.SetVersionRetention(aliceFile, 2+i%2)
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+			)
+			for _, err := range errs {
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Every append is there once, in the order Bob made them.")
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			expected := "start;"
+			for i := 0; i < appends; i++ {
+				expected += string([]byte{'b', '.', '0' + byte(i), ';'})
+			}
+			Expect(string(data)).To(Equal(expected))
+		})
+
+		Specify("Concurrency Test: stream writers and appends from other sessions all land", func() {
+			userlib.DebugMsg("Initializing Alice with two sessions and Bob, sharing one file.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte("start;"))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice and her laptop stream appends while Bob appends.")
+			const appends = 10
+			stream := func(session *client.User, s byte) func() error {
+				return func() error {
+					for i := 0; i < appends; i++ {
+						writer, err := session.OpenWriter(aliceFile, client.WriteAppend)
+						if err != nil {
+							return err
+						}
+						_, err = writer.Write([]byte{'0' + s, '.', '0' + byte(i), ';'})
+						if err != nil {
+							return err
+						}
+						err = writer.Close()
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				}
+			}
+			errs := runConcurrently(
+				stream(alice, 0),
+				stream(aliceLaptop, 1),
+				func() error {
+					for i := 0; i < appends; i++ {
+						err := bob.AppendToFile(bobFile, []byte{'2', '.', '0' + byte(i), ';'})
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				},
+			)
+			for _, err := range errs {
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Every write is there once, and those of each session in the order it made them.")
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(len(data)).To(Equal(len("start;") + 4*appends*3))
+			next := make([]int, 3)
+			for i := len("start;"); i < len(data); i += 4 {
+				s, n := int(data[i]-'0'), int(data[i+2]-'0')
+				Expect(s).To(BeNumerically("<", 3))
+				Expect(n).To(Equal(next[s]))
+				next[s]++
+			}
+			for s := range next {
+				Expect(next[s]).To(Equal(appends))
+			}
+		})
+	})
+
+	Describe("Lock Tests", func() {
+		Specify("Lock Test: a lock keeps other sessions out until it is released, and every sharee sees it", func() {
+			userlib.DebugMsg("Initializing Alice, Bob who may write and Charles who may only read.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			invite, err = bob.CreateInvitationWithPermission(bobFile, "charles", client.PermissionRead)
+			Expect(err).To(BeNil())
+			Expect(charles.AcceptInvitation("bob", invite, charlesFile)).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice locks the file, Bob and her laptop cannot.")
+			Expect(alice.LockFile(aliceFile, minute)).To(BeNil())
+			err = bob.LockFile(bobFile, minute)
+			Expect(err).To(MatchError(client.ErrLocked))
+			err = aliceLaptop.LockFile(aliceFile, minute)
+			Expect(err).To(MatchError(client.ErrLocked))
+			err = bob.UnlockFile(bobFile)
+			Expect(err).To(MatchError(client.ErrLocked))
+			Expect(alice.LockFile(aliceFile, minute)).To(BeNil())
+
+			userlib.DebugMsg("Charles sees who holds the lock, but may not take it.")
+			lock, locked, err := charles.GetLock(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(locked).To(BeTrue())
+			Expect(lock.Holder).To(Equal("alice"))
+			Expect(lock.Expires.After(client.SystemClock{}.Now())).To(BeTrue())
+			Expect(charles.LockFile(charlesFile, minute)).To(Equal(client.ErrReadOnly))
+
+			userlib.DebugMsg("The lock is advisory, Bob can still append.")
+			Expect(bob.AppendToFile(bobFile, []byte(contentTwo))).To(BeNil())
+
+			userlib.DebugMsg("Once Alice unlocks, Bob can take the lock.")
+			Expect(alice.UnlockFile(aliceFile)).To(BeNil())
+			_, locked, err = charles.GetLock(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(locked).To(BeFalse())
+			Expect(bob.LockFile(bobFile, minute)).To(BeNil())
+			lock, locked, err = aliceLaptop.GetLock(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(locked).To(BeTrue())
+			Expect(lock.Holder).To(Equal("bob"))
+			Expect(bob.UnlockFile(bobFile)).To(BeNil())
+			Expect(bob.UnlockFile(bobFile)).To(BeNil())
+		})
+
+		Specify("Lock Test: a lease lapses by itself once its ttl has passed", func() {
+			userlib.DebugMsg("Alice locks a file for a moment and her session then goes away.")
+			clock := &client.OffsetClock{}
+			alice, err = client.InitUserWithOptions("alice", defaultPassword, client.SessionOptions{Clock: clock})
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			aliceLaptop, err = client.GetUserWithOptions("alice", defaultPassword, client.SessionOptions{Clock: clock})
+			Expect(err).To(BeNil())
+			Expect(alice.LockFile(aliceFile, minute)).To(BeNil())
+			clock.Advance(59 * second)
+			err = aliceLaptop.LockFile(aliceFile, minute)
+			Expect(err).To(MatchError(client.ErrLocked))
+
+			userlib.DebugMsg("Her laptop gets the lock once the lease expired.")
+			clock.Advance(2 * second)
+			_, locked, err := aliceLaptop.GetLock(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(locked).To(BeFalse())
+			Expect(aliceLaptop.LockFile(aliceFile, minute)).To(BeNil())
+			err = alice.UnlockFile(aliceFile)
+			Expect(err).To(MatchError(client.ErrLocked))
+			Expect(aliceLaptop.UnlockFile(aliceFile)).To(BeNil())
+		})
+
+		Specify("Lock Test: putting back a lease that was since released is detected", func() {
+			userlib.DebugMsg("Alice shares a file with Bob and locks it.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			Expect(alice.LockFile(aliceFile, minute)).To(BeNil())
+			held := make(map[uuid.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				held[key] = append([]byte{}, value...)
+			}
+
+			userlib.DebugMsg("Alice unlocks the file and Bob sees it released.")
+			Expect(alice.UnlockFile(aliceFile)).To(BeNil())
+			_, locked, err := bob.GetLock(bobFile)
+			Expect(err).To(BeNil())
+			Expect(locked).To(BeFalse())
+
+			userlib.DebugMsg("The datastore puts the held lease back, which Bob reports.")
+			var rolledBack int
+			for key, value := range userlib.DatastoreGetMap() {
+				if old, ok := held[key]; ok && string(old) != string(value) {
+					userlib.DatastoreSet(key, old)
+					rolledBack++
+				}
+			}
+			Expect(rolledBack).To(Equal(1))
+			_, _, err = bob.GetLock(bobFile)
+			Expect(err).To(MatchError(client.ErrRollback))
+			err = bob.LockFile(bobFile, minute)
+			Expect(err).To(MatchError(client.ErrRollback))
+		})
+
+		Specify("Lock Test: revoking the holder drops the lease, and a tampered lease is detected", func() {
+			userlib.DebugMsg("Initializing Alice, and Bob and Charles who may both write.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			Expect(charles.AcceptInvitation("alice", invite, charlesFile)).To(BeNil())
+
+			userlib.DebugMsg("Bob locks the file and is revoked, which releases it.")
+			before := make(map[uuid.UUID]bool)
+			for key := range userlib.DatastoreGetMap() {
+				before[key] = true
+			}
+			Expect(bob.LockFile(bobFile, minute)).To(BeNil())
+			var leaseUUID uuid.UUID
+			for key := range userlib.DatastoreGetMap() {
+				if !before[key] {
+					leaseUUID = key
+				}
+			}
+			Expect(alice.RevokeAccess(aliceFile, "bob")).To(BeNil())
+			_, locked, err := alice.GetLock(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(locked).To(BeFalse())
+
+			userlib.DebugMsg("Charles locks the file and keeps the lock when Alice revokes someone else.")
+			Expect(charles.LockFile(charlesFile, minute)).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "doris")
+			Expect(err).To(BeNil())
+			Expect(doris.AcceptInvitation("alice", invite, dorisFile)).To(BeNil())
+			Expect(alice.RevokeAccess(aliceFile, "doris")).To(BeNil())
+			lock, locked, err := alice.GetLock(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(locked).To(BeTrue())
+			Expect(lock.Holder).To(Equal("charles"))
+			err = alice.LockFile(aliceFile, minute)
+			Expect(err).To(MatchError(client.ErrLocked))
+
+			userlib.DebugMsg("Tampering with the lease is detected.")
+			value, ok := userlib.DatastoreGet(leaseUUID)
+			Expect(ok).To(BeTrue())
+			userlib.DatastoreSet(leaseUUID, append(value, maliciousByte...))
+			_, _, err = charles.GetLock(charlesFile)
+			Expect(err).ToNot(BeNil())
+			Expect(alice.LockFile(aliceFile, minute)).ToNot(BeNil())
+		})
+	})
+
+	Describe("Invitation Expiry Tests", func() {
+		Specify("Invitation Expiry Test: an invitation cannot be accepted once it has expired", func() {
+			userlib.DebugMsg("Initializing Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+
+			userlib.DebugMsg("Alice invites Bob for a moment, and Bob waits too long.")
+			_, err = alice.CreateExpiringInvitation(aliceFile, "bob", client.PermissionRead, 0)
+			Expect(err).ToNot(BeNil())
+			clock := &client.OffsetClock{}
+			bob, err = client.GetUserWithOptions("bob", defaultPassword, client.SessionOptions{Clock: clock})
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateExpiringInvitation(aliceFile, "bob", client.PermissionRead, minute)
+			Expect(err).To(BeNil())
+			clock.Advance(2 * minute)
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(MatchError(client.ErrInvitationExpired))
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("A fresh invitation can still be accepted.")
+			invite, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Invitation Expiry Test: an invitation is accepted once, and a newer one replaces it", func() {
+			userlib.DebugMsg("Initializing Alice and Bob, and a second session for Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			bobLaptop, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+
+			userlib.DebugMsg("Alice invites Bob twice, only the second invitation works.")
+			first, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			second, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", first, bobFile)
+			Expect(err).To(MatchError(client.ErrInvitationUsed))
+			Expect(bob.AcceptInvitation("alice", second, bobFile)).To(BeNil())
+
+			userlib.DebugMsg("Bob cannot accept the same invitation again under another name.")
+			err = bobLaptop.AcceptInvitation("alice", second, charlesFile)
+			Expect(err).To(MatchError(client.ErrInvitationUsed))
+			_, err = bob.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Re-inviting Bob hands out a new invitation he can accept.")
+			third, err := alice.CreateInvitationWithPermission(aliceFile, "bob", client.PermissionRead)
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", third, charlesFile)).To(BeNil())
+			data, err := bob.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Invitation Expiry Test: the sender can cancel an invitation until it is accepted", func() {
+			userlib.DebugMsg("Initializing Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+
+			userlib.DebugMsg("Alice cancels the invitation to Bob before he accepts it.")
+			Expect(alice.CancelInvitation(aliceFile, "bob")).ToNot(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(alice.CancelInvitation(aliceFile, "bob")).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).ToNot(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			Expect(alice.RevokeAccess(aliceFile, "bob")).ToNot(BeNil())
+			Expect(alice.CancelInvitation(aliceFile, "bob")).ToNot(BeNil())
+
+			userlib.DebugMsg("Once Charles accepts, cancelling is too late and Alice has to revoke.")
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			Expect(charles.AcceptInvitation("alice", invite, charlesFile)).To(BeNil())
+			err = alice.CancelInvitation(aliceFile, "charles")
+			Expect(err).To(MatchError(client.ErrInvitationUsed))
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			Expect(alice.RevokeAccess(aliceFile, "charles")).To(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Invitation Expiry Test: an invitation sent before a password change can still be cancelled", func() {
+			userlib.DebugMsg("Alice invites Bob and changes her password before he accepts.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(alice.ChangePassword(defaultPassword, "newPassword")).To(BeNil())
+
+			userlib.DebugMsg("Cancelling finds the invitation and Bob can no longer accept it.")
+			Expect(alice.CancelInvitation(aliceFile, "bob")).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).ToNot(BeNil())
+			entries, err := alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+			Expect(alice.CancelInvitation(aliceFile, "bob")).ToNot(BeNil())
+		})
+	})
+
+	Describe("Inbox Tests", func() {
+		Specify("Inbox Test: invitations can be found and accepted through the inbox", func() {
+			userlib.DebugMsg("Initializing Alice, Bob, Charles and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			Expect(charles.StoreFile(charlesFile, []byte(contentTwo))).To(BeNil())
+			Expect(doris.StoreFile(dorisFile, []byte(contentThree))).To(BeNil())
+
+			userlib.DebugMsg("Bob's inbox starts out empty.")
+			pending, err := bob.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(BeEmpty())
+
+			userlib.DebugMsg("Alice, Charles and Doris invite Bob, Alice twice and Doris cancels hers.")
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = charles.CreateExpiringInvitation(charlesFile, "bob", client.PermissionRead, hour)
+			Expect(err).To(BeNil())
+			_, err = doris.CreateInvitation(dorisFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(doris.CancelInvitation(dorisFile, "bob")).To(BeNil())
+			latest, err := alice.CreateInvitationWithPermission(aliceFile, "bob", client.PermissionRead)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob sees the invitations he can still accept, oldest first.")
+			pending, err = bob.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(2))
+			Expect(pending[0].Sender).To(Equal("charles"))
+			Expect(pending[0].Filename).To(Equal(charlesFile))
+			Expect(pending[0].Expires).To(BeTemporally("~", client.SystemClock{}.Now().Add(hour), minute))
+			Expect(pending[1].Sender).To(Equal("alice"))
+			Expect(pending[1].Filename).To(Equal(aliceFile))
+			Expect(pending[1].InvitationPtr).To(Equal(latest))
+			Expect(pending[1].Expires).To(BeTemporally("~", client.SystemClock{}.Now().Add(client.DefaultInvitationTTL), minute))
+
+			userlib.DebugMsg("Bob accepts both from the inbox, which leaves it with nothing pending.")
+			for _, invitation := range pending {
+				Expect(bob.AcceptInvitation(invitation.Sender, invitation.InvitationPtr, invitation.Filename)).To(BeNil())
+			}
+			data, err := bob.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			data, err = bob.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+			pending, err = bob.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(BeEmpty())
+
+			userlib.DebugMsg("Other users cannot read Bob's inbox.")
+			pending, err = alice.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(BeEmpty())
+		})
+
+		Specify("Inbox Test: entries that were forged or removed are reported", func() {
+			userlib.DebugMsg("Initializing Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			otherFile := "aliceOtherFile.txt"
+			lastFile := "aliceLastFile.txt"
+			for _, filename := range []string{aliceFile, otherFile, lastFile} {
+				Expect(alice.StoreFile(filename, []byte(contentOne))).To(BeNil())
+			}
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(otherFile, "bob")
+			Expect(err).To(BeNil())
+			kept, err := alice.CreateInvitation(lastFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("An attacker tampers with one entry and removes another.")
+			entry, err := client.GetInboxSlotUUID("bob", 0)
+			Expect(err).To(BeNil())
+			value, ok := userlib.DatastoreGet(entry)
+			Expect(ok).To(BeTrue())
+			value[len(value)-1] ^= 0xff
+			userlib.DatastoreSet(entry, value)
+			entry, err = client.GetInboxSlotUUID("bob", 1)
+			Expect(err).To(BeNil())
+			userlib.DatastoreDelete(entry)
+
+			userlib.DebugMsg("Bob is told, sees the entry that is left, and is only told once.")
+			pending, err := bob.ListPendingInvitations()
+			Expect(err).To(MatchError(client.ErrInboxTampered))
+			Expect(pending).To(HaveLen(1))
+			Expect(pending[0].InvitationPtr).To(Equal(kept))
+			pending, err = bob.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+
+			userlib.DebugMsg("A forged head is reported and replaced, later invitations land in the new one.")
+			head, err := client.GetInboxHeadUUID("bob")
+			Expect(err).To(BeNil())
+			userlib.DatastoreSet(head, maliciousByte)
+			_, err = alice.CreateInvitation(otherFile, "bob")
+			Expect(err).To(BeNil())
+			pending, err = bob.ListPendingInvitations()
+			Expect(err).To(MatchError(client.ErrInboxTampered))
+			Expect(pending).To(BeEmpty())
+			latest, err := alice.CreateInvitation(otherFile, "bob")
+			Expect(err).To(BeNil())
+			pending, err = bob.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			Expect(pending[0].InvitationPtr).To(Equal(latest))
+			Expect(bob.AcceptInvitation("alice", latest, bobFile)).To(BeNil())
+		})
+
+		Specify("Inbox Test: entries are removed once accepted, cancelled, replaced or expired", func() {
+			userlib.DebugMsg("Initializing Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			Expect(charles.StoreFile(charlesFile, []byte(contentTwo))).To(BeNil())
+			inSlot := func(index uint64) bool {
+				slot, err := client.GetInboxSlotUUID("bob", index)
+				Expect(err).To(BeNil())
+				_, ok := userlib.DatastoreGet(slot)
+				return ok
+			}
+
+			userlib.DebugMsg("Replaced and cancelled invitations are dropped when Bob lists his inbox.")
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(alice.CancelInvitation(aliceFile, "bob")).To(BeNil())
+			Expect(inSlot(0)).To(BeTrue())
+			Expect(inSlot(1)).To(BeTrue())
+			pending, err := bob.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(BeEmpty())
+			Expect(inSlot(0)).To(BeFalse())
+			Expect(inSlot(1)).To(BeFalse())
+
+			userlib.DebugMsg("Accepting removes the entry, listing removes the ones that expired.")
+			accepted, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			expired, err := charles.CreateExpiringInvitation(charlesFile, "bob", client.PermissionRead, hour)
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", accepted, bobFile)).To(BeNil())
+			Expect(inSlot(2)).To(BeFalse())
+			Expect(inSlot(3)).To(BeFalse())
+			pending, err = bob.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			Expect(pending[0].InvitationPtr).To(Equal(expired))
+			clock := &client.OffsetClock{}
+			clock.Advance(2 * hour)
+			bob, err = client.GetUserWithOptions("bob", defaultPassword, client.SessionOptions{Clock: clock})
+			Expect(err).To(BeNil())
+			pending, err = bob.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(BeEmpty())
+		})
+
+		Specify("Inbox Test: the head hides who invited Bob, and cannot be put back or removed unnoticed", func() {
+			userlib.DebugMsg("Initializing Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			otherFile := "aliceOtherFile.txt"
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			Expect(alice.StoreFile(otherFile, []byte(contentTwo))).To(BeNil())
+			head, err := client.GetInboxHeadUUID("bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Neither Alice's name nor her filename shows in Bob's inbox.")
+			first, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			pending, err := bob.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+			before, ok := userlib.DatastoreGet(head)
+			Expect(ok).To(BeTrue())
+			Expect(string(before)).ToNot(ContainSubstring("alice"))
+
+			userlib.DebugMsg("A head that was put back is reported.")
+			_, err = alice.CreateInvitation(otherFile, "bob")
+			Expect(err).To(BeNil())
+			pending, err = bob.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(2))
+			userlib.DatastoreSet(head, before)
+			pending, err = bob.ListPendingInvitations()
+			Expect(err).To(MatchError(client.ErrInboxTampered))
+			Expect(pending).To(BeEmpty())
+
+			userlib.DebugMsg("So is a head that was removed, also from a new session, which still finds the entries sent since.")
+			latest, err := alice.CreateInvitation(otherFile, "bob")
+			Expect(err).To(BeNil())
+			userlib.DatastoreDelete(head)
+			bob, err = client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			pending, err = bob.ListPendingInvitations()
+			Expect(err).To(MatchError(client.ErrInboxTampered))
+			Expect(pending).To(HaveLen(1))
+			Expect(pending[0].InvitationPtr).To(Equal(latest))
+			pending, err = bob.ListPendingInvitations()
+			Expect(err).To(BeNil())
+			Expect(pending).To(HaveLen(1))
+
+			userlib.DebugMsg("Alice's first invitation can still be accepted.")
+			Expect(bob.AcceptInvitation("alice", first, aliceFile)).To(BeNil())
+		})
+	})
+
+	Describe("ListAccess Tests", func() {
+		Specify("ListAccess Test: the owner sees every user with access, a sharee those below them", func() {
+			userlib.DebugMsg("Initializing Alice, Bob, Charles and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+
+			userlib.DebugMsg("Nobody has access yet.")
+			entries, err := alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+
+			userlib.DebugMsg("Alice shares with Bob, Bob with Charles, and Alice invites Doris who has not accepted yet.")
+			start := client.SystemClock{}.Now()
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			invite, err = bob.CreateInvitationWithPermission(bobFile, "charles", client.PermissionRead)
+			Expect(err).To(BeNil())
+			Expect(charles.AcceptInvitation("bob", invite, charlesFile)).To(BeNil())
+			dorisInvite, err := alice.CreateInvitation(aliceFile, "doris")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice sees Bob and Charles, with who granted them access and when.")
+			entries, err = alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(2))
+			Expect(entries[0].Username).To(Equal("bob"))
+			Expect(entries[0].GrantedBy).To(Equal("alice"))
+			Expect(entries[0].Permission).To(Equal(client.PermissionReadWrite))
+			Expect(entries[1].Username).To(Equal("charles"))
+			Expect(entries[1].GrantedBy).To(Equal("bob"))
+			Expect(entries[1].Permission).To(Equal(client.PermissionRead))
+			for _, entry := range entries {
+				Expect(entry.Granted).To(BeTemporally(">=", start))
+				Expect(entry.Granted).To(BeTemporally("<=", client.SystemClock{}.Now()))
+			}
+			Expect(entries[0].Granted).To(BeTemporally("<=", entries[1].Granted))
+
+			userlib.DebugMsg("Bob sees only Charles, Charles sees nobody, Eve has no such file.")
+			entries, err = bob.ListAccess(bobFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Username).To(Equal("charles"))
+			entries, err = charles.ListAccess(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+			eve, err = client.InitUser("eve", defaultPassword)
+			Expect(err).To(BeNil())
+			_, err = eve.ListAccess(aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Once Doris accepts and Bob is revoked, only Doris is left.")
+			Expect(doris.AcceptInvitation("alice", dorisInvite, dorisFile)).To(BeNil())
+			Expect(alice.RevokeAccess(aliceFile, "bob")).To(BeNil())
+			entries, err = alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Username).To(Equal("doris"))
+			Expect(entries[0].GrantedBy).To(Equal("alice"))
+		})
+	})
+
+	Describe("Ownership Transfer Tests", func() {
+		Specify("Ownership Transfer Test: the new owner takes over and every sharee keeps access", func() {
+			userlib.DebugMsg("Initializing Alice, Bob, Charles and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares with Bob, who shares with Charles.")
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			invite, err = bob.CreateInvitationWithPermission(bobFile, "charles", client.PermissionRead)
+			Expect(err).To(BeNil())
+			Expect(charles.AcceptInvitation("bob", invite, charlesFile)).To(BeNil())
+
+			userlib.DebugMsg("Alice offers the file to Doris, and stays the owner until Doris accepts.")
+			_, err = bob.TransferOwnership(bobFile, "doris")
+			Expect(err).ToNot(BeNil())
+			_, err = alice.TransferOwnership(aliceFile, "alice")
+			Expect(err).ToNot(BeNil())
+			transfer, err := alice.TransferOwnership(aliceFile, "doris")
+			Expect(err).To(BeNil())
+			_, err = doris.LoadFile(dorisFile)
+			Expect(err).ToNot(BeNil())
+			entries, err := alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(2))
+			Expect(charles.AcceptOwnership("alice", transfer, charlesFile)).ToNot(BeNil())
+			Expect(doris.AcceptOwnership("bob", transfer, dorisFile)).ToNot(BeNil())
+
+			userlib.DebugMsg("Doris accepts and sees who has access, Alice included.")
+			Expect(doris.AcceptOwnership("alice", transfer, dorisFile)).To(BeNil())
+			Expect(doris.AcceptOwnership("alice", transfer, eveFile)).ToNot(BeNil())
+			data, err := doris.LoadFile(dorisFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			entries, err = doris.ListAccess(dorisFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(3))
+			grantedBy := make(map[string]string)
+			for _, entry := range entries {
+				grantedBy[entry.Username] = entry.GrantedBy
+			}
+			Expect(grantedBy).To(Equal(map[string]string{"alice": "doris", "bob": "alice", "charles": "bob"}))
+			files, err := doris.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]client.FileInfo{{Filename: dorisFile, IsOwner: true}}))
+
+			userlib.DebugMsg("Alice is now a writer on both of her sessions, and no longer the owner.")
+			Expect(aliceLaptop.AppendToFile(aliceFile, []byte(contentTwo))).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			files, err = alice.ListFiles()
+			Expect(err).To(BeNil())
+			Expect(files).To(Equal([]client.FileInfo{{Filename: aliceFile, IsOwner: false}}))
+			Expect(alice.RevokeAccess(aliceFile, "bob")).ToNot(BeNil())
+			_, err = alice.TransferOwnership(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Doris removes Alice, Bob and Charles keep their access.")
+			Expect(doris.RevokeAccess(dorisFile, "alice")).To(BeNil())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			Expect(bob.AppendToFile(bobFile, []byte(contentThree))).To(BeNil())
+			data, err = charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			entries, err = doris.ListAccess(dorisFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(2))
+		})
+
+		Specify("Ownership Transfer Test: a sharee can become the owner under the name they have the file as", func() {
+			userlib.DebugMsg("Initializing Alice, Bob and Charles, Alice shares with Bob who shares with Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			invite, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			Expect(charles.AcceptInvitation("bob", invite, charlesFile)).To(BeNil())
+
+			userlib.DebugMsg("Bob has to accept the file as %s.", bobFile)
+			transfer, err := alice.TransferOwnership(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptOwnership("alice", transfer, eveFile)).ToNot(BeNil())
+			Expect(bob.AcceptOwnership("alice", transfer, bobFile)).To(BeNil())
+
+			userlib.DebugMsg("Bob owns the file, Charles and Alice are below him.")
+			entries, err := bob.ListAccess(bobFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(2))
+			for _, entry := range entries {
+				Expect(entry.GrantedBy).To(Equal("bob"))
+				Expect(entry.Permission).To(Equal(client.PermissionReadWrite))
+			}
+			Expect(bob.RevokeAccess(bobFile, "charles")).To(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+			Expect(alice.AppendToFile(aliceFile, []byte(contentTwo))).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Bob can hand the file back to Alice.")
+			transfer, err = bob.TransferOwnership(bobFile, "alice")
+			Expect(err).To(BeNil())
+			Expect(alice.AcceptOwnership("bob", transfer, aliceFile)).To(BeNil())
+			entries, err = alice.ListAccess(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Username).To(Equal("bob"))
+			Expect(alice.RevokeAccess(aliceFile, "bob")).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Ownership Transfer Test: the chunks of a deduplicated file stay with the old owner", func() {
+			userlib.DebugMsg("Alice stores the same content in two deduplicated files.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			content := userlib.RandomBytes(3 * client.BlockSize)
+			for _, filename := range []string{aliceFile, charlesFile} {
+				Expect(alice.StoreFile(filename, content)).To(BeNil())
+				Expect(alice.SetDeduplication(filename, true)).To(BeNil())
+			}
+
+			userlib.DebugMsg("Bob takes one over, replaces its content and removes Alice.")
+			transfer, err := alice.TransferOwnership(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptOwnership("alice", transfer, bobFile)).To(BeNil())
+			Expect(bob.StoreFile(bobFile, []byte(contentOne))).To(BeNil())
+			Expect(bob.RevokeAccess(bobFile, "alice")).To(BeNil())
+			Expect(bob.StoreFile(bobFile, []byte(contentTwo))).To(BeNil())
+
+			userlib.DebugMsg("Alice's other file still has all of its chunks.")
+			data, err := alice.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+		})
+
+		Specify("Ownership Transfer Test: a transfer can be replaced or withdrawn until it is accepted", func() {
+			userlib.DebugMsg("Initializing Alice, Bob and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			Expect(charles.AcceptInvitation("alice", invite, charlesFile)).To(BeNil())
+
+			userlib.DebugMsg("A second offer replaces the first.")
+			first, err := alice.TransferOwnership(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			second, err := alice.TransferOwnership(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptOwnership("alice", first, bobFile)).ToNot(BeNil())
+
+			userlib.DebugMsg("Revoking Charles withdraws the offer, which would hand out the old keys.")
+			Expect(alice.RevokeAccess(aliceFile, "charles")).To(BeNil())
+			Expect(bob.AcceptOwnership("alice", second, bobFile)).ToNot(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("A tampered offer is rejected, an untouched one goes through.")
+			third, err := alice.TransferOwnership(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			value, ok := userlib.DatastoreGet(third)
+			Expect(ok).To(BeTrue())
+			tampered := append([]byte{}, value...)
+			tampered[len(tampered)-1] ^= 0xff
+			userlib.DatastoreSet(third, tampered)
+			Expect(bob.AcceptOwnership("alice", third, bobFile)).ToNot(BeNil())
+			userlib.DatastoreSet(third, value)
+			Expect(bob.AcceptOwnership("alice", third, bobFile)).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Deleting the file as the new owner removes it for Alice too.")
+			Expect(bob.DeleteFile(bobFile)).To(BeNil())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Ownership Transfer Test: revoking the old owner moves the share tree to keys they never held", func() {
+			userlib.DebugMsg("Initializing Alice, Bob, Charles, Doris, Eve and Frank.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+			eve, err = client.InitUser("eve", defaultPassword)
+			Expect(err).To(BeNil())
+			frank, err = client.InitUser("frank", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares with Bob, who shares with Charles, and invites Eve.")
+			Expect(alice.StoreFile(aliceFile, []byte(contentOne))).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(bob.AcceptInvitation("alice", invite, bobFile)).To(BeNil())
+			invite, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			Expect(charles.AcceptInvitation("bob", invite, charlesFile)).To(BeNil())
+			eveInvite, err := alice.CreateInvitation(aliceFile, "eve")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Doris takes the file, shares it with Frank, then revokes Frank and Alice.")
+			transfer, err := alice.TransferOwnership(aliceFile, "doris")
+			Expect(err).To(BeNil())
+			Expect(doris.AcceptOwnership("alice", transfer, dorisFile)).To(BeNil())
+			invite, err = doris.CreateInvitation(dorisFile, "frank")
+			Expect(err).To(BeNil())
+			Expect(frank.AcceptInvitation("doris", invite, frankFile)).To(BeNil())
+			Expect(doris.RevokeAccess(dorisFile, "frank")).To(BeNil())
+			Expect(doris.RevokeAccess(dorisFile, "alice")).To(BeNil())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Doris hands the file on to Frank before anyone loads it again.")
+			frankOwnedFile := "frankOwnedFile.txt"
+			transfer, err = doris.TransferOwnership(dorisFile, "frank")
+			Expect(err).To(BeNil())
+			Expect(frank.AcceptOwnership("doris", transfer, frankOwnedFile)).To(BeNil())
+
+			userlib.DebugMsg("Bob, Charles and Eve follow their nodes to the new keys, Alice stays out.")
+			Expect(bob.AppendToFile(bobFile, []byte(contentTwo))).To(BeNil())
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			Expect(eve.AcceptInvitation("alice", eveInvite, eveFile)).To(BeNil())
+			data, err = eve.LoadFile(eveFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			entries, err := frank.ListAccess(frankOwnedFile)
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(4))
+
+			userlib.DebugMsg("Frank revokes Bob, Charles goes with him, Eve and Doris keep their access.")
+			Expect(frank.RevokeAccess(frankOwnedFile, "bob")).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+			Expect(doris.AppendToFile(dorisFile, []byte(contentThree))).To(BeNil())
+			data, err = eve.LoadFile(eveFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+		})
+	})
+
+	//THEIR TESTS
+	Describe("Basic Tests", func() {
+
+		Specify("Basic Test: Testing InitUser/GetUser on a single user.", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Getting user Alice.")
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Basic Test: Testing Single User Store/Load/Append.", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Storing file data: %s", contentOne)
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Appending file data: %s", contentTwo)
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Appending file data: %s", contentThree)
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Loading file...")
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+		})
+
+		Specify("Basic Test: Testing Create/Accept Invite Functionality with multiple users and multiple instances.", func() {
+			userlib.DebugMsg("Initializing users Alice (aliceDesktop) and Bob.")
+			aliceDesktop, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Getting second instance of Alice - aliceLaptop")
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("aliceDesktop storing file %s with content: %s", aliceFile, contentOne)
+			err = aliceDesktop.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("aliceLaptop creating invite for Bob.")
+			invite, err := aliceLaptop.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob accepting invite from Alice under filename %s.", bobFile)
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob appending to file %s, content: %s", bobFile, contentTwo)
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("aliceDesktop appending to file %s, content: %s", aliceFile, contentThree)
+			err = aliceDesktop.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Checking that aliceDesktop sees expected file data.")
+			data, err := aliceDesktop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+
+			userlib.DebugMsg("Checking that aliceLaptop sees expected file data.")
+			data, err = aliceLaptop.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+
+			userlib.DebugMsg("Checking that Bob sees expected file data.")
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+
+			userlib.DebugMsg("Getting third instance of Alice - alicePhone.")
+			alicePhone, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Checking that alicePhone sees Alice's changes.")
+			data, err = alicePhone.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+		})
+
+		Specify("Basic Test: Testing Revoke Functionality", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charlie.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice storing file %s with content: %s", aliceFile, contentOne)
+			alice.StoreFile(aliceFile, []byte(contentOne))
+
+			userlib.DebugMsg("Alice creating invite for Bob for file %s, and Bob accepting invite under name %s.", aliceFile, bobFile)
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			//
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Checking that Alice can still load the file.")
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Checking that Bob can load the file.")
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Bob creating invite for Charles for file %s, and Charlie accepting invite under name %s.", bobFile, charlesFile)
+			invite, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+
+			err = charles.AcceptInvitation("bob", invite, charlesFile)
 			Expect(err).To(BeNil())
 
 			userlib.DebugMsg("Checking that Bob can load the file.")
@@ -1033,4 +4462,4 @@ var _ = Describe("Client Tests", func() {
 		})
 
 	})
-})
+}